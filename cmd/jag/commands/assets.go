@@ -0,0 +1,347 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/setanta314/ar"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func AssetsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "assets",
+		Short: "Inspect assets files",
+		Long: "Inspect assets files, like the ones attached to programs with '--assets'.\n" +
+			"Assets files are created with 'jag toit tool assets'.",
+	}
+
+	cmd.AddCommand(AssetsListCmd())
+	return cmd
+}
+
+// assetsJsonEntry is an element of the 'jag assets list --json' output.
+type assetsJsonEntry struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	Type string `json:"type"`
+}
+
+func AssetsListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list <assets-file>",
+		Short: "List the assets in an assets file",
+		Long: "List the assets in an assets file, with their sizes and types.\n" +
+			"The type is guessed from the content: tison, json, text or binary.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			jsonOutput, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return err
+			}
+
+			path := args[0]
+			if err := checkAssetsPath(path); err != nil {
+				return err
+			}
+			assets, err := readAssets(path)
+			if err != nil {
+				return err
+			}
+
+			if jsonOutput {
+				res := []assetsJsonEntry{}
+				for _, a := range assets {
+					res = append(res, assetsJsonEntry{Name: a.name, Size: len(a.data), Type: a.guessType()})
+				}
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(res)
+			}
+
+			// Compute the column lengths for all columns except for the last.
+			nameLength := len("NAME")
+			sizeLength := len("SIZE")
+			total := 0
+			for _, a := range assets {
+				nameLength = max(nameLength, len(a.name))
+				sizeLength = max(sizeLength, len(strconv.Itoa(len(a.data))))
+				total += len(a.data)
+			}
+
+			fmt.Println(padded("NAME", nameLength) + padded("SIZE", sizeLength) + "TYPE")
+			for _, a := range assets {
+				fmt.Println(padded(a.name, nameLength) + padded(strconv.Itoa(len(a.data)), sizeLength) + a.guessType())
+			}
+			fmt.Printf("\n%d assets, %d bytes in total\n", len(assets), total)
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("json", false, "print the assets as a JSON array")
+	return cmd
+}
+
+// asset is a single entry of an assets bundle.
+type asset struct {
+	name string
+	data []byte
+}
+
+// guessType returns the likely format of the asset. The assets file doesn't
+// record the format, so it is guessed from the content.
+func (a asset) guessType() string {
+	if a.name == "jag.defines" {
+		// Jaguar always adds the defines as TISON.
+		return "tison"
+	}
+	if json.Valid(a.data) {
+		return "json"
+	}
+	if utf8.Valid(a.data) {
+		text := true
+		for _, r := range string(a.data) {
+			if unicode.IsControl(r) && !unicode.IsSpace(r) {
+				text = false
+				break
+			}
+		}
+		if text {
+			return "text"
+		}
+	}
+	return "binary"
+}
+
+// readAssets reads the entries of an assets bundle. Bundles are ar archives
+// with one entry per asset.
+func readAssets(path string) ([]asset, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(ar.GLOBAL_HEADER))
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != ar.GLOBAL_HEADER {
+		return nil, fmt.Errorf("'%s' is not an assets file", path)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var res []asset
+	reader := ar.NewReader(f)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read assets file '%s': %w", path, err)
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read assets file '%s': %w", path, err)
+		}
+		// GNU ar terminates names with a slash.
+		res = append(res, asset{name: strings.TrimSuffix(header.Name, "/"), data: data})
+	}
+}
+
+// largeAssetSize is the size above which an asset read from a directory
+// likely doesn't fit in the flash of the device, together with the program.
+const largeAssetSize = 256 * 1024
+
+// isAssetFile returns whether a file in a directory given with
+// '--assets-from-dir' is bundled. Hidden files and editor backups are
+// skipped.
+func isAssetFile(name string) bool {
+	return !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, "~")
+}
+
+// readAssetsDir reads the files in the directory and its subdirectories as
+// assets. The name of each asset is the path of the file relative to the
+// directory, with forward slashes.
+func readAssetsDir(dir string) ([]asset, error) {
+	var res []asset
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		if !isAssetFile(entry.Name()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if len(data) > largeAssetSize {
+			fmt.Fprintf(os.Stderr, "Warning: asset '%s' from '%s' is %s, which might not fit on the device\n", name, dir, formatSize(int64(len(data))))
+		}
+		res = append(res, asset{name: name, data: data})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read assets from '%s': %w", dir, err)
+	}
+	return res, nil
+}
+
+// assetsSubdirs returns the directory and its subdirectories that hold
+// assets, so they can be watched.
+func assetsSubdirs(dir string) []string {
+	var res []string
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+		if path != dir && !isAssetFile(entry.Name()) {
+			return filepath.SkipDir
+		}
+		res = append(res, path)
+		return nil
+	})
+	return res
+}
+
+// getProgramAssetsDirs returns the directories given with the repeatable
+// flag.
+func getProgramAssetsDirs(flags *pflag.FlagSet, flagName string) ([]string, error) {
+	if !flags.Changed(flagName) {
+		return nil, nil
+	}
+
+	dirs, err := flags.GetStringArray(flagName)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if stat, err := os.Stat(d); err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("no such directory: '%s'", d)
+			}
+			return nil, err
+		} else if !stat.IsDir() {
+			return nil, fmt.Errorf("--%s must be a directory: '%s' (use --assets for assets files)", flagName, d)
+		}
+	}
+	return dirs, nil
+}
+
+// GetProgramAssetsPaths returns the assets files given with the repeatable
+// flag.
+func GetProgramAssetsPaths(flags *pflag.FlagSet, flagName string) ([]string, error) {
+	if !flags.Changed(flagName) {
+		return nil, nil
+	}
+
+	paths, err := flags.GetStringArray(flagName)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		if err := checkAssetsPath(p); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// prepareAssets returns the path of a single assets file for the given
+// bundles and the files in the given directories. Multiple bundles, or any
+// directory, are merged into a temporary file, which is removed by the
+// returned cleanup function. The directories come after the bundles. Assets
+// that are in more than one bundle or directory are an error, unless
+// overwrite is set, in which case later ones win.
+func prepareAssets(ctx context.Context, sdk *SDK, paths []string, dirs []string, overwrite bool) (string, func(), error) {
+	if len(dirs) == 0 {
+		switch len(paths) {
+		case 0:
+			return "", func() {}, nil
+		case 1:
+			return paths[0], func() {}, nil
+		}
+	}
+
+	var merged []asset
+	origins := map[string]string{}
+	indexes := map[string]int{}
+	sources := append(append([]string{}, paths...), dirs...)
+	for i, p := range sources {
+		var assets []asset
+		var err error
+		if i < len(paths) {
+			assets, err = readAssets(p)
+		} else {
+			assets, err = readAssetsDir(p)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		for _, a := range assets {
+			if i, ok := indexes[a.name]; ok {
+				if !overwrite {
+					return "", nil, fmt.Errorf("asset '%s' is in both '%s' and '%s' (use --assets-overwrite to let the later one win)", a.name, origins[a.name], p)
+				}
+				merged[i] = a
+			} else {
+				indexes[a.name] = len(merged)
+				merged = append(merged, a)
+			}
+			origins[a.name] = p
+		}
+	}
+
+	tempdir, err := os.MkdirTemp("", "jag_assets")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tempdir) }
+	output := filepath.Join(tempdir, "merged.assets")
+	if err := runAssetsTool(ctx, sdk, output, "create"); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	for i, a := range merged {
+		dataFile := filepath.Join(tempdir, fmt.Sprintf("asset-%d", i))
+		if err := os.WriteFile(dataFile, a.data, 0644); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		if err := runAssetsTool(ctx, sdk, output, "add", "--format=binary", a.name, dataFile); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("failed to add asset '%s': %w", a.name, err)
+		}
+	}
+	return output, cleanup, nil
+}
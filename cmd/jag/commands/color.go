@@ -0,0 +1,81 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const (
+	colorFlagName string = "color"
+	ctxKeyColor   ctxKey = "color"
+
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+// style is the ANSI escape sequence that starts a color.
+type style string
+
+const (
+	styleSuccess style = "\033[32m"
+	styleError   style = "\033[31m"
+	styleChange  style = "\033[33m"
+
+	styleReset = "\033[0m"
+)
+
+// resolveColor returns whether the output to stdout is colored for the
+// given '--color' mode. In 'auto' mode the output is colored if stdout is
+// a terminal, unless the NO_COLOR environment variable is set.
+func resolveColor(mode string) (bool, error) {
+	switch mode {
+	case colorAlways:
+		return true, nil
+	case colorNever:
+		return false, nil
+	case colorAuto:
+		if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+			return false, nil
+		}
+		return term.IsTerminal(int(os.Stdout.Fd())), nil
+	default:
+		return false, fmt.Errorf("invalid --%s '%s', must be '%s', '%s', or '%s'", colorFlagName, mode, colorAuto, colorAlways, colorNever)
+	}
+}
+
+// withColor returns the context with colored output enabled or disabled.
+// Machine readable output, like '--json', disables it.
+func withColor(ctx context.Context, color bool) context.Context {
+	return context.WithValue(ctx, ctxKeyColor, color)
+}
+
+// useColor returns whether the output to stdout is colored.
+func useColor(ctx context.Context) bool {
+	color, _ := ctx.Value(ctxKeyColor).(bool)
+	return color
+}
+
+// paint returns the text in the style, if colored output is enabled.
+func paint(ctx context.Context, s style, text string) string {
+	return s.apply(useColor(ctx), text)
+}
+
+// apply returns the text in the style if enabled is set. A trailing newline
+// is kept outside the colored part, so the color doesn't leak into the
+// next line.
+func (s style) apply(enabled bool, text string) string {
+	if !enabled || text == "" {
+		return text
+	}
+	trimmed := strings.TrimSuffix(text, "\n")
+	return string(s) + trimmed + styleReset + text[len(trimmed):]
+}
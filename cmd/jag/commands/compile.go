@@ -5,8 +5,11 @@
 package commands
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -18,9 +21,14 @@ func CompileCmd() *cobra.Command {
 		Short: "Compile Toit code to a snapshot",
 		Long: "Compile Toit code to a snapshot file.  The snapshot is an executable\n" +
 			"can be run on a Jaguar device as a new program.  The snapshot also\n" +
-			"contains debug information that can be used by host-side tools.",
+			"contains debug information that can be used by host-side tools.\n" +
+			"\n" +
+			"Snapshots don't contain assets. With '--assets' the given assets files are\n" +
+			"merged into a file next to the snapshot, so the two can be deployed together\n" +
+			"with 'jag run <snapshot> --assets <assets>'.\n" +
+			"\n" +
+			"If the compiler fails, jag exits with the exit code of the compiler.",
 		Args:         cobra.ExactArgs(1),
-		Hidden:       true,
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			entrypoint := args[0]
@@ -33,19 +41,29 @@ func CompileCmd() *cobra.Command {
 				return fmt.Errorf("can't run directory: '%s'", entrypoint)
 			}
 
-			ctx := cmd.Context()
+			ctx, err := withProjectConfig(cmd.Context(), entrypoint)
+			if err != nil {
+				return err
+			}
 
 			sdk, err := GetSDK(ctx)
 			if err != nil {
 				return err
 			}
 
-			optimizationLevel := -1
-			if cmd.Flags().Changed("optimization-level") {
-				optimizationLevel, err = cmd.Flags().GetInt("optimization-level")
-				if err != nil {
-					return err
-				}
+			optimizationLevel, err := parseOptimizationLevelFlag(cmd)
+			if err != nil {
+				return err
+			}
+
+			assetsPaths, err := GetProgramAssetsPaths(cmd.Flags(), "assets")
+			if err != nil {
+				return err
+			}
+
+			assetsOverwrite, err := cmd.Flags().GetBool("assets-overwrite")
+			if err != nil {
+				return err
 			}
 
 			outputfile := ""
@@ -79,15 +97,35 @@ func CompileCmd() *cobra.Command {
 				// We assume the error has been printed.
 				// Mark the command as silent to avoid printing the error twice.
 				cmd.SilenceErrors = true
+				var exitErr *exec.ExitError
+				if errors.As(err, &exitErr) {
+					return &ExitCodeError{exitErr.ExitCode()}
+				}
 				return err
 			}
 
 			fmt.Printf("Success: Wrote compiled bytecodes to '%s'\n", outputfile)
+
+			if len(assetsPaths) == 0 {
+				return nil
+			}
+			assetsPath, cleanupAssets, err := prepareAssets(ctx, sdk, assetsPaths, nil, assetsOverwrite)
+			if err != nil {
+				return err
+			}
+			defer cleanupAssets()
+			assetsOutput := strings.TrimSuffix(outputfile, filepath.Ext(outputfile)) + ".assets"
+			if err := copyFileAtomic(assetsPath, assetsOutput); err != nil {
+				return err
+			}
+			fmt.Printf("Success: Wrote assets to '%s'\n", assetsOutput)
 			return nil
 		},
 	}
 
 	cmd.Flags().StringP("output", "o", "", "specify output (snapshot) file")
-	cmd.Flags().IntP("optimization-level", "O", -1, "optimization level")
+	cmd.Flags().StringP("optimization-level", "O", "", optimizationLevelUsage)
+	cmd.Flags().StringArray("assets", nil, "assets files to deploy with the snapshot (can be repeated to merge several assets files)")
+	cmd.Flags().Bool("assets-overwrite", false, "let later '--assets' files replace assets of the same name instead of failing")
 	return cmd
 }
@@ -5,10 +5,16 @@
 package commands
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"github.com/toitlang/jaguar/cmd/jag/directory"
 )
 
@@ -16,16 +22,27 @@ const (
 	WifiCfgKey         = "wifi"
 	WifiSSIDCfgKey     = "ssid"
 	WifiPasswordCfgKey = "password"
+
+	WatchDebounceCfgKey = "watch.debounce"
 )
 
 func ConfigCmd(info Info) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "config",
 		Short: "Configure Jaguar",
-		Long:  "Configure the Jaguar command line tool.",
+		Long: "Configure the Jaguar command line tool.\n" +
+			"The settings are stored in the user configuration. Settings that are\n" +
+			"defaults for flags are overridden by the flags. In general the order is:\n" +
+			"flag, then the project configuration in 'jag.yaml', then the user\n" +
+			"configuration, then the built-in default.\n" +
+			"Use 'jag config list' to see the supported keys.",
 	}
 
 	cmd.AddCommand(
+		ConfigGetCmd(),
+		ConfigSetCmd(),
+		ConfigUnsetCmd(),
+		ConfigListCmd(),
 		ConfigAnalyticsCmd(),
 		ConfigUpToDateCmd(info),
 		ConfigWifiCmd(),
@@ -195,3 +212,277 @@ func configUpToDate(info Info, disable bool) func(*cobra.Command, []string) erro
 		return nil
 	}
 }
+
+// configSetting is a key that can be changed with 'jag config set'.
+type configSetting struct {
+	key         string
+	description string
+	// Stored in the device configuration instead of the user configuration.
+	device bool
+	// Don't print the value in 'jag config list'.
+	secret bool
+	// parse validates the value given on the command line and returns the
+	// value to store.
+	parse func(value string) (interface{}, error)
+}
+
+func parseBoolSetting(value string) (interface{}, error) {
+	res, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value '%s', must be true or false", value)
+	}
+	return res, nil
+}
+
+func parseStringSetting(value string) (interface{}, error) {
+	if value == "" {
+		return nil, fmt.Errorf("the value must not be empty, use 'jag config unset' to remove it")
+	}
+	return value, nil
+}
+
+var configSettings = []configSetting{
+	{
+		key:         "analytics.disabled",
+		description: "don't send anonymous usage statistics and crash reports",
+		parse:       parseBoolSetting,
+	},
+	{
+		key:         UpToDateKey + ".disabled",
+		description: "don't check periodically whether Jaguar is up to date",
+		parse:       parseBoolSetting,
+	},
+	{
+		key:         SDKVersionCfgKey,
+		description: "the Toit SDK version to use, see 'jag sdk'",
+		parse: func(value string) (interface{}, error) {
+			path, err := installedSDKPath(value)
+			if err != nil {
+				return nil, err
+			}
+			if path == "" {
+				return nil, fmt.Errorf("Toit SDK %s isn't installed.\nRun 'jag sdk install %s' to install it", value, value)
+			}
+			return value, nil
+		},
+	},
+	{
+		key:         WifiCfgKey + "." + WifiSSIDCfgKey,
+		description: "the default WiFi network name for 'jag flash' and 'jag firmware update'",
+		parse:       parseStringSetting,
+	},
+	{
+		key:         WifiCfgKey + "." + WifiPasswordCfgKey,
+		description: "the default WiFi password",
+		secret:      true,
+		parse: func(value string) (interface{}, error) {
+			return value, nil
+		},
+	},
+	{
+		key:         "port",
+		description: "the default serial port, see 'jag port set'",
+		device:      true,
+		parse:       parseStringSetting,
+	},
+	{
+		key:         WatchDebounceCfgKey,
+		description: "the default '--debounce' of 'jag watch'",
+		parse: func(value string) (interface{}, error) {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid duration '%s', must be like '250ms'", value)
+			}
+			return d.String(), nil
+		},
+	},
+}
+
+func findConfigSetting(key string) (configSetting, error) {
+	var keys []string
+	for _, setting := range configSettings {
+		if setting.key == key {
+			return setting, nil
+		}
+		keys = append(keys, setting.key)
+	}
+	sort.Strings(keys)
+	return configSetting{}, fmt.Errorf("unknown key '%s', the supported keys are: %s", key, strings.Join(keys, ", "))
+}
+
+func (s configSetting) config() (*viper.Viper, error) {
+	if s.device {
+		return directory.GetDeviceConfig()
+	}
+	return directory.GetUserConfig()
+}
+
+func ConfigGetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "get <key>",
+		Short:        "Print the value of a setting",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			setting, err := findConfigSetting(args[0])
+			if err != nil {
+				return err
+			}
+			cfg, err := setting.config()
+			if err != nil {
+				return err
+			}
+			if !cfg.IsSet(setting.key) {
+				return fmt.Errorf("'%s' isn't set", setting.key)
+			}
+			fmt.Println(cfg.GetString(setting.key))
+			return nil
+		},
+	}
+	return cmd
+}
+
+func ConfigSetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "set <key> <value>",
+		Short:        "Change a setting",
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			setting, err := findConfigSetting(args[0])
+			if err != nil {
+				return err
+			}
+			value, err := setting.parse(args[1])
+			if err != nil {
+				return fmt.Errorf("can't set '%s': %w", setting.key, err)
+			}
+			cfg, err := setting.config()
+			if err != nil {
+				return err
+			}
+			cfg.Set(setting.key, value)
+			return directory.WriteConfig(cfg)
+		},
+	}
+	return cmd
+}
+
+func ConfigUnsetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "unset <key>",
+		Short:        "Remove a setting, so the default is used",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			setting, err := findConfigSetting(args[0])
+			if err != nil {
+				return err
+			}
+			cfg, err := setting.config()
+			if err != nil {
+				return err
+			}
+			if !cfg.IsSet(setting.key) {
+				return nil
+			}
+			cfg, err = unsetConfigKey(cfg, setting.key)
+			if err != nil {
+				return err
+			}
+			return directory.WriteConfig(cfg)
+		},
+	}
+	return cmd
+}
+
+// unsetConfigKey returns a copy of the configuration without the given
+// dotted key. Viper can't remove keys, so the configuration is rebuilt.
+func unsetConfigKey(cfg *viper.Viper, key string) (*viper.Viper, error) {
+	settings := cfg.AllSettings()
+	parts := strings.Split(key, ".")
+	parent := settings
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := parent[part].(map[string]interface{})
+		if !ok {
+			return cfg, nil
+		}
+		parent = child
+	}
+	delete(parent, parts[len(parts)-1])
+
+	res := viper.New()
+	res.SetConfigType("yaml")
+	res.SetConfigFile(cfg.ConfigFileUsed())
+	if err := res.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// configEntry is an element of the 'jag config list --json' output.
+type configEntry struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	Set         bool   `json:"set"`
+	Description string `json:"description"`
+}
+
+func ConfigListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "list",
+		Short:        "List the supported settings and their values",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			jsonOutput, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return err
+			}
+			userCfg, err := directory.GetUserConfig()
+			if err != nil {
+				return err
+			}
+			deviceCfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+
+			entries := []configEntry{}
+			for _, setting := range configSettings {
+				cfg := userCfg
+				if setting.device {
+					cfg = deviceCfg
+				}
+				entry := configEntry{
+					Key:         setting.key,
+					Set:         cfg.IsSet(setting.key),
+					Description: setting.description,
+				}
+				if entry.Set {
+					entry.Value = cfg.GetString(setting.key)
+					if setting.secret && entry.Value != "" {
+						entry.Value = "********"
+					}
+				}
+				entries = append(entries, entry)
+			}
+
+			if jsonOutput {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(entries)
+			}
+			for _, entry := range entries {
+				value := entry.Value
+				if !entry.Set {
+					value = "(not set)"
+				}
+				fmt.Printf("%-20s %-20s %s\n", entry.Key, value, entry.Description)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().Bool("json", false, "print the settings as a JSON array")
+	return cmd
+}
@@ -5,8 +5,10 @@
 package commands
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -25,6 +27,7 @@ func ContainerCmd() *cobra.Command {
 	cmd.AddCommand(ContainerListCmd())
 	cmd.AddCommand(ContainerInstallCmd())
 	cmd.AddCommand(ContainerUninstallCmd())
+	cmd.AddCommand(ContainerStopCmd())
 	return cmd
 }
 
@@ -38,7 +41,16 @@ func ContainerListCmd() *cobra.Command {
 				return err
 			}
 
+			jsonOutput, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return err
+			}
+
 			ctx := cmd.Context()
+			if jsonOutput {
+				// Keep stdout for the JSON.
+				ctx = withOutput(ctx, os.Stderr)
+			}
 			sdk, err := GetSDK(ctx)
 			if err != nil {
 				return err
@@ -54,6 +66,10 @@ func ContainerListCmd() *cobra.Command {
 				return err
 			}
 
+			if jsonOutput {
+				return printContainersJson(device, containers)
+			}
+
 			// Compute the column lengths for all columns except for the last.
 			deviceNameLength := max(len("DEVICE"), len(device.Name()))
 			idLength := len("IMAGE")
@@ -70,9 +86,32 @@ func ContainerListCmd() *cobra.Command {
 	}
 
 	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	cmd.Flags().Bool("json", false, "print the containers as a JSON array")
 	return cmd
 }
 
+// containerJson is an element of the 'jag container list --json' output.
+type containerJson struct {
+	Device string `json:"device"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+}
+
+func printContainersJson(device Device, containers map[string]string) error {
+	res := []containerJson{}
+	for id, name := range containers {
+		res = append(res, containerJson{
+			Device: device.Name(),
+			ID:     id,
+			Name:   name,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(res)
+}
+
 func ContainerInstallCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use: "install <name> <file>",
@@ -112,12 +151,9 @@ func ContainerInstallCmd() *cobra.Command {
 				return fmt.Errorf("can't run directory: '%s'", entrypoint)
 			}
 
-			optimizationLevel := -1
-			if cmd.Flags().Changed("optimization-level") {
-				optimizationLevel, err = cmd.Flags().GetInt("optimization-level")
-				if err != nil {
-					return err
-				}
+			optimizationLevel, err := parseOptimizationLevelFlag(cmd)
+			if err != nil {
+				return err
 			}
 
 			sdk, err := GetSDK(ctx)
@@ -162,7 +198,7 @@ func ContainerInstallCmd() *cobra.Command {
 	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
 	cmd.Flags().StringArrayP("define", "D", nil, "define settings to control container on device")
 	cmd.Flags().String("assets", "", "attach assets to the container")
-	cmd.Flags().IntP("optimization-level", "O", -1, "optimization level")
+	cmd.Flags().StringP("optimization-level", "O", "", optimizationLevelUsage)
 	cmd.Flags().String("interval", "", "interval for container starts")
 	return cmd
 }
@@ -199,6 +235,97 @@ func ContainerUninstallCmd() *cobra.Command {
 	return cmd
 }
 
+func ContainerStopCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stop [name]",
+		Short: "Stop running containers on a device",
+		Long: "Stop running containers on a device.\n" +
+			"Either give the name of the container, use '--prefix' to stop all\n" +
+			"containers whose name starts with the prefix, or use '--all' to stop all\n" +
+			"containers. The Jaguar container itself is never stopped.\n" +
+			"Stopped containers that are installed run again when the device reboots.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			deviceSelect, err := parseDeviceFlag(cmd)
+			if err != nil {
+				return err
+			}
+
+			all, err := cmd.Flags().GetBool("all")
+			if err != nil {
+				return err
+			}
+			prefix, err := cmd.Flags().GetString("prefix")
+			if err != nil {
+				return err
+			}
+			selections := 0
+			if len(args) == 1 {
+				selections++
+			}
+			if all {
+				selections++
+			}
+			if cmd.Flags().Changed("prefix") {
+				selections++
+			}
+			if selections != 1 {
+				return fmt.Errorf("exactly one of a container name, --prefix or --all must be given")
+			}
+
+			sdk, err := GetSDK(ctx)
+			if err != nil {
+				return err
+			}
+
+			device, err := GetDevice(ctx, sdk, true, deviceSelect)
+			if err != nil {
+				return err
+			}
+
+			containers, err := device.ContainerList(ctx, sdk)
+			if err != nil {
+				return err
+			}
+
+			var names []string
+			for _, name := range containers {
+				if name == "jaguar" {
+					continue
+				}
+				if all || (len(args) == 1 && name == args[0]) || (len(args) == 0 && strings.HasPrefix(name, prefix)) {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			if len(args) == 1 && len(names) == 0 {
+				return fmt.Errorf("no container '%s' on '%s'", args[0], device.Name())
+			}
+
+			stopped := 0
+			for _, name := range names {
+				wasRunning, err := device.ContainerStop(ctx, sdk, name)
+				if err != nil {
+					return fmt.Errorf("failed to stop container '%s': %w", name, err)
+				}
+				if wasRunning {
+					fmt.Printf("Stopped container '%s'\n", name)
+					stopped++
+				}
+			}
+			fmt.Printf("Stopped %d of %d containers on '%s'\n", stopped, len(names), device.Name())
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	cmd.Flags().Bool("all", false, "stop all containers")
+	cmd.Flags().String("prefix", "", "stop all containers whose name starts with this prefix")
+	return cmd
+}
+
 func padded(prefix string, total int) string {
 	return prefix + strings.Repeat(" ", 3+total-len(prefix))
 }
@@ -8,12 +8,15 @@ import (
 	"bufio"
 	"context"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/mitchellh/mapstructure"
@@ -24,11 +27,19 @@ import (
 
 func DecodeCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "decode <message>",
+		Use:   "decode [message]",
 		Short: "Decode a stack trace received from a Jaguar device",
 		Long: "Decode a stack trace received from a Jaguar device. Stack traces are encoded\n" +
-			"using base64 and are easy to copy from the serial output.",
-		Args:         cobra.ExactArgs(1),
+			"using base64 and are easy to copy from the serial output.\n" +
+			"\n" +
+			"If no message is given, or the message is '-', the message is read from\n" +
+			"stdin. Use '--file' to read it from a file instead. When reading from stdin\n" +
+			"or a file, all 'jag decode' and 'Backtrace:' lines are decoded, so the\n" +
+			"output of 'jag monitor --output' can be decoded directly.\n" +
+			"\n" +
+			"By default the snapshot of the program is found by its ID in the snapshot\n" +
+			"directories. Use '--snapshot' to use a specific snapshot.",
+		Args:         cobra.MaximumNArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			pretty, err := cmd.Flags().GetBool("force-pretty")
@@ -43,26 +54,143 @@ func DecodeCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			return serialDecode(cmd.Context(), envelope, args[0], pretty, plain)
+			file, err := cmd.Flags().GetString("file")
+			if err != nil {
+				return err
+			}
+			snapshot, err := cmd.Flags().GetString("snapshot")
+			if err != nil {
+				return err
+			}
+			if snapshot != "" {
+				if _, err := os.Stat(snapshot); err != nil {
+					return fmt.Errorf("can't use snapshot '%s': %w", snapshot, err)
+				}
+			}
+			isHex, err := cmd.Flags().GetBool("hex")
+			if err != nil {
+				return err
+			}
+
+			ctx := cmd.Context()
+			if len(args) == 1 && args[0] != "-" {
+				if file != "" {
+					return fmt.Errorf("can't use --file with a message argument")
+				}
+				message := args[0]
+				if isHex {
+					if message, err = hexToBase64(message); err != nil {
+						return err
+					}
+				}
+				return serialDecode(ctx, envelope, snapshot, "", message, pretty, plain)
+			}
+
+			var input []byte
+			if file != "" {
+				input, err = os.ReadFile(file)
+			} else {
+				input, err = io.ReadAll(os.Stdin)
+			}
+			if err != nil {
+				return err
+			}
+			messages := findDecodeMessages(string(input))
+			if len(messages) == 0 {
+				return fmt.Errorf("no message to decode")
+			}
+			for i, message := range messages {
+				if isHex {
+					if message, err = hexToBase64(message); err != nil {
+						return err
+					}
+				}
+				if i > 0 {
+					fmt.Println()
+				}
+				if err := serialDecode(ctx, envelope, snapshot, "", message, pretty, plain); err != nil {
+					return err
+				}
+			}
+			return nil
 		},
 	}
 	cmd.Flags().BoolP("force-pretty", "r", false, "force output to use terminal graphics")
 	cmd.Flags().BoolP("force-plain", "l", false, "force output to use plain ASCII text")
 	cmd.Flags().String("envelope", "", "name or path of the firmware envelope")
+	cmd.Flags().StringP("file", "f", "", "read the message from a file")
+	cmd.Flags().String("snapshot", "", "snapshot of the program that produced the message")
+	cmd.Flags().Bool("hex", false, "the message is hex encoded instead of base64")
 	return cmd
 }
 
-func serialDecode(ctx context.Context, envelope string, message string, forcePretty bool, forcePlain bool) error {
+// findDecodeMessages returns the decodable messages in the input. The lines
+// containing 'jag decode ' or 'Backtrace:' are decoded, even if they are
+// prefixed, for example with a timestamp. If there are no such lines, the
+// whole input is the message.
+func findDecodeMessages(input string) []string {
+	var res []string
+	for _, line := range strings.Split(input, "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, "jag decode "); i >= 0 {
+			res = append(res, line[i:])
+		} else if i := strings.Index(line, "Backtrace:"); i >= 0 {
+			res = append(res, line[i:])
+		}
+	}
+	if len(res) == 0 {
+		if message := strings.TrimSpace(input); message != "" {
+			res = append(res, message)
+		}
+	}
+	return res
+}
+
+func hexToBase64(message string) (string, error) {
+	message = strings.TrimPrefix(message, "jag decode ")
+	decoded, err := hex.DecodeString(strings.TrimSpace(message))
+	if err != nil {
+		return "", fmt.Errorf("message isn't hex encoded: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(decoded), nil
+}
+
+// lastDeployedFile is the name of the file in the snapshots state directory
+// that holds the ID of the most recently deployed program.
+const lastDeployedFile = "last-deployed"
+
+// lastDeployedSnapshot returns the path of the snapshot of the most recently
+// deployed program, or "" if it isn't known.
+func lastDeployedSnapshot() string {
+	dir, err := directory.GetSnapshotsStatePath()
+	if err != nil {
+		return ""
+	}
+	id, err := os.ReadFile(filepath.Join(dir, lastDeployedFile))
+	if err != nil {
+		return ""
+	}
+	snapshot := filepath.Join(dir, strings.TrimSpace(string(id))+".snapshot")
+	if _, err := os.Stat(snapshot); err != nil {
+		return ""
+	}
+	return snapshot
+}
+
+// serialDecode decodes a message from the device. If snapshot is empty, the
+// snapshot is looked up by the ID of the program in the message. If that
+// snapshot isn't found, the fallback snapshot is used, if given.
+func serialDecode(ctx context.Context, envelope string, snapshot string, fallback string, message string, forcePretty bool, forcePlain bool) error {
 	if strings.HasPrefix(message, "jag decode ") {
-		return jagDecode(ctx, message[11:], forcePretty, forcePlain)
+		return jagDecode(ctx, message[11:], snapshot, fallback, forcePretty, forcePlain)
 	} else if strings.HasPrefix(message, "Backtrace:") {
 		return crashDecode(ctx, envelope, message)
 	} else {
-		return jagDecode(ctx, message, forcePretty, forcePlain)
+		return jagDecode(ctx, message, snapshot, fallback, forcePretty, forcePlain)
 	}
 }
 
-func jagDecode(ctx context.Context, base64Message string, forcePretty bool, forcePlain bool) error {
+func jagDecode(ctx context.Context, base64Message string, snapshotOverride string, fallbackSnapshot string, forcePretty bool, forcePlain bool) error {
 	sdk, err := GetSDK(ctx)
 	if err != nil {
 		return err
@@ -147,8 +275,12 @@ func jagDecode(ctx context.Context, base64Message string, forcePretty bool, forc
 	if err != nil {
 		return err
 	}
-	snapshot := ""
+	snapshot := snapshotOverride
 	for _, path := range snapshotsPaths {
+		if snapshotOverride != "" {
+			// The user told us which snapshot to use.
+			break
+		}
 		candidate := filepath.Join(path, programId.String()+".snapshot")
 		if snapshot == "" {
 			// Remember the first candidate so we use it in the error message if
@@ -161,6 +293,10 @@ func jagDecode(ctx context.Context, base64Message string, forcePretty bool, forc
 			break
 		}
 	}
+	if _, err := os.Stat(snapshot); programId != uuid.Nil && fallbackSnapshot != "" && errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "No snapshot for program %s, using the most recently deployed one\n", programId)
+		snapshot = fallbackSnapshot
+	}
 
 	pretty := "--no-force-pretty"
 	if forcePretty {
@@ -173,7 +309,7 @@ func jagDecode(ctx context.Context, base64Message string, forcePretty bool, forc
 
 	var decodeCommand *exec.Cmd = sdk.SystemMessage(ctx, base64Message, pretty, plain)
 	isMissingSnapshot := false
-	if programId != uuid.Nil {
+	if programId != uuid.Nil || snapshotOverride != "" {
 		if _, err := os.Stat(snapshot); errors.Is(err, os.ErrNotExist) {
 			isMissingSnapshot = true
 		} else {
@@ -241,10 +377,24 @@ type Decoder struct {
 	scanner  *bufio.Scanner
 	context  context.Context
 	envelope string
+	// If set, the lines from the device are prefixed with the time they
+	// were received.
+	timestamps *lineTimestamper
+	// If set, only the lines matching the filter are printed.
+	filter *lineFilter
+	// If set, all lines are also written to the log, including the ones
+	// hidden by the filter.
+	log *monitorLog
+	// If set, stack traces are printed as they are received instead of
+	// being decoded.
+	raw bool
+	// If set, the most recently deployed snapshot is used to decode stack
+	// traces of programs whose snapshot isn't found.
+	useLastDeployed bool
 }
 
 func NewDecoder(scanner *bufio.Scanner, ctx context.Context, envelope string) *Decoder {
-	return &Decoder{scanner, ctx, envelope}
+	return &Decoder{scanner: scanner, context: ctx, envelope: envelope}
 }
 
 func (d *Decoder) decode(forcePretty bool, forcePlain bool) {
@@ -261,26 +411,39 @@ func (d *Decoder) decode(forcePretty bool, forcePlain bool) {
 	for d.scanner.Scan() {
 		// Get next line from device (or simulator) console.
 		line := d.scanner.Text()
+		// The scanner only returns complete lines, so the timestamp is the
+		// time the line was finished.
+		prefix := d.timestamps.prefix(time.Now())
+		d.log.writeLine(prefix + line)
+		if !d.filter.Match(line) {
+			continue
+		}
 		versionPrefix := "[toit] INFO: starting <v"
 		if strings.HasPrefix(line, versionPrefix) && strings.HasSuffix(line, ">") {
 			Version = line[len(versionPrefix) : len(line)-1]
 		}
 		if _, contains := POSTPONED_LINES[line]; contains {
-			postponed = append(postponed, line)
+			postponed = append(postponed, prefix+line)
 		} else {
 			separator := strings.Repeat("*", 78)
-			if strings.HasPrefix(line, "jag decode ") || strings.HasPrefix(line, "Backtrace:") {
+			if !d.raw && (strings.HasPrefix(line, "jag decode ") || strings.HasPrefix(line, "Backtrace:")) {
 				fmt.Printf("\n" + separator + "\n")
 				if Version != "" {
 					fmt.Printf("Decoding by `jag`, device has version <%s>\n", Version)
 					fmt.Printf(separator + "\n")
 				}
-				if err := serialDecode(d.context, d.envelope, line, forcePretty, forcePlain); err != nil {
+				fallback := ""
+				if d.useLastDeployed {
+					// Look it up for every stack trace, since programs may
+					// have been deployed while monitoring.
+					fallback = lastDeployedSnapshot()
+				}
+				if err := serialDecode(d.context, d.envelope, "", fallback, line, forcePretty, forcePlain); err != nil {
 					if len(postponed) != 0 {
 						fmt.Println(strings.Join(postponed, "\n"))
 						postponed = []string{}
 					}
-					fmt.Println(line)
+					fmt.Println(prefix + line)
 					fmt.Println("jag: Failed to decode line.")
 				} else {
 					postponed = []string{}
@@ -291,7 +454,7 @@ func (d *Decoder) decode(forcePretty bool, forcePlain bool) {
 					fmt.Println(strings.Join(postponed, "\n"))
 					postponed = []string{}
 				}
-				fmt.Println(line)
+				fmt.Println(prefix + line)
 			}
 		}
 	}
@@ -0,0 +1,365 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func DepsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "deps <file>",
+		Short: "List the source files that <file> depends on",
+		Long: "List the source files that <file> depends on. This is the same set of\n" +
+			"files that 'jag watch' watches for changes.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, err := cmd.Flags().GetString("format")
+			if err != nil {
+				return err
+			}
+			format = strings.ToLower(format)
+			if format != "plain" && format != "json" {
+				return fmt.Errorf("--format flag '%s' was not recognized. Must be either plain or json", format)
+			}
+
+			entrypoint := args[0]
+			if stat, err := os.Stat(entrypoint); err != nil {
+				if os.IsNotExist(err) {
+					return fmt.Errorf("no such file or directory: '%s'", entrypoint)
+				}
+				return fmt.Errorf("can't stat file '%s', reason: %w", entrypoint, err)
+			} else if stat.IsDir() {
+				return fmt.Errorf("can't analyze directory: '%s'", entrypoint)
+			}
+
+			ctx := cmd.Context()
+			sdk, err := GetSDK(ctx)
+			if err != nil {
+				return err
+			}
+
+			paths, err := analyzeDependencies(ctx, sdk, entrypoint, nil)
+			if err != nil {
+				return err
+			}
+			sort.Strings(paths)
+
+			if format == "json" {
+				if paths == nil {
+					paths = []string{}
+				}
+				return json.NewEncoder(os.Stdout).Encode(paths)
+			}
+			for _, p := range paths {
+				fmt.Println(p)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().String("format", "plain", "set output format to plain or json")
+	return cmd
+}
+
+// analyzeDependencies runs the analyzer on the given entrypoint and returns
+// the source files it depends on. An error is returned if the analyzer
+// fails, which typically means that the program has compilation errors.
+// In that case the paths from the partial dependency file, if any, are
+// returned as well. If some dependencies can't be accessed, the paths are returned together
+// with a *dependencyStatError.
+// If logf is not nil, the analyzer command and the dependency file are logged
+// through it.
+func analyzeDependencies(ctx context.Context, sdk *SDK, entrypoint string, logf func(format string, a ...interface{})) ([]string, error) {
+	tmpFile, err := os.CreateTemp("", "*.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	return analyzeDependenciesTo(ctx, sdk, entrypoint, tmpFile.Name(), defaultDependencyFormat, logf)
+}
+
+// analyzeDependenciesTo is like analyzeDependencies, but uses the given
+// dependency file and format. The file is truncated first. The caller is
+// responsible for removing the file.
+// If the SDK doesn't support the format, an *unsupportedDependencyFormatError
+// is returned.
+func analyzeDependenciesTo(ctx context.Context, sdk *SDK, entrypoint string, depFile string, format string, logf func(format string, a ...interface{})) ([]string, error) {
+	parse, ok := dependencyFormats[format]
+	if !ok {
+		return nil, &unsupportedDependencyFormatError{format}
+	}
+
+	// Truncate, so a failing analyzer doesn't leave the paths of a
+	// previous run behind.
+	if err := os.WriteFile(depFile, nil, 0644); err != nil {
+		return nil, err
+	}
+
+	analyze := sdk.ToitAnalyze(ctx, "--dependency-file", depFile, "--dependency-format", format, entrypoint)
+	var stderr bytes.Buffer
+	analyze.Stderr = &stderr
+	if logf != nil {
+		logf("Running: %s\n", strings.Join(analyze.Args, " "))
+	}
+	if err := analyze.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) && ctx.Err() == nil {
+			// The analyzer didn't even start, so there are no
+			// dependencies to be found.
+			return nil, &analyzerExecError{analyze.Path, err}
+		}
+		// Older SDKs reject formats they don't know with a usage error.
+		if format != defaultDependencyFormat && strings.Contains(stderr.String(), "dependency-format") {
+			return nil, &unsupportedDependencyFormatError{format}
+		}
+		// The analyzer might still have written a partial dependency file.
+		var paths []string
+		if b, readErr := os.ReadFile(depFile); readErr == nil {
+			logDependencyFile(logf, b)
+			paths, _ = parse(b)
+		}
+		return paths, fmt.Errorf("failed to analyze '%s': %w", entrypoint, err)
+	}
+
+	b, err := os.ReadFile(depFile)
+	if err != nil {
+		return nil, err
+	}
+	logDependencyFile(logf, b)
+	return parse(b)
+}
+
+const defaultDependencyFormat = "plain"
+
+// dependencyFormats maps the dependency formats of the analyzer to the
+// functions that parse them.
+var dependencyFormats = map[string]func([]byte) ([]string, error){
+	"plain": parsePlainDependencyFiles,
+	"ninja": parseNinjaDependencies,
+}
+
+// unsupportedDependencyFormatError is returned when the dependency format
+// isn't known to Jaguar or to the installed SDK.
+type unsupportedDependencyFormatError struct {
+	format string
+}
+
+func (e *unsupportedDependencyFormatError) Error() string {
+	return fmt.Sprintf("dependency format '%s' is not supported", e.format)
+}
+
+// analyzerExecError is returned when the analyzer can't be run at all, for
+// example because the SDK is broken. Unlike a failed analysis, which
+// happens for programs that don't compile, this needs the user's attention.
+type analyzerExecError struct {
+	path string
+	err  error
+}
+
+func (e *analyzerExecError) Error() string {
+	return fmt.Sprintf("can't run the analyzer '%s': %v", e.path, e.err)
+}
+
+func (e *analyzerExecError) Unwrap() error {
+	return e.err
+}
+
+func logDependencyFile(logf func(format string, a ...interface{}), b []byte) {
+	if logf == nil {
+		return
+	}
+	logf("Dependency file:\n%s", b)
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		logf("\n")
+	}
+}
+
+// dependencyStatError is returned when some of the dependencies reported by
+// the analyzer exist, but can't be accessed.
+type dependencyStatError struct {
+	errs []error
+}
+
+func (e *dependencyStatError) Error() string {
+	var msgs []string
+	for _, err := range e.errs {
+		msgs = append(msgs, err.Error())
+	}
+	return "failed to access dependencies: " + strings.Join(msgs, ", ")
+}
+
+// parsePlainDependencyFiles parses a plain dependency file and returns the
+// files in it. The watcher derives the directories to watch from them.
+// Paths that don't exist, or that are directories, are skipped. If other
+// paths can't be stat'd they are still returned, together with a
+// *dependencyStatError.
+//
+// The file has one path per line. The paths of the entrypoints end with a
+// ':', and their dependencies are indented:
+//
+//	/path/to/main.toit:
+//	  /path/to/dir with spaces/dep.toit
+//
+// A line ending with an odd number of backslashes continues on the next
+// line. A backslash in front of a space, a tab, a backslash or a colon
+// escapes it, so paths can end with them. Other backslashes are kept, since
+// they are path separators on Windows.
+func parsePlainDependencyFiles(b []byte) ([]string, error) {
+	text := strings.ReplaceAll(string(b), "\r\n", "\n")
+	var paths []string
+	logical := ""
+	continued := false
+	for _, line := range strings.Split(text, "\n") {
+		if continued {
+			// The indentation of a continued line isn't part of the path.
+			line = strings.TrimLeft(line, " \t")
+		}
+		continued = trailingBackslashes(line)%2 == 1
+		if continued {
+			logical += line[:len(line)-1]
+			continue
+		}
+		if p := parsePlainDependencyLine(logical + line); p != "" {
+			paths = append(paths, p)
+		}
+		logical = ""
+	}
+	if p := parsePlainDependencyLine(logical); p != "" {
+		paths = append(paths, p)
+	}
+	return statDependencyFiles(paths)
+}
+
+// trailingBackslashes returns the number of backslashes at the end of the
+// line. An odd number ends in a continuation.
+func trailingBackslashes(line string) int {
+	n := 0
+	for n < len(line) && line[len(line)-1-n] == '\\' {
+		n++
+	}
+	return n
+}
+
+// parsePlainDependencyLine returns the path on a line of a plain dependency
+// file, without its escapes, its indentation, and the ':' that ends the
+// path of an entrypoint. It returns "" for empty lines.
+func parsePlainDependencyLine(line string) string {
+	line = strings.TrimLeft(line, " \t")
+	var res strings.Builder
+	// The length of res without the unescaped spaces and tabs at its end.
+	// If the last character it keeps is an unescaped colon, beforeColon is
+	// the length without the colon.
+	kept := 0
+	beforeColon := -1
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && strings.IndexByte(" \t\\:", line[i+1]) >= 0 {
+			i++
+			res.WriteByte(line[i])
+			kept = res.Len()
+			beforeColon = -1
+			continue
+		}
+		res.WriteByte(c)
+		if c != ' ' && c != '\t' {
+			beforeColon = -1
+			if c == ':' {
+				beforeColon = kept
+			}
+			kept = res.Len()
+		}
+	}
+	if beforeColon >= 0 {
+		return res.String()[:beforeColon]
+	}
+	return res.String()[:kept]
+}
+
+// parseNinjaDependencies parses a dependency file in the Ninja (Makefile)
+// format:
+//
+//	target: dep1 dep2 \
+//	  dep3
+//
+// Spaces, colons, '#' and backslashes in paths are escaped with a
+// backslash, and '$' is written as '$$'. Other backslashes are kept, since
+// they are path separators on Windows.
+func parseNinjaDependencies(b []byte) ([]string, error) {
+	text := strings.ReplaceAll(string(b), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\\\n", " ")
+	var candidates []string
+	for _, line := range strings.Split(text, "\n") {
+		var current strings.Builder
+		flush := func() {
+			if current.Len() > 0 {
+				candidates = append(candidates, current.String())
+				current.Reset()
+			}
+		}
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case c == '\\' && i+1 < len(line) && strings.IndexByte(" :#\\", line[i+1]) >= 0:
+				current.WriteByte(line[i+1])
+				i++
+			case c == '$' && i+1 < len(line) && line[i+1] == '$':
+				current.WriteByte('$')
+				i++
+			case c == ' ' || c == '\t':
+				flush()
+			case c == ':' && (i+1 == len(line) || line[i+1] == ' ' || line[i+1] == '\t'):
+				// End of the target, which is a dependency as well.
+				flush()
+			default:
+				current.WriteByte(c)
+			}
+		}
+		flush()
+	}
+	return statDependencyFiles(candidates)
+}
+
+// statDependencyFiles removes duplicates, paths that don't exist, and
+// directories, so only files are returned. Paths that can't be stat'd are
+// still returned, together with a *dependencyStatError.
+func statDependencyFiles(candidates []string) ([]string, error) {
+	m := map[string]struct{}{}
+	var statErrs []error
+	for _, p := range candidates {
+		if _, ok := m[p]; ok {
+			continue
+		}
+		if stat, err := os.Stat(p); err == nil {
+			if !stat.IsDir() {
+				m[p] = struct{}{}
+			}
+		} else if !os.IsNotExist(err) {
+			m[p] = struct{}{}
+			statErrs = append(statErrs, err)
+		}
+	}
+	var res []string
+	for r := range m {
+		res = append(res, r)
+	}
+	if len(statErrs) > 0 {
+		return res, &dependencyStatError{statErrs}
+	}
+	return res, nil
+}
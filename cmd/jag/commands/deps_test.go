@@ -0,0 +1,322 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createFiles creates empty files with the given paths, relative to dir.
+func createFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// escapeDependencyPath escapes the backslashes of the path, so the
+// dependency files of Windows paths stay valid.
+func escapeDependencyPath(p string) string {
+	return strings.ReplaceAll(p, `\`, `\\`)
+}
+
+func TestParsePlainDependencyFiles(t *testing.T) {
+	dir := t.TempDir()
+	createFiles(t, dir, "main.toit", "dep.toit", "with space/dep.toit", "trailing ", `back\slash.toit`, "long/path/dep.toit")
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	d := escapeDependencyPath(dir + string(filepath.Separator))
+
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "entrypoint and dependency",
+			content: d + "main.toit:\n  " + d + "dep.toit\n",
+			want:    []string{"main.toit", "dep.toit"},
+		},
+		{
+			name:    "no trailing newline",
+			content: d + "main.toit:\n  " + d + "dep.toit",
+			want:    []string{"main.toit", "dep.toit"},
+		},
+		{
+			name:    "spaces",
+			content: d + "main.toit:\n  " + d + "with space/dep.toit\n",
+			want:    []string{"main.toit", "with space/dep.toit"},
+		},
+		{
+			name:    "escaped space",
+			content: d + "main.toit:\n  " + d + `with\ space/dep.toit` + "\n",
+			want:    []string{"main.toit", "with space/dep.toit"},
+		},
+		{
+			name:    "escaped trailing space",
+			content: d + "main.toit:\n  " + d + `trailing\ ` + "\n",
+			want:    []string{"main.toit", "trailing "},
+		},
+		{
+			name:    "unescaped trailing space",
+			content: d + "main.toit: \n  " + d + "dep.toit  \n",
+			want:    []string{"main.toit", "dep.toit"},
+		},
+		{
+			name:    "escaped backslash",
+			content: d + "main.toit:\n  " + d + `back\\slash.toit` + "\n",
+			want:    []string{"main.toit", `back\slash.toit`},
+		},
+		{
+			name:    "continuation",
+			content: d + "main.toit:\n  " + d + "long/\\\n    path/dep.toit\n",
+			want:    []string{"main.toit", "long/path/dep.toit"},
+		},
+		{
+			name:    "CRLF",
+			content: d + "main.toit:\r\n  " + d + "dep.toit\r\n",
+			want:    []string{"main.toit", "dep.toit"},
+		},
+		{
+			name:    "CRLF continuation",
+			content: d + "main.toit:\r\n  " + d + "long/\\\r\n    path/dep.toit\r\n",
+			want:    []string{"main.toit", "long/path/dep.toit"},
+		},
+		{
+			name:    "missing files and directories are skipped",
+			content: d + "main.toit:\n  " + d + "missing.toit\n  " + d + "subdir\n",
+			want:    []string{"main.toit"},
+		},
+		{
+			name:    "duplicates",
+			content: d + "main.toit:\n  " + d + "dep.toit\n" + d + "dep.toit:\n  " + d + "main.toit\n",
+			want:    []string{"main.toit", "dep.toit"},
+		},
+		{
+			name:    "empty",
+			content: "\n\n",
+			want:    nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parsePlainDependencyFiles([]byte(test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkDependencyFiles(t, dir, got, test.want)
+		})
+	}
+}
+
+func TestParsePlainDependencyLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"", ""},
+		{"   ", ""},
+		{"/a/main.toit:", "/a/main.toit"},
+		{"  /a/dep.toit", "/a/dep.toit"},
+		{`/a/colon\:`, "/a/colon:"},
+		{`/a/colon\::`, "/a/colon:"},
+		{`/a/back\\:`, `/a/back\`},
+		{`C:\dir\main.toit:`, `C:\dir\main.toit`},
+		{`/a/tab\	`, "/a/tab\t"},
+		{"/a/main.toit :", "/a/main.toit"},
+	}
+	for _, test := range tests {
+		if got := parsePlainDependencyLine(test.line); got != test.want {
+			t.Errorf("parsePlainDependencyLine(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestParseNinjaDependencies(t *testing.T) {
+	dir := t.TempDir()
+	createFiles(t, dir, "main.toit", "dep.toit", "with space/dep.toit", `back\slash.toit`, "hash#.toit", "dollar$.toit")
+	d := dir + string(filepath.Separator)
+	// Colons and backslashes are escaped in Ninja files, and the ones of
+	// the temporary directory must be too.
+	escape := func(p string) string {
+		p = strings.ReplaceAll(p, `\`, `\\`)
+		p = strings.ReplaceAll(p, ":", `\:`)
+		return strings.ReplaceAll(p, " ", `\ `)
+	}
+	e := escape(d)
+
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "target and dependencies",
+			content: e + "main.toit: " + e + "dep.toit\n",
+			want:    []string{"main.toit", "dep.toit"},
+		},
+		{
+			name:    "escaped space",
+			content: e + "main.toit: " + e + `with\ space/dep.toit` + "\n",
+			want:    []string{"main.toit", "with space/dep.toit"},
+		},
+		{
+			name:    "escaped backslash",
+			content: e + "main.toit: " + e + `back\\slash.toit` + "\n",
+			want:    []string{"main.toit", `back\slash.toit`},
+		},
+		{
+			name:    "escaped hash and dollar",
+			content: e + "main.toit: " + e + `hash\#.toit ` + e + "dollar$$.toit\n",
+			want:    []string{"main.toit", "hash#.toit", "dollar$.toit"},
+		},
+		{
+			name:    "continuation",
+			content: e + "main.toit: \\\n  " + e + "dep.toit \\\n  " + e + `with\ space/dep.toit` + "\n",
+			want:    []string{"main.toit", "dep.toit", "with space/dep.toit"},
+		},
+		{
+			name:    "CRLF",
+			content: e + "main.toit: \\\r\n  " + e + "dep.toit\r\n",
+			want:    []string{"main.toit", "dep.toit"},
+		},
+		{
+			name:    "missing files are skipped",
+			content: e + "main.toit: " + e + "missing.toit\n",
+			want:    []string{"main.toit"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseNinjaDependencies([]byte(test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkDependencyFiles(t, dir, got, test.want)
+		})
+	}
+}
+
+// checkDependencyFiles compares the parsed paths with the wanted ones,
+// which are relative to dir.
+func checkDependencyFiles(t *testing.T, dir string, got []string, want []string) {
+	t.Helper()
+	var wantPaths []string
+	for _, w := range want {
+		wantPaths = append(wantPaths, filepath.Join(dir, w))
+	}
+	sort.Strings(got)
+	sort.Strings(wantPaths)
+	if !reflect.DeepEqual(got, wantPaths) {
+		t.Errorf("got %q, want %q", got, wantPaths)
+	}
+}
+
+// unstatablePath returns a path in dir that exists as far as the
+// analyzer is concerned, but that can't be stat'd. The name is too long
+// for any file system, which fails with something else than 'not exist'.
+func unstatablePath(dir string) string {
+	return filepath.Join(dir, strings.Repeat("x", 300)+".toit")
+}
+
+func TestStatDependencyFiles(t *testing.T) {
+	dir := t.TempDir()
+	createFiles(t, dir, "main.toit")
+	main := filepath.Join(dir, "main.toit")
+	unstatable := unstatablePath(dir)
+
+	got, err := statDependencyFiles([]string{main, filepath.Join(dir, "missing.toit"), dir, unstatable, main})
+	var statErr *dependencyStatError
+	if !errors.As(err, &statErr) {
+		t.Fatalf("got %v, want a *dependencyStatError", err)
+	}
+	if len(statErr.errs) != 1 {
+		t.Errorf("got %d errors, want one for '%s'", len(statErr.errs), unstatable)
+	}
+	sort.Strings(got)
+	if want := []string{main, unstatable}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	got, err = statDependencyFiles([]string{main})
+	if err != nil || !reflect.DeepEqual(got, []string{main}) {
+		t.Errorf("got %q, %v, want only '%s'", got, err, main)
+	}
+}
+
+func TestAnalyzeDependenciesStatError(t *testing.T) {
+	sdk := newFakeSDK(t)
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	unstatable := unstatablePath(dir)
+	writeFile(t, main, "uses "+unstatable+"\n")
+
+	paths, err := analyzeDependencies(context.Background(), sdk, main, nil)
+	var statErr *dependencyStatError
+	if !errors.As(err, &statErr) {
+		t.Fatalf("got %v, want a *dependencyStatError", err)
+	}
+	sort.Strings(paths)
+	if want := []string{main, unstatable}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("got %q, want %q", paths, want)
+	}
+}
+
+func TestAnalyzeDependenciesMissingAnalyzer(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	writeFile(t, main, "")
+	// An SDK without executables.
+	sdk := &SDK{Path: t.TempDir(), Version: "v0.0.0-test"}
+
+	_, err := analyzeDependencies(context.Background(), sdk, main, nil)
+	var execErr *analyzerExecError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("got %v, want an *analyzerExecError", err)
+	}
+	if !strings.Contains(err.Error(), sdk.Path) {
+		t.Errorf("the error '%v' doesn't name the analyzer in '%s'", err, sdk.Path)
+	}
+
+	// A program that doesn't compile is a failed analysis, not a broken
+	// SDK.
+	writeFile(t, main, "broken\n")
+	_, err = analyzeDependencies(context.Background(), newFakeSDK(t), main, nil)
+	if err == nil || errors.As(err, &execErr) {
+		t.Errorf("got %v, want a failed analysis", err)
+	}
+}
+
+func TestAnalyzeDependenciesCancelled(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	writeFile(t, main, "analyze-delay 5\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	var err error
+	within(t, 2*time.Second, "the cancelled analysis", func() {
+		_, err = analyzeDependencies(ctx, newFakeSDK(t), main, nil)
+	})
+	var execErr *analyzerExecError
+	if err == nil || errors.As(err, &execErr) {
+		t.Errorf("got %v, want a failed analysis", err)
+	}
+}
@@ -10,9 +10,12 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 	"unicode/utf8"
 
+	"github.com/spf13/viper"
 	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"golang.org/x/term"
 )
 
 const (
@@ -23,6 +26,8 @@ const (
 	JaguarContainerTimeoutHeader  = "X-Jaguar-Container-Timeout"
 	JaguarContainerIntervalHeader = "X-Jaguar-Container-Interval"
 	JaguarCRC32Header             = "X-Jaguar-CRC32"
+	// The arguments of a program that is run, as a JSON array of strings.
+	JaguarRunArgumentsHeader = "X-Jaguar-Run-Arguments"
 )
 
 type Device interface {
@@ -42,6 +47,13 @@ type Device interface {
 	SendCode(ctx context.Context, sdk *SDK, request string, b []byte, headersMap map[string]string) error
 	ContainerList(ctx context.Context, sdk *SDK) (map[string]string, error)
 	ContainerUninstall(ctx context.Context, sdk *SDK, name string) error
+	Stop(ctx context.Context, sdk *SDK) error
+	// ContainerStop stops the running container with the given name. It
+	// returns false if the container wasn't running.
+	ContainerStop(ctx context.Context, sdk *SDK, name string) (bool, error)
+	// Reboot restarts the device. It returns once the device has accepted
+	// the request, before it is back up.
+	Reboot(ctx context.Context, sdk *SDK) error
 	UpdateFirmware(ctx context.Context, sdk *SDK, b []byte) error
 
 	ToJson() map[string]interface{}
@@ -163,7 +175,7 @@ func GetDevice(ctx context.Context, sdk *SDK, checkPing bool, deviceSelect devic
 		return nil, err
 	}
 	manualPick := deviceSelect != nil
-	if deviceCfg.IsSet("device") && !manualPick {
+	if deviceCfg.IsSet("device") && !manualPick && useDefaultDevice(ctx) {
 		var decoded map[string]interface{}
 		if err := deviceCfg.UnmarshalKey("device", &decoded); err != nil {
 			return nil, err
@@ -172,42 +184,158 @@ func GetDevice(ctx context.Context, sdk *SDK, checkPing bool, deviceSelect devic
 		if err != nil {
 			return nil, err
 		}
-		if checkPing {
-			if d.Ping(ctx, sdk) {
-				return d, nil
-			}
-			deviceSelect = deviceIDSelect(d.ID())
-			fmt.Printf("Failed to ping '%s'.\n", d.Name())
-		} else {
+		infof(ctx, "Using last used device '%s'\n", d.Name())
+		if !checkPing || d.Ping(ctx, sdk) {
 			return d, nil
 		}
+		deviceSelect = deviceIDSelect(d.ID())
+		infof(ctx, "Failed to ping '%s'.\n", d.Name())
 	}
 
-	d, autoSelected, err := scanAndPickDevice(ctx, scanTimeout, scanPort, deviceSelect, manualPick)
+	d, autoSelected, err := scanAndPickDevice(ctx, scanTimeout, scanPort, deviceSelect, nil, 0, manualPick)
 	if err != nil {
 		return nil, err
 	}
-	if !manualPick {
-		if autoSelected {
-			fmt.Printf("Found device '%s' again\n", d.Name())
+	if !manualPick && autoSelected {
+		infof(ctx, "Found device '%s' again\n", d.Name())
+	}
+	// Remember the device, so later commands can use it without '--device'.
+	if err := storeDevice(deviceCfg, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// GetDeviceWaiting is like GetDevice, but keeps retrying for the given time
+// if the device can't be found, for example because it is still booting.
+// A non-positive wait tries only once.
+func GetDeviceWaiting(ctx context.Context, sdk *SDK, checkPing bool, deviceSelect deviceSelect, wait time.Duration) (Device, error) {
+	if wait <= 0 {
+		return GetDevice(ctx, sdk, checkPing, deviceSelect)
+	}
+	var res Device
+	printf := func(format string, a ...interface{}) { infof(ctx, format, a...) }
+	err := retryWaiting(ctx, wait, "the device", printf, func() error {
+		d, err := GetDevice(ctx, sdk, checkPing, deviceSelect)
+		res = d
+		return err
+	})
+	return res, err
+}
+
+// retryWaiting calls try until it succeeds, backing off between attempts,
+// and gives up after the given time. The what describes what is waited for
+// in the messages, which are printed with printf.
+func retryWaiting(ctx context.Context, wait time.Duration, what string, printf func(format string, a ...interface{}), try func() error) error {
+	start := time.Now()
+	interval := 250 * time.Millisecond
+	for {
+		err := try()
+		if err == nil {
+			return nil
+		}
+		elapsed := time.Since(start)
+		if elapsed >= wait {
+			return fmt.Errorf("gave up after waiting %s for %s: %w", elapsed.Round(100*time.Millisecond), what, err)
 		}
-		deviceCfg.Set("device", d.ToJson())
-		if err := deviceCfg.WriteConfig(); err != nil {
+		printf("Waiting for %s ...\n", what)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		interval *= 2
+		if interval > 2*time.Second {
+			interval = 2 * time.Second
+		}
+	}
+}
+
+const (
+	devicesCfgKey    = "devices"
+	maxStoredDevices = 20
+)
+
+// storeDevice makes the device the default device and adds it to the front
+// of the list of remembered devices.
+func storeDevice(cfg *viper.Viper, d Device) error {
+	known, err := storedDevices(cfg)
+	if err != nil {
+		return err
+	}
+	entries := []map[string]interface{}{d.ToJson()}
+	for _, k := range known {
+		// A device gets a new ID when its firmware is updated, so the
+		// address identifies it as well.
+		if k.ID() == d.ID() || k.Address() == d.Address() {
+			continue
+		}
+		if len(entries) == maxStoredDevices {
+			break
+		}
+		entries = append(entries, k.ToJson())
+	}
+	cfg.Set("device", d.ToJson())
+	cfg.Set(devicesCfgKey, entries)
+	return cfg.WriteConfig()
+}
+
+// storedDevices returns the remembered devices, most recently used first.
+func storedDevices(cfg *viper.Viper) ([]Device, error) {
+	var decoded []map[string]interface{}
+	if cfg.IsSet(devicesCfgKey) {
+		if err := cfg.UnmarshalKey(devicesCfgKey, &decoded); err != nil {
 			return nil, err
 		}
+	} else if cfg.IsSet("device") {
+		// Configurations written by older versions only have the default
+		// device.
+		var data map[string]interface{}
+		if err := cfg.UnmarshalKey("device", &data); err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, data)
 	}
-	return d, nil
+	var res []Device
+	for _, data := range decoded {
+		d, err := NewDeviceFromJson(data)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, d)
+	}
+	return res, nil
 }
 
 // A Reader based on a byte array that prints a progress bar.
+// When stdout isn't a terminal, a line is printed for every 10% instead.
 type ProgressReader struct {
 	b         []byte
 	index     int
 	spinState int
+	start     time.Time
+	tty       bool
+	// The last percentage printed when stdout isn't a terminal.
+	reported int
 }
 
 func NewProgressReader(b []byte) *ProgressReader {
-	return &ProgressReader{b, 0, 0}
+	return &ProgressReader{
+		b:        b,
+		start:    time.Now(),
+		tty:      term.IsTerminal(int(os.Stdout.Fd())),
+		reported: -1,
+	}
+}
+
+// eta estimates the remaining time from the bytes read so far.
+func (p *ProgressReader) eta() string {
+	elapsed := time.Since(p.start)
+	if p.index == 0 || elapsed < time.Second {
+		return "--"
+	}
+	remaining := time.Duration(float64(elapsed) * float64(len(p.b)-p.index) / float64(p.index))
+	return remaining.Round(time.Second).String()
 }
 
 func (p *ProgressReader) Read(buffer []byte) (n int, err error) {
@@ -217,6 +345,13 @@ func (p *ProgressReader) Read(buffer []byte) (n int, err error) {
 	copied := copy(buffer, p.b[p.index:])
 	p.index += copied
 	percent := (p.index * 100) / len(p.b)
+	if !p.tty {
+		if step := percent / 10 * 10; step > p.reported {
+			p.reported = step
+			fmt.Printf("%3d%%  %dk of %dk  ETA %s\n", step, p.index>>10, len(p.b)>>10, p.eta())
+		}
+		return copied, nil
+	}
 	fmt.Print("\r")
 	// The strings must contain characters with the same UTF-8 length so that
 	// they can be chopped up.  The emoji generally are 4-byte characters.
@@ -248,6 +383,6 @@ func (p *ProgressReader) Read(buffer []byte) (n int, err error) {
 	fmt.Printf("   %3d%%  %4dk  %s  [", percent, p.index>>10, spinChar)
 	fmt.Print(done[len(done)-pos*doneBytesPerPart:])
 	fmt.Print(todo[:len(todo)-pos*todoBytesPerPart])
-	fmt.Print("] ")
+	fmt.Printf("] of %dk  ETA %-6s", len(p.b)>>10, p.eta())
 	return copied, nil
 }
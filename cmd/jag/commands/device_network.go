@@ -24,6 +24,9 @@ import (
 type DeviceNetwork struct {
 	DeviceBase
 	proxied bool
+	// The client used for requests to the device. If nil, the default
+	// client is used.
+	client *http.Client
 }
 
 func NewDeviceNetworkFromJson(data map[string]interface{}) (*DeviceNetwork, error) {
@@ -63,8 +66,49 @@ func (d DeviceNetwork) ToJson() map[string]interface{} {
 
 const (
 	pingTimeout = 3000 * time.Millisecond
+
+	// sessionIdleTimeout is how long an unused session connection is kept
+	// open. It covers the time between two saves in a watch session.
+	sessionIdleTimeout = 10 * time.Minute
 )
 
+func (d DeviceNetwork) httpClient() *http.Client {
+	if d.client != nil {
+		return d.client
+	}
+	return http.DefaultClient
+}
+
+// newDeviceSession returns a device that keeps its connection open across
+// requests, so repeated requests don't pay for connecting every time.
+// The returned function closes the connection. Devices that aren't reached
+// over the network are returned unchanged.
+func newDeviceSession(device Device) (Device, func()) {
+	var d DeviceNetwork
+	switch nd := device.(type) {
+	case DeviceNetwork:
+		d = nd
+	case *DeviceNetwork:
+		d = *nd
+	default:
+		return device, func() {}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 2
+	transport.IdleConnTimeout = sessionIdleTimeout
+	d.client = &http.Client{Transport: transport}
+	return d, transport.CloseIdleConnections
+}
+
+// resetDeviceSession drops the open connection of a device returned by
+// newDeviceSession, so the next request reconnects. Used after failures,
+// since the connection might be broken.
+func resetDeviceSession(device Device) {
+	if d, ok := device.(DeviceNetwork); ok && d.client != nil {
+		d.client.CloseIdleConnections()
+	}
+}
+
 func (d DeviceNetwork) newRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
 	lanIp, err := getLanIp()
 	if err != nil {
@@ -88,7 +132,7 @@ func (d DeviceNetwork) Ping(ctx context.Context, sdk *SDK) bool {
 	}
 	req.Header.Set(JaguarDeviceIDHeader, d.ID())
 	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
-	res, err := http.DefaultClient.Do(req)
+	res, err := d.httpClient().Do(req)
 	if err != nil {
 		return false
 	}
@@ -110,7 +154,7 @@ func (d DeviceNetwork) SendCode(ctx context.Context, sdk *SDK, request string, b
 	// Set a crc32 header of the bytes.
 	req.Header.Set(JaguarCRC32Header, fmt.Sprintf("%d", crc32.ChecksumIEEE(b)))
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := d.httpClient().Do(req)
 	if err != nil {
 		return err
 	}
@@ -130,7 +174,7 @@ func (d DeviceNetwork) ContainerList(ctx context.Context, sdk *SDK) (map[string]
 	}
 	req.Header.Set(JaguarDeviceIDHeader, d.ID())
 	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
-	res, err := http.DefaultClient.Do(req)
+	res, err := d.httpClient().Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -161,7 +205,7 @@ func (d DeviceNetwork) ContainerUninstall(ctx context.Context, sdk *SDK, name st
 	req.Header.Set(JaguarDeviceIDHeader, d.ID())
 	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
 	req.Header.Set(JaguarContainerNameHeader, name)
-	res, err := http.DefaultClient.Do(req)
+	res, err := d.httpClient().Do(req)
 	if err != nil {
 		return err
 	}
@@ -176,6 +220,74 @@ func (d DeviceNetwork) ContainerUninstall(ctx context.Context, sdk *SDK, name st
 	return nil
 }
 
+func (d DeviceNetwork) Stop(ctx context.Context, sdk *SDK) error {
+	req, err := d.newRequest(ctx, "PUT", "/stop", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(JaguarDeviceIDHeader, d.ID())
+	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
+	res, err := d.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+
+	io.ReadAll(res.Body) // Avoid closing connection prematurely.
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("got non-OK from device: %s", res.Status)
+	}
+	return nil
+}
+
+func (d DeviceNetwork) Reboot(ctx context.Context, sdk *SDK) error {
+	req, err := d.newRequest(ctx, "PUT", "/reboot", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(JaguarDeviceIDHeader, d.ID())
+	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
+	res, err := d.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode == http.StatusNotImplemented {
+		return fmt.Errorf("'%s' can't be rebooted: %s", d.Name(), res.Status)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("got non-OK from device: %s", res.Status)
+	}
+	// Older firmware answers unknown requests with an empty OK.
+	if !strings.Contains(string(body), "OK") {
+		return fmt.Errorf("'%s' can't be rebooted remotely, update its firmware with 'jag firmware update'", d.Name())
+	}
+	return nil
+}
+
+func (d DeviceNetwork) ContainerStop(ctx context.Context, sdk *SDK, name string) (bool, error) {
+	req, err := d.newRequest(ctx, "PUT", "/stop", nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set(JaguarDeviceIDHeader, d.ID())
+	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
+	req.Header.Set(JaguarContainerNameHeader, name)
+	res, err := d.httpClient().Do(req)
+	if err != nil {
+		return false, err
+	}
+
+	io.ReadAll(res.Body) // Avoid closing connection prematurely.
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("got non-OK from device: %s", res.Status)
+	}
+	return true, nil
+}
+
 func (d DeviceNetwork) UpdateFirmware(ctx context.Context, sdk *SDK, b []byte) error {
 	var reader = NewProgressReader(b)
 	req, err := d.newRequest(ctx, "PUT", "/firmware", reader)
@@ -186,7 +298,7 @@ func (d DeviceNetwork) UpdateFirmware(ctx context.Context, sdk *SDK, b []byte) e
 	req.Header.Set(JaguarDeviceIDHeader, d.ID())
 	req.Header.Set(JaguarSDKVersionHeader, sdk.Version)
 	defer fmt.Print("\n\n")
-	res, err := http.DefaultClient.Do(req)
+	res, err := d.httpClient().Do(req)
 	if err != nil {
 		return err
 	}
@@ -234,6 +346,33 @@ func Identify(ctx context.Context, ds deviceSelect) ([]Device, error) {
 }
 
 func ScanNetwork(ctx context.Context, ds deviceSelect, port uint) ([]Device, error) {
+	scanned, err := scanNetwork(ctx, port, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return scannedDevices(scanned), nil
+}
+
+func scannedDevices(scanned []scannedDevice) []Device {
+	var res []Device
+	for _, s := range scanned {
+		res = append(res, s.Device)
+	}
+	return res
+}
+
+// scannedDevice is a device found by scanning, together with the time its
+// last identify broadcast was received.
+type scannedDevice struct {
+	Device
+	lastSeen time.Time
+}
+
+// scanNetwork listens for identify broadcasts until the context is done, or
+// until count devices matching the filter have been found if count is
+// positive. Devices not matching the filter are dropped.
+// The returned devices are sorted by name.
+func scanNetwork(ctx context.Context, port uint, filter *deviceFilter, count int) ([]scannedDevice, error) {
 	pc, err := reuseport.ListenPacket("udp4", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
@@ -245,7 +384,7 @@ func ScanNetwork(ctx context.Context, ds deviceSelect, port uint) ([]Device, err
 		}
 	}
 
-	devices := map[string]Device{}
+	devices := map[string]scannedDevice{}
 looping:
 	for {
 		select {
@@ -270,12 +409,15 @@ looping:
 		dev, err := parseDeviceNetwork(buf[:n])
 		if err != nil {
 			fmt.Println("Failed to parse identify", err)
-		} else if dev != nil {
-			devices[dev.Address()] = *dev
+		} else if dev != nil && filter.Match(dev) {
+			devices[dev.Address()] = scannedDevice{*dev, time.Now()}
+			if count > 0 && len(devices) >= count {
+				break looping
+			}
 		}
 	}
 
-	var res []Device
+	var res []scannedDevice
 	for _, d := range devices {
 		res = append(res, d)
 	}
@@ -0,0 +1,135 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+)
+
+func DevicesCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "devices",
+		Short: "Manage the devices Jaguar remembers",
+		Long: "Manage the devices Jaguar remembers.\n" +
+			"Jaguar remembers the devices it has been used with, so they can be\n" +
+			"reached even when they are on a different network and can't be found\n" +
+			"with 'jag scan'.",
+	}
+
+	cmd.AddCommand(DevicesListCmd())
+	return cmd
+}
+
+// devicesJsonDevice is an element of the 'jag devices list --json' output.
+type devicesJsonDevice struct {
+	Name      string `json:"name"`
+	ID        string `json:"id"`
+	Address   string `json:"address"`
+	Reachable bool   `json:"reachable"`
+	LatencyMs *int64 `json:"latency_ms"`
+}
+
+func DevicesListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "list",
+		Short:        "List the remembered devices and whether they are reachable",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			jsonOutput, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return err
+			}
+
+			ctx := cmd.Context()
+			sdk, err := GetSDK(ctx)
+			if err != nil {
+				return err
+			}
+
+			cfg, err := directory.GetDeviceConfig()
+			if err != nil {
+				return err
+			}
+			devices, err := storedDevices(cfg)
+			if err != nil {
+				return err
+			}
+
+			// Ping all devices at the same time, so unreachable devices
+			// don't add up their timeouts.
+			latencies := make([]*time.Duration, len(devices))
+			var wg sync.WaitGroup
+			for i, d := range devices {
+				wg.Add(1)
+				go func(i int, d Device) {
+					defer wg.Done()
+					start := time.Now()
+					if d.Ping(ctx, sdk) {
+						latency := time.Since(start)
+						latencies[i] = &latency
+					}
+				}(i, d)
+			}
+			wg.Wait()
+
+			if jsonOutput {
+				res := []devicesJsonDevice{}
+				for i, d := range devices {
+					entry := devicesJsonDevice{
+						Name:      d.Name(),
+						ID:        d.ID(),
+						Address:   d.Address(),
+						Reachable: latencies[i] != nil,
+					}
+					if latencies[i] != nil {
+						ms := latencies[i].Milliseconds()
+						entry.LatencyMs = &ms
+					}
+					res = append(res, entry)
+				}
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(res)
+			}
+
+			if len(devices) == 0 {
+				fmt.Println("No remembered devices. Use 'jag scan' to find one.")
+				return nil
+			}
+
+			// Compute the column lengths for all columns except for the last.
+			nameLength := len("NAME")
+			addressLength := len("ADDRESS")
+			statusLength := len("unreachable")
+			for _, d := range devices {
+				nameLength = max(nameLength, len(d.Name()))
+				addressLength = max(addressLength, len(d.Address()))
+			}
+
+			fmt.Println(padded("NAME", nameLength) + padded("ADDRESS", addressLength) + padded("STATUS", statusLength) + "LATENCY")
+			for i, d := range devices {
+				status := "unreachable"
+				latency := "-"
+				if latencies[i] != nil {
+					status = "reachable"
+					latency = latencies[i].Round(time.Millisecond).String()
+				}
+				fmt.Println(padded(d.Name(), nameLength) + padded(d.Address(), addressLength) + padded(status, statusLength) + latency)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("json", false, "print the devices as a JSON array")
+	return cmd
+}
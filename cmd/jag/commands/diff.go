@@ -0,0 +1,200 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/setanta314/ar"
+	"github.com/spf13/cobra"
+)
+
+// snapshotDebugEntry is the entry of a snapshot archive that holds the debug
+// information. Stripped snapshots don't have it.
+const snapshotDebugEntry = "source-map"
+
+func DiffCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff <old-snapshot> <new-snapshot>",
+		Short: "Compare the sizes of two snapshots",
+		Long: "Compare the sizes of two snapshots, for example ones produced by\n" +
+			"'jag compile' for two commits.\n" +
+			"The total sizes are compared, as well as the sizes of the parts of the\n" +
+			"snapshots, like the program and its debug information. The SDK doesn't\n" +
+			"report the sizes of individual modules or functions, so they can't be\n" +
+			"compared.\n" +
+			"With '--fail-over' the command fails if the new snapshot grew by more than\n" +
+			"the given percentage, which can be used to catch size regressions in CI.",
+		Args:         cobra.ExactArgs(2),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			jsonOutput, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return err
+			}
+			failOver, err := cmd.Flags().GetFloat64("fail-over")
+			if err != nil {
+				return err
+			}
+			if failOver < 0 {
+				return fmt.Errorf("--fail-over must not be negative, got %v", failOver)
+			}
+
+			diff, err := diffSnapshots(args[0], args[1])
+			if err != nil {
+				return err
+			}
+
+			if jsonOutput {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(diff); err != nil {
+					return err
+				}
+			} else {
+				diff.print()
+			}
+
+			if cmd.Flags().Changed("fail-over") && diff.DeltaPercent > failOver {
+				return fmt.Errorf("the snapshot grew by %.1f%%, more than %.1f%%", diff.DeltaPercent, failOver)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("json", false, "print the differences as JSON")
+	cmd.Flags().Float64("fail-over", 0, "fail if the new snapshot is this many percent bigger than the old one")
+	return cmd
+}
+
+// snapshotDiff is the output of 'jag diff --json'.
+type snapshotDiff struct {
+	Old          string  `json:"old"`
+	New          string  `json:"new"`
+	OldSize      int64   `json:"old_bytes"`
+	NewSize      int64   `json:"new_bytes"`
+	Delta        int64   `json:"delta_bytes"`
+	DeltaPercent float64 `json:"delta_percent"`
+	// The sizes of the entries of the snapshot archives, sorted by name.
+	// An entry that only exists in one of the snapshots has size 0 in the
+	// other. Empty if Stripped is set.
+	Entries []snapshotEntryDiff `json:"entries"`
+	// Set if one of the snapshots has no debug information.
+	Stripped bool   `json:"stripped"`
+	Note     string `json:"note,omitempty"`
+}
+
+type snapshotEntryDiff struct {
+	Name    string `json:"name"`
+	OldSize int64  `json:"old_bytes"`
+	NewSize int64  `json:"new_bytes"`
+	Delta   int64  `json:"delta_bytes"`
+}
+
+func diffSnapshots(oldPath string, newPath string) (*snapshotDiff, error) {
+	oldEntries, oldSize, err := snapshotEntrySizes(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	newEntries, newSize, err := snapshotEntrySizes(newPath)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &snapshotDiff{
+		Old:     oldPath,
+		New:     newPath,
+		OldSize: oldSize,
+		NewSize: newSize,
+		Delta:   newSize - oldSize,
+		Entries: []snapshotEntryDiff{},
+	}
+	if oldSize > 0 {
+		res.DeltaPercent = float64(res.Delta) * 100 / float64(oldSize)
+	}
+
+	_, oldDebug := oldEntries[snapshotDebugEntry]
+	_, newDebug := newEntries[snapshotDebugEntry]
+	if !oldDebug || !newDebug {
+		// The parts of stripped snapshots don't line up with the ones of
+		// unstripped snapshots.
+		res.Stripped = true
+		res.Note = "at least one of the snapshots is stripped of debug information, so only the totals are reported"
+		return res, nil
+	}
+
+	names := map[string]struct{}{}
+	for name := range oldEntries {
+		names[name] = struct{}{}
+	}
+	for name := range newEntries {
+		names[name] = struct{}{}
+	}
+	for name := range names {
+		res.Entries = append(res.Entries, snapshotEntryDiff{
+			Name:    name,
+			OldSize: oldEntries[name],
+			NewSize: newEntries[name],
+			Delta:   newEntries[name] - oldEntries[name],
+		})
+	}
+	sort.Slice(res.Entries, func(i, j int) bool { return res.Entries[i].Name < res.Entries[j].Name })
+	return res, nil
+}
+
+// snapshotEntrySizes returns the sizes of the entries of the snapshot
+// archive, and the size of the file.
+func snapshotEntrySizes(path string) (map[string]int64, int64, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, fmt.Errorf("no such file: '%s'", path)
+		}
+		return nil, 0, err
+	}
+	if !IsSnapshot(path) {
+		return nil, 0, fmt.Errorf("'%s' isn't a snapshot, use 'jag compile' to create one", path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	res := map[string]int64{}
+	reader := ar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read snapshot '%s': %w", path, err)
+		}
+		res[header.Name] += header.Size
+	}
+	return res, stat.Size(), nil
+}
+
+func (d *snapshotDiff) print() {
+	fmt.Printf("Snapshot size: %s -> %s (%s, %+.1f%%)\n", formatSize(d.OldSize), formatSize(d.NewSize), formatSizeDelta(d.Delta), d.DeltaPercent)
+	for _, entry := range d.Entries {
+		fmt.Printf("  %-12s %10s -> %-10s %s\n", entry.Name, formatSize(entry.OldSize), formatSize(entry.NewSize), formatSizeDelta(entry.Delta))
+	}
+	if d.Note != "" {
+		fmt.Printf("Note: %s.\n", d.Note)
+	}
+}
+
+func formatSizeDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + formatSize(-delta)
+	}
+	return "+" + formatSize(delta)
+}
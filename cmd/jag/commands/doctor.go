@@ -0,0 +1,234 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-reuseport"
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+)
+
+// lowInotifyWatchLimit is the inotify watch limit below which 'jag watch'
+// can run out of watches for projects with many packages. Many
+// distributions still default to 8192.
+const lowInotifyWatchLimit = 65536
+
+func DoctorCmd(info Info) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Report the environment of Jaguar, for bug reports",
+		Long: "Report the operating system, the versions of Jaguar and the Toit SDK, the\n" +
+			"Jaguar devices on the network, the serial ports, and on Linux the inotify\n" +
+			"watch limit, together with any problems found with them.\n" +
+			"Please include the output in bug reports.\n" +
+			"Unlike 'jag setup --check', the command only fails if the report can't\n" +
+			"be printed. Problems are part of the report.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			jsonOutput, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return err
+			}
+			timeout, err := cmd.Flags().GetDuration("timeout")
+			if err != nil {
+				return err
+			}
+
+			report := diagnose(cmd.Context(), info, timeout)
+			if jsonOutput {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(report)
+			}
+			report.print()
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("json", false, "print the report as JSON")
+	cmd.Flags().DurationP("timeout", "t", scanTimeout, "how long to scan for devices")
+	return cmd
+}
+
+// doctorReport is the output of 'jag doctor --json'.
+type doctorReport struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	// The version of Jaguar, and the version of the SDK it was built with.
+	Version      string `json:"version"`
+	BuildDate    string `json:"build_date"`
+	BuildCommit  string `json:"build_commit"`
+	BuildSDK     string `json:"build_sdk_version"`
+	SDKVersion   string `json:"sdk_version,omitempty"`
+	SDKPath      string `json:"sdk_path,omitempty"`
+	AssetsPath   string `json:"assets_path,omitempty"`
+	ConfigPath   string `json:"config_path,omitempty"`
+	LastDevice   string `json:"last_device,omitempty"`
+	ScanPort     uint   `json:"scan_port"`
+	ScanPortOpen bool   `json:"scan_port_open"`
+	// The devices found by scanning the network.
+	Devices        []scanJsonDevice `json:"devices"`
+	Ports          []portDetails    `json:"serial_ports"`
+	ConfiguredPort string           `json:"configured_port,omitempty"`
+	// Only set on Linux.
+	InotifyWatchLimit *int `json:"inotify_max_user_watches,omitempty"`
+	// Problems found in the environment. Empty if there are none.
+	Problems []string `json:"problems"`
+}
+
+// diagnose collects the report of 'jag doctor'. Failures are recorded as
+// problems in the report.
+func diagnose(ctx context.Context, info Info, timeout time.Duration) *doctorReport {
+	res := &doctorReport{
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Version:     info.Version,
+		BuildDate:   info.Date,
+		BuildCommit: info.Commit,
+		BuildSDK:    info.SDKVersion,
+		ScanPort:    scanPort,
+		Devices:     []scanJsonDevice{},
+		Problems:    []string{},
+	}
+	problem := func(format string, a ...interface{}) {
+		res.Problems = append(res.Problems, fmt.Sprintf(format, a...))
+	}
+
+	sdk, err := GetSDK(ctx)
+	if err != nil {
+		problem("the Toit SDK can't be loaded: %v", err)
+	} else {
+		res.SDKVersion = sdk.Version
+		res.SDKPath = sdk.Path
+		if info.SDKVersion != "" && sdk.Version != info.SDKVersion {
+			problem("Jaguar was built with Toit SDK %s, but uses %s; programs only run on devices whose firmware uses the same SDK", info.SDKVersion, sdk.Version)
+		}
+	}
+
+	if assetsPath, err := directory.GetAssetsPath(); err != nil {
+		problem("the Jaguar assets are missing: %v", err)
+	} else if _, err := directory.GetJaguarSnapshotPath(); err != nil {
+		problem("the Jaguar assets are incomplete: %v", err)
+	} else {
+		res.AssetsPath = assetsPath
+	}
+
+	if cfg, err := directory.GetDeviceConfig(); err != nil {
+		problem("the device configuration can't be read: %v", err)
+	} else {
+		res.ConfigPath = cfg.ConfigFileUsed()
+		if cfg.IsSet("device") {
+			var decoded map[string]interface{}
+			if err := cfg.UnmarshalKey("device", &decoded); err == nil {
+				if d, err := NewDeviceFromJson(decoded); err == nil {
+					res.LastDevice = d.Name()
+				}
+			}
+		}
+	}
+
+	// Scanning also shows whether the port for the device broadcasts is
+	// available.
+	if pc, err := reuseport.ListenPacket("udp4", fmt.Sprintf(":%d", scanPort)); err != nil {
+		problem("can't listen for devices on UDP port %d: %v", scanPort, err)
+	} else {
+		pc.Close()
+		res.ScanPortOpen = true
+		scanCtx, cancel := context.WithTimeout(ctx, timeout)
+		scanned, err := scanNetwork(scanCtx, scanPort, nil, 0)
+		cancel()
+		if err != nil {
+			problem("scanning for devices failed: %v", err)
+		}
+		res.Devices = scanJsonDevices(scanned)
+		for _, d := range res.Devices {
+			if res.SDKVersion != "" && d.SDKVersion != "" && d.SDKVersion != res.SDKVersion {
+				problem("device '%s' runs Toit SDK %s, but the SDK in use is %s; run 'jag firmware update' to update it", d.Name, d.SDKVersion, res.SDKVersion)
+			}
+		}
+	}
+
+	if ports, err := getPortDetails(true); err != nil {
+		problem("the serial ports can't be listed: %v", err)
+	} else {
+		res.Ports = ports
+	}
+	if res.Ports == nil {
+		res.Ports = []portDetails{}
+	}
+	if port := ConfiguredPort(); port != "" {
+		res.ConfiguredPort = port
+		if exists, err := PortExists(port); err != nil {
+			problem("the serial port '%s' set with 'jag port set' can't be checked: %v", port, err)
+		} else if !exists {
+			problem("the serial port '%s' set with 'jag port set' isn't connected", port)
+		}
+	}
+
+	if limit, ok := inotifyWatchLimit(); ok {
+		res.InotifyWatchLimit = &limit
+		if limit < lowInotifyWatchLimit {
+			problem("the inotify watch limit is %d, which 'jag watch' can run out of; raise it with 'sudo sysctl fs.inotify.max_user_watches=524288'", limit)
+		}
+	}
+	return res
+}
+
+func (r *doctorReport) print() {
+	orNone := func(s string) string {
+		if s == "" {
+			return "none"
+		}
+		return s
+	}
+	fmt.Printf("OS:                 %s/%s\n", r.OS, r.Arch)
+	fmt.Printf("Jaguar:             %s (commit %s, built %s with Toit SDK %s)\n", orNone(r.Version), orNone(r.BuildCommit), orNone(r.BuildDate), orNone(r.BuildSDK))
+	if r.SDKVersion != "" {
+		fmt.Printf("Toit SDK:           %s in '%s'\n", r.SDKVersion, r.SDKPath)
+	} else {
+		fmt.Println("Toit SDK:           none")
+	}
+	fmt.Printf("Assets:             %s\n", orNone(r.AssetsPath))
+	fmt.Printf("Configuration:      %s\n", orNone(r.ConfigPath))
+	fmt.Printf("Last used device:   %s\n", orNone(r.LastDevice))
+	if r.InotifyWatchLimit != nil {
+		fmt.Printf("Inotify watches:    %d\n", *r.InotifyWatchLimit)
+	}
+	fmt.Printf("Devices:            %d found\n", len(r.Devices))
+	for _, d := range r.Devices {
+		fmt.Printf("  %s  %s  %s  %s\n", d.Name, d.Address, d.Chip, d.SDKVersion)
+	}
+	fmt.Printf("Serial ports:       %d found\n", len(r.Ports))
+	for _, p := range r.Ports {
+		line := "  " + p.Name
+		if p.USB {
+			line += "  " + p.VID + ":" + p.PID
+		}
+		if p.Hint != "" {
+			line += "  " + p.Hint
+		}
+		if p.Name == r.ConfiguredPort {
+			line += "  (set with 'jag port set')"
+		}
+		fmt.Println(line)
+	}
+	if len(r.Problems) == 0 {
+		fmt.Println("No problems found.")
+		return
+	}
+	fmt.Println("Problems:")
+	for _, problem := range r.Problems {
+		fmt.Printf("  - %s\n", strings.ReplaceAll(problem, "\n", "\n    "))
+	}
+}
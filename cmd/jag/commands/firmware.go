@@ -5,9 +5,12 @@
 package commands
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/coreos/go-semver/semver"
 	"github.com/spf13/cobra"
 	"github.com/toitlang/jaguar/cmd/jag/directory"
 )
@@ -50,9 +53,11 @@ func FirmwareCmd() *cobra.Command {
 
 func FirmwareUpdateCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:          "update [envelope]",
-		Short:        "Update the firmware on a Jaguar device",
-		Long:         "Update the firmware on a Jaguar device via WiFi",
+		Use:   "update [envelope]",
+		Short: "Update the firmware on a Jaguar device",
+		Long: "Update the firmware on a Jaguar device via WiFi.\n" +
+			"With '--check', only compare the firmware on the device with the one of\n" +
+			"the installed SDK, without updating it.",
 		Args:         cobra.MaximumNArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -62,6 +67,22 @@ func FirmwareUpdateCmd() *cobra.Command {
 				return err
 			}
 
+			check, err := cmd.Flags().GetBool("check")
+			if err != nil {
+				return err
+			}
+			jsonOutput, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return err
+			}
+			if jsonOutput && !check {
+				return fmt.Errorf("--json can only be used with --check")
+			}
+			if jsonOutput {
+				// Keep stdout for the JSON.
+				ctx = withOutput(ctx, os.Stderr)
+			}
+
 			sdk, err := GetSDK(ctx)
 			if err != nil {
 				return err
@@ -72,6 +93,10 @@ func FirmwareUpdateCmd() *cobra.Command {
 				return err
 			}
 
+			if check {
+				return printFirmwareCheck(device, sdk, jsonOutput)
+			}
+
 			// We get a new ID for the device, so entries in the device flash stored
 			// by an older version are invalidated.
 			return withFirmware(cmd, args, device, func(newID string, envelopeFile *os.File, config map[string]interface{}) error {
@@ -102,17 +127,71 @@ func FirmwareUpdateCmd() *cobra.Command {
 				if err != nil {
 					return err
 				}
-				deviceCfg.Set("device", device.ToJson())
-				return deviceCfg.WriteConfig()
+				return storeDevice(deviceCfg, device)
 			})
 		},
 	}
 
 	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
+	cmd.Flags().Bool("check", false, "only report whether an update is available, without updating")
+	cmd.Flags().Bool("json", false, "print the result of '--check' as JSON")
 	addFirmwareFlashFlags(cmd, "", "new name of the device, if given")
 	return cmd
 }
 
+// firmwareCheck is the output of 'jag firmware update --check --json'.
+type firmwareCheck struct {
+	Device      string `json:"device"`
+	Installed   string `json:"installed"`
+	Available   string `json:"available"`
+	Status      string `json:"status"`
+	Recommended bool   `json:"update_recommended"`
+}
+
+func printFirmwareCheck(device Device, sdk *SDK, jsonOutput bool) error {
+	res := firmwareCheck{
+		Device:    device.Name(),
+		Installed: device.SDKVersion(),
+		Available: sdk.Version,
+	}
+	installed, installedErr := semver.NewVersion(strings.TrimPrefix(res.Installed, "v"))
+	available, availableErr := semver.NewVersion(strings.TrimPrefix(res.Available, "v"))
+	switch {
+	case res.Installed == res.Available:
+		res.Status = "up-to-date"
+	case installedErr != nil || availableErr != nil:
+		// We can't tell which one is newer, but the device doesn't run the
+		// SDK that programs are compiled with.
+		res.Status = "different"
+		res.Recommended = true
+	case installed.LessThan(*available):
+		res.Status = "update-available"
+		res.Recommended = true
+	case available.LessThan(*installed):
+		res.Status = "device-newer"
+	default:
+		res.Status = "up-to-date"
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(res)
+	}
+
+	fmt.Printf("Device '%s' is running Toit SDK %s\n", res.Device, res.Installed)
+	fmt.Printf("The installed SDK has firmware for Toit SDK %s\n", res.Available)
+	switch res.Status {
+	case "up-to-date":
+		fmt.Println("The firmware is up to date")
+	case "device-newer":
+		fmt.Println("The device runs a newer firmware than the installed SDK. Consider updating Jaguar")
+	default:
+		fmt.Println("An update is recommended. Run 'jag firmware update' to update")
+	}
+	return nil
+}
+
 func FirmwareExtractCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "extract [envelope]",
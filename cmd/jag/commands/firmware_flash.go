@@ -22,8 +22,8 @@ type callback func(id string, envelopeFile *os.File, config map[string]interface
 func addFirmwareFlashFlags(cmd *cobra.Command, defaultChip string, nameHelp string) {
 	cmd.Flags().String("name", "", nameHelp)
 	cmd.Flags().StringP("chip", "c", defaultChip, "chip of the target device")
-	cmd.Flags().String("wifi-ssid", "", "default WiFi network name")
-	cmd.Flags().String("wifi-password", "", "default WiFi password")
+	cmd.Flags().String("wifi-ssid", "", "WiFi network name the device connects to (asked for if not configured); its password then comes from --wifi-password or is asked for, never from the configuration")
+	cmd.Flags().String("wifi-password", "", "WiFi password (asked for without echoing if neither given nor configured)")
 	cmd.Flags().Bool("exclude-jaguar", false, "don't install the Jaguar service")
 	cmd.Flags().Int("uart-endpoint-rx", -1, "add a UART endpoint to the device listening on the given pin")
 	cmd.Flags().MarkHidden("uart-endpoint-rx")
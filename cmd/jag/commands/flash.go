@@ -5,11 +5,18 @@
 package commands
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"os"
+	"os/exec"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"golang.org/x/term"
 )
 
 func FlashCmd() *cobra.Command {
@@ -18,7 +25,18 @@ func FlashCmd() *cobra.Command {
 		Short: "Flash an ESP32 with the Jaguar firmware",
 		Long: "Flash an ESP32 with the Jaguar firmware. The initial flashing is\n" +
 			"done over a serial connection and it is used to give the ESP32 its initial\n" +
-			"firmware and the necessary WiFi credentials.",
+			"firmware and the necessary WiFi credentials.\n" +
+			"\n" +
+			"The WiFi credentials are taken from '--wifi-ssid' and '--wifi-password',\n" +
+			"the JAG_WIFI_SSID and JAG_WIFI_PASSWORD environment variables, or the ones\n" +
+			"stored with 'jag config wifi set', in that order. If none are found, they\n" +
+			"are asked for, without echoing the password. The stored password is only\n" +
+			"used for the stored network, so with '--wifi-ssid' alone it is asked for.\n" +
+			"\n" +
+			"With '--erase' the whole flash is erased before flashing, which can recover\n" +
+			"a device that doesn't boot anymore. This wipes all data on the device,\n" +
+			"including installed containers and stored settings. It asks for\n" +
+			"confirmation unless '--yes' is given.",
 		Args:         cobra.MaximumNArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -43,6 +61,20 @@ func FlashCmd() *cobra.Command {
 				return err
 			}
 
+			erase, err := cmd.Flags().GetBool("erase")
+			if err != nil {
+				return err
+			}
+			if erase {
+				yes, err := cmd.Flags().GetBool("yes")
+				if err != nil {
+					return err
+				}
+				if err := confirmErase(port, yes); err != nil {
+					return err
+				}
+			}
+
 			return withFirmware(cmd, args, nil, func(id string, envelopeFile *os.File, config map[string]interface{}) error {
 
 				sdk, err := GetSDK(ctx)
@@ -74,6 +106,16 @@ func FlashCmd() *cobra.Command {
 					file.Close()
 				}
 
+				if erase {
+					chip, err := cmd.Flags().GetString("chip")
+					if err != nil {
+						return err
+					}
+					if err := eraseFlash(ctx, chip, port, baud); err != nil {
+						return err
+					}
+				}
+
 				fmt.Printf("Flashing device over serial on port '%s' ...\n", port)
 				return runFirmwareToolWithConfig(ctx, sdk, envelopeFile.Name(), config, flashArguments...)
 			})
@@ -83,6 +125,82 @@ func FlashCmd() *cobra.Command {
 	cmd.Flags().StringP("port", "p", ConfiguredPort(), "serial port to flash via")
 	cmd.Flags().Uint("baud", 921600, "baud rate used for the serial flashing")
 	cmd.Flags().Bool("skip-port-check", false, "accept the given port without checking")
+	cmd.Flags().Bool("erase", false, "erase the whole flash before flashing, wiping all data on the device")
+	cmd.Flags().BoolP("yes", "y", false, "don't ask for confirmation before erasing")
 	addFirmwareFlashFlags(cmd, "esp32", "name for the device, if not set a name will be auto generated")
 	return cmd
 }
+
+// confirmErase asks the user to confirm that the flash on the port is
+// erased, unless yes is set.
+func confirmErase(port string, yes bool) error {
+	if yes {
+		return nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("--erase wipes all data on the device, use --yes to confirm it without a terminal")
+	}
+	fmt.Printf("This erases all data on the device on port '%s', including its containers and settings.\n", port)
+	fmt.Print("Continue? [y/N] ")
+	answer, err := ReadLine()
+	if err != nil {
+		return err
+	}
+	if answer := strings.ToLower(answer); answer != "y" && answer != "yes" {
+		return fmt.Errorf("erase cancelled")
+	}
+	return nil
+}
+
+// eraseFlash erases the whole flash of the device on the port. The output
+// of esptool is only shown if the erase fails, and a progress line is shown
+// instead, since a full erase can take a while.
+func eraseFlash(ctx context.Context, chip string, port string, baud uint) error {
+	esptool, err := directory.GetEsptoolPath()
+	if err != nil {
+		return err
+	}
+	args := []string{"--port", port, "--baud", strconv.Itoa(int(baud))}
+	if chip != "" && chip != "auto" {
+		args = append(args, "--chip", chip)
+	}
+	args = append(args, "erase_flash")
+
+	var output bytes.Buffer
+	erase := exec.CommandContext(ctx, esptool, args...)
+	erase.Stdout = &output
+	erase.Stderr = &output
+	if err := erase.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- erase.Wait() }()
+
+	start := time.Now()
+	tty := term.IsTerminal(int(os.Stdout.Fd()))
+	fmt.Printf("Erasing the flash on port '%s' ...", port)
+	if !tty {
+		fmt.Println()
+	}
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			elapsed := time.Since(start).Round(100 * time.Millisecond)
+			if tty {
+				fmt.Printf("\rErasing the flash on port '%s' ... %s\n", port, elapsed)
+			}
+			if err != nil {
+				os.Stdout.Write(output.Bytes())
+				return fmt.Errorf("failed to erase the flash: %w", err)
+			}
+			fmt.Printf("Erased the flash in %s\n", elapsed)
+			return nil
+		case <-ticker.C:
+			if tty {
+				fmt.Printf("\rErasing the flash on port '%s' ... %s", port, time.Since(start).Round(time.Second))
+			}
+		}
+	}
+}
@@ -23,13 +23,18 @@ import (
 type ctxKey string
 
 const (
-	ctxKeyInfo          ctxKey = "info"
-	noAnalyticsFlagName string = "no-analytics"
+	ctxKeyInfo              ctxKey = "info"
+	ctxKeyNoDefaultDevice   ctxKey = "no-default-device"
+	ctxKeySDKPath           ctxKey = "sdk-path"
+	noAnalyticsFlagName     string = "no-analytics"
+	noDefaultDeviceFlagName string = "no-default-device"
+	sdkFlagName             string = "sdk"
 )
 
 type Info struct {
 	Version    string `mapstructure:"version" yaml:"version" json:"version"`
 	Date       string `mapstructure:"date" yaml:"date" json:"date"`
+	Commit     string `mapstructure:"commit" yaml:"commit" json:"commit"`
 	SDKVersion string `mapstructure:"sdkVersion" yaml:"sdkVersion" json:"sdkVersion"`
 }
 
@@ -41,6 +46,13 @@ func GetInfo(ctx context.Context) Info {
 	return ctx.Value(ctxKeyInfo).(Info)
 }
 
+// useDefaultDevice returns whether the last used device may be picked when
+// no device is given on the command line.
+func useDefaultDevice(ctx context.Context) bool {
+	noDefault, _ := ctx.Value(ctxKeyNoDefaultDevice).(bool)
+	return !noDefault
+}
+
 func JagCmd(info Info, isReleaseBuild bool) *cobra.Command {
 	configCmd := ConfigCmd(info)
 
@@ -52,11 +64,24 @@ func JagCmd(info Info, isReleaseBuild bool) *cobra.Command {
 			"ESP32 applications written in Toit over WiFi. Change your Toit code in your editor, update\n" +
 			"the application on your device, and restart it all within seconds. No need to flash over\n" +
 			"serial, reboot your device, or wait for it to reconnect to your network.",
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			colorMode, _ := cmd.Flags().GetString(colorFlagName)
+			color, err := resolveColor(colorMode)
+			if err != nil {
+				return err
+			}
+			cmd.SetContext(withColor(cmd.Context(), color))
+			if noDefault, _ := cmd.Flags().GetBool(noDefaultDeviceFlagName); noDefault {
+				cmd.SetContext(context.WithValue(cmd.Context(), ctxKeyNoDefaultDevice, true))
+			}
+			if sdkPath, _ := cmd.Flags().GetString(sdkFlagName); sdkPath != "" {
+				cmd.SetContext(context.WithValue(cmd.Context(), ctxKeySDKPath, sdkPath))
+			}
+
 			// Avoid running the up-to-date check code when
 			// we're most likely running on a build bot.
 			if isLikelyRunningOnBuildbot() {
-				return
+				return nil
 			}
 
 			// Avoid running the up-to-date check code when
@@ -64,24 +89,31 @@ func JagCmd(info Info, isReleaseBuild bool) *cobra.Command {
 			current := cmd
 			for current.HasParent() {
 				if current == configCmd {
-					return
+					return nil
 				}
 				current = current.Parent()
 			}
 
 			CheckUpToDate(info)
+			return nil
 		},
 	}
 
 	cmd.AddCommand(
 		ScanCmd(),
+		DevicesCmd(),
 		ContainerCmd(),
 		PingCmd(),
 		RunCmd(),
 		CompileCmd(),
+		DiffCmd(),
 		SimulateCmd(),
 		DecodeCmd(),
+		DepsCmd(),
+		AssetsCmd(),
 		SetupCmd(info),
+		DoctorCmd(info),
+		SDKCmd(),
 		FlashCmd(),
 		FirmwareCmd(),
 		MonitorCmd(),
@@ -95,6 +127,9 @@ func JagCmd(info Info, isReleaseBuild bool) *cobra.Command {
 
 	cmd.PersistentFlags().Bool(noAnalyticsFlagName, false, "do not send analytics")
 	cmd.PersistentFlags().MarkHidden(noAnalyticsFlagName)
+	cmd.PersistentFlags().Bool(noDefaultDeviceFlagName, false, "don't fall back to the last used device when no device is given")
+	cmd.PersistentFlags().String(sdkFlagName, "", "use the Toit SDK in this directory for this invocation")
+	cmd.PersistentFlags().String(colorFlagName, colorAuto, "color the output: 'auto' (on terminals, unless NO_COLOR is set), 'always', or 'never'")
 	return cmd
 }
 
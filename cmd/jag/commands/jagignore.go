@@ -0,0 +1,175 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const jagIgnoreFile = ".jagignore"
+
+// ignorePattern is a single line of a .jagignore file.
+type ignorePattern struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+	// Anchored patterns are matched relative to the directory of the
+	// .jagignore file. Other patterns match a name at any level.
+	anchored bool
+}
+
+// ignoreFile holds the patterns of a .jagignore file together with the
+// directory they are relative to.
+type ignoreFile struct {
+	dir      string
+	patterns []ignorePattern
+}
+
+// ignoreMatcher decides which paths 'jag watch' should ignore, based on the
+// .jagignore files found from the entrypoint directory upwards. Patterns use
+// the gitignore syntax. Patterns in deeper files take precedence.
+type ignoreMatcher struct {
+	// Ordered from the root to the entrypoint directory.
+	files []ignoreFile
+}
+
+// loadIgnoreMatcher collects the .jagignore files in the directory of the
+// entrypoint and all its parents.
+func loadIgnoreMatcher(entrypoint string) (*ignoreMatcher, error) {
+	dir, err := filepath.Abs(filepath.Dir(entrypoint))
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+
+	var files []ignoreFile
+	for {
+		patterns, err := readIgnoreFile(filepath.Join(dir, jagIgnoreFile))
+		if err != nil {
+			return nil, err
+		}
+		if len(patterns) > 0 {
+			files = append([]ignoreFile{{dir: dir, patterns: patterns}}, files...)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return &ignoreMatcher{files: files}, nil
+}
+
+func readIgnoreFile(p string) ([]ignorePattern, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []ignorePattern
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if pattern, ok := parseIgnorePattern(scanner.Text()); ok {
+			res = append(res, pattern)
+		}
+	}
+	return res, scanner.Err()
+}
+
+func parseIgnorePattern(line string) (ignorePattern, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignorePattern{}, false
+	}
+
+	var res ignorePattern
+	if strings.HasPrefix(line, "!") {
+		res.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		res.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	res.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return ignorePattern{}, false
+	}
+	res.segments = strings.Split(line, "/")
+	return res, true
+}
+
+// Match returns whether the given file should be ignored.
+func (m *ignoreMatcher) Match(p string) bool {
+	if m == nil {
+		return false
+	}
+	ignored := false
+	for _, file := range m.files {
+		rel, err := filepath.Rel(file.dir, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+		for _, pattern := range file.patterns {
+			if pattern.match(segments) {
+				ignored = !pattern.negate
+			}
+		}
+	}
+	return ignored
+}
+
+func (p ignorePattern) match(segments []string) bool {
+	// A pattern that matches a directory also matches everything in it.
+	for k := 1; k <= len(segments); k++ {
+		if k == len(segments) && p.dirOnly {
+			break
+		}
+		prefix := segments[:k]
+		if p.anchored {
+			if matchSegments(p.segments, prefix) {
+				return true
+			}
+		} else if len(p.segments) == 1 {
+			if ok, _ := path.Match(p.segments[0], prefix[k-1]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, jagIgnoreFile), "# Comment\n"+
+		"*.gen.toit\n"+
+		"build/\n"+
+		"/generated\n"+
+		"docs/**/*.toit\n"+
+		"!keep.gen.toit\n"+
+		"\n")
+	// Patterns of the deeper file take precedence.
+	writeFile(t, filepath.Join(dir, "app", jagIgnoreFile), "!*.gen.toit\nlocal.toit\n")
+	createFiles(t, dir, "app/main.toit")
+
+	m, err := loadIgnoreMatcher(filepath.Join(dir, "app", "main.toit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"main.toit", false},
+		{"a.gen.toit", true},
+		{"lib/a.gen.toit", true},
+		{"keep.gen.toit", false},
+		{"build/out.toit", true},
+		{"lib/build/out.toit", true},
+		// Only directories match 'build/'.
+		{"build", false},
+		{"generated/a.toit", true},
+		{"lib/generated/a.toit", false},
+		{"docs/a.toit", true},
+		{"docs/x/y/a.toit", true},
+		{"lib/docs/a.toit", false},
+		{"app/a.gen.toit", false},
+		{"app/local.toit", true},
+		{"local.toit", false},
+		{"app/build/out.toit", true},
+	}
+	for _, test := range tests {
+		if got := m.Match(filepath.Join(dir, filepath.FromSlash(test.path))); got != test.want {
+			t.Errorf("Match(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+	if m.Match(filepath.Join(filepath.Dir(dir), "a.gen.toit")) {
+		t.Errorf("matched a file outside of the directory of the .jagignore file")
+	}
+
+	// Without .jagignore files, as with '--no-ignore', nothing is ignored.
+	var none *ignoreMatcher
+	if none.Match(filepath.Join(dir, "a.gen.toit")) {
+		t.Errorf("the nil matcher ignored a file")
+	}
+}
+
+func TestWatchIgnoredDependency(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	lib := filepath.Join(dir, "lib.toit")
+	generated := filepath.Join(dir, "generated", "gen.toit")
+	writeFile(t, filepath.Join(dir, jagIgnoreFile), "generated/\n")
+	writeFile(t, lib, "")
+	writeFile(t, generated, "")
+	writeFile(t, main, imports(lib, generated))
+
+	for _, noIgnore := range []bool{false, true} {
+		ignores := map[string]*ignoreMatcher{}
+		if !noIgnore {
+			m, err := loadIgnoreMatcher(main)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ignores[main] = m
+		}
+		s := startWatchSession(t, watchOptions{ignores: ignores}, main)
+		if exit := s.runEnd(); exit != 0 {
+			t.Fatalf("the first run failed with %d", exit)
+		}
+		s.waitUntilWatched(main, generated)
+
+		s.change(generated, "// changed\n")
+		if noIgnore {
+			if event := s.next(WatchEventRunStart); event.File != generated {
+				t.Errorf("the run was for '%s', want '%s'", event.File, generated)
+			}
+			s.runEnd()
+		} else {
+			s.expectNoRun(500 * time.Millisecond)
+			s.change(lib, "// changed\n")
+			if event := s.next(WatchEventRunStart); event.File != lib {
+				t.Errorf("the run was for '%s', want '%s'", event.File, lib)
+			}
+			s.runEnd()
+		}
+		s.cancel()
+	}
+}
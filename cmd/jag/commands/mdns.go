@@ -0,0 +1,192 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	mdnsTimeout  = 2 * time.Second
+	mdnsCacheTTL = 30 * time.Second
+)
+
+var mdnsAddress = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// isMDNSHostname returns whether the host is resolved with multicast DNS.
+func isMDNSHostname(host string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), ".local")
+}
+
+// deviceHostnameSelect selects a device by its mDNS hostname, optionally
+// followed by a port.
+type deviceHostnameSelect string
+
+func (s deviceHostnameSelect) hostPort() (string, string) {
+	if host, port, err := net.SplitHostPort(string(s)); err == nil {
+		return host, port
+	}
+	return string(s), ""
+}
+
+func (s deviceHostnameSelect) Match(d Device) bool {
+	host, _ := s.hostPort()
+	ip, ok := mdnsCache.lookup(host)
+	if !ok {
+		return false
+	}
+	return deviceAddressSelect(ip.String()).Match(d)
+}
+
+func (s deviceHostnameSelect) Address() string {
+	return string(s)
+}
+
+func (s deviceHostnameSelect) String() string {
+	return fmt.Sprintf("device with hostname: '%s'", string(s))
+}
+
+// resolve returns a selection of the device by the address the hostname
+// resolves to.
+func (s deviceHostnameSelect) resolve(ctx context.Context) (deviceAddressSelect, error) {
+	host, port := s.hostPort()
+	ip, err := resolveMDNS(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if port == "" {
+		return deviceAddressSelect(ip.String()), nil
+	}
+	return deviceAddressSelect(net.JoinHostPort(ip.String(), port)), nil
+}
+
+type mdnsCacheEntry struct {
+	ip      net.IP
+	expires time.Time
+}
+
+// mdnsCache keeps resolved hostnames for a short while, so a 'jag watch'
+// session doesn't query the network for every run.
+var mdnsCache = &mdnsResolutions{entries: map[string]mdnsCacheEntry{}}
+
+type mdnsResolutions struct {
+	mutex   sync.Mutex
+	entries map[string]mdnsCacheEntry
+}
+
+func (c *mdnsResolutions) lookup(host string) (net.IP, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[strings.ToLower(host)]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.ip, true
+}
+
+func (c *mdnsResolutions) store(host string, ip net.IP) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[strings.ToLower(host)] = mdnsCacheEntry{ip: ip, expires: time.Now().Add(mdnsCacheTTL)}
+}
+
+// resolveMDNS resolves a '.local' hostname to an IPv4 address. The system
+// resolver is tried first, as it often knows about mDNS already. Otherwise
+// a query is multicast on the local network.
+func resolveMDNS(ctx context.Context, host string) (net.IP, error) {
+	if ip, ok := mdnsCache.lookup(host); ok {
+		return ip, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mdnsTimeout)
+	defer cancel()
+
+	ip, err := lookupSystemIPv4(ctx, host)
+	if err != nil {
+		ip, err = queryMDNS(ctx, host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the mDNS hostname '%s': %w", host, err)
+	}
+	mdnsCache.store(host, ip)
+	return ip, nil
+}
+
+func lookupSystemIPv4(ctx context.Context, host string) (net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ip := addr.IP.To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("no IPv4 address for '%s'", host)
+}
+
+func queryMDNS(ctx context.Context, host string) (net.IP, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name: name,
+			Type: dnsmessage.TypeA,
+			// Ask for a unicast response, so we don't have to join the
+			// multicast group.
+			Class: dnsmessage.ClassINET | (1 << 15),
+		}},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := conn.WriteTo(packet, mdnsAddress); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if isTimeoutError(err) {
+				return nil, fmt.Errorf("no answer within %s", mdnsTimeout)
+			}
+			return nil, err
+		}
+		var response dnsmessage.Message
+		if err := response.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		for _, answer := range response.Answers {
+			if !strings.EqualFold(answer.Header.Name.String(), name.String()) {
+				continue
+			}
+			if a, ok := answer.Body.(*dnsmessage.AResource); ok {
+				return net.IP(a.A[:]), nil
+			}
+		}
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"regexp"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,8 +22,14 @@ import (
 
 func MonitorCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:          "monitor",
-		Short:        "Monitor the serial output of an ESP32",
+		Use:   "monitor",
+		Short: "Monitor the serial output of an ESP32",
+		Long: "Monitor the serial output of an ESP32.\n" +
+			"The device is rebooted first, unless '--attach' is given.\n" +
+			"With '--since' the output of the recent past is shown before the live\n" +
+			"output, if the device keeps it. The serial protocol of Jaguar doesn't\n" +
+			"keep a history yet, so for now only a notice is printed. Since rebooting\n" +
+			"would lose the history, '--since' implies '--attach'.",
 		Args:         cobra.NoArgs,
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -33,7 +41,7 @@ func MonitorCmd() *cobra.Command {
 				return err
 			}
 
-			if port, err = CheckPort(port); err != nil {
+			if port, err = checkMonitorPort(port, cmd.Flags().Changed("port")); err != nil {
 				return err
 			}
 
@@ -41,12 +49,29 @@ func MonitorCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
+			if baud == 0 {
+				return fmt.Errorf("--baud must be positive")
+			}
 
 			attach, err := cmd.Flags().GetBool("attach")
 			if err != nil {
 				return err
 			}
 
+			since, err := cmd.Flags().GetDuration("since")
+			if err != nil {
+				return err
+			}
+			if since < 0 {
+				return fmt.Errorf("--since must not be negative, got %s", since)
+			}
+			if since > 0 {
+				if cmd.Flags().Changed("attach") && !attach {
+					return fmt.Errorf("--since can't be used with --attach=false, since rebooting loses the device's output")
+				}
+				attach = true
+			}
+
 			pretty, err := cmd.Flags().GetBool("force-pretty")
 			if err != nil {
 				return err
@@ -57,14 +82,90 @@ func MonitorCmd() *cobra.Command {
 				return err
 			}
 
-			fmt.Printf("Starting serial monitor of port '%s' ...\n", port)
-			dev, err := serialOpen(port, &serial.Mode{
+			reconnect, err := cmd.Flags().GetBool("reconnect")
+			if err != nil {
+				return err
+			}
+
+			reconnectInterval, err := cmd.Flags().GetDuration("reconnect-interval")
+			if err != nil {
+				return err
+			}
+			if reconnectInterval <= 0 {
+				return fmt.Errorf("--reconnect-interval must be positive, got %s", reconnectInterval)
+			}
+
+			reconnectAttempts, err := cmd.Flags().GetInt("reconnect-attempts")
+			if err != nil {
+				return err
+			}
+			if reconnectAttempts < 0 {
+				return fmt.Errorf("--reconnect-attempts must not be negative, got %d", reconnectAttempts)
+			}
+
+			shouldProxy, err := cmd.Flags().GetBool("proxy")
+			if err != nil {
+				return err
+			}
+			if shouldProxy && reconnect {
+				return fmt.Errorf("--reconnect can't be used with --proxy")
+			}
+
+			envelope, err := cmd.Flags().GetString("envelope")
+			if err != nil {
+				return err
+			}
+
+			timestamps, err := parseTimestampFlags(cmd)
+			if err != nil {
+				return err
+			}
+
+			filter, err := parseLineFilterFlags(cmd)
+			if err != nil {
+				return err
+			}
+			output, err := cmd.Flags().GetString("output")
+			if err != nil {
+				return err
+			}
+			appendOutput, err := cmd.Flags().GetBool("append")
+			if err != nil {
+				return err
+			}
+			if appendOutput && output == "" {
+				return fmt.Errorf("--append can only be used with --output")
+			}
+
+			decode, err := cmd.Flags().GetBool("decode")
+			if err != nil {
+				return err
+			}
+
+			opts := monitorOptions{
+				timestamps: timestamps,
+				filter:     filter,
+				raw:        !decode,
+				// Stack traces printed by the monitor are likely to be from
+				// the program that was just deployed.
+				useLastDeployed: decode,
+			}
+			if output != "" {
+				if opts.log, err = openMonitorLog(output, appendOutput); err != nil {
+					return err
+				}
+				defer opts.log.Close()
+			}
+
+			mode := &serial.Mode{
 				BaudRate: int(baud),
-			})
+			}
+			fmt.Printf("Starting serial monitor of port '%s' ...\n", port)
+			dev, err := serialOpen(port, mode)
 			if err != nil {
 				return err
 			}
-			defer dev.Close()
+			defer func() { dev.Close() }()
 
 			signalChan := make(chan os.Signal, 1)
 			signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
@@ -79,55 +180,290 @@ func MonitorCmd() *cobra.Command {
 			if !attach {
 				dev.Reboot()
 			}
+			if since > 0 {
+				// Devices only print their output to the serial port as it
+				// happens, so there is nothing to replay.
+				fmt.Printf("-- the device doesn't keep its output, showing live output only --\n")
+			}
 
 			var logReader io.Reader = dev
 
-			shouldProxy, err := cmd.Flags().GetBool("proxy")
-			if err != nil {
-				return err
-			}
-
 			if shouldProxy {
 				ch1, ch2 := multiplexReader(dev)
 				logReader = ch1
 				go runUartProxy(dev, ch2)
 			}
 
-			scanner := bufio.NewScanner(logReader)
+			for {
+				err := monitorReader(ctx, logReader, envelope, pretty, plain, opts)
+				if !reconnect || ctx.Err() != nil {
+					return err
+				}
 
-			envelope, err := cmd.Flags().GetString("envelope")
-			if err != nil {
-				return err
-			}
-
-			// Create a context-aware decoder that can be interrupted.
-			decoder := NewDecoder(scanner, ctx, envelope)
-			done := make(chan error, 1)
-			go func() {
-				decoder.decode(pretty, plain)
-				done <- scanner.Err()
-			}()
-
-			// Wait for either completion or context cancellation.
-			select {
-			case err := <-done:
-				return err
-			case <-ctx.Done():
-				return ctx.Err()
+				if err != nil {
+					fmt.Println(paint(ctx, styleError, fmt.Sprintf("-- connection lost: %v --", err)))
+					opts.log.writeLine(fmt.Sprintf("-- connection lost: %v --", err))
+				} else {
+					fmt.Println(paint(ctx, styleError, "-- connection lost --"))
+					opts.log.writeLine("-- connection lost --")
+				}
+				dev.Close()
+				dev, err = reopenSerial(ctx, port, mode, reconnectInterval, reconnectAttempts)
+				if err != nil {
+					return err
+				}
+				fmt.Println(paint(ctx, styleSuccess, "-- reconnected --"))
+				opts.log.writeLine("-- reconnected --")
+				logReader = dev
 			}
 		},
 	}
 
-	cmd.Flags().StringP("port", "p", ConfiguredPort(), "port to monitor")
+	cmd.Flags().StringP("port", "p", ConfiguredPort(), "port to monitor (defaults to the port set with 'jag port set')")
 	cmd.Flags().BoolP("attach", "a", false, "attach to the serial output without rebooting it")
+	cmd.Flags().Duration("since", 0, "show the output of the recent past first, if the device keeps it (implies '--attach')")
 	cmd.Flags().BoolP("force-pretty", "r", false, "force output to use terminal graphics")
 	cmd.Flags().BoolP("force-plain", "l", false, "force output to use plain ASCII text")
 	cmd.Flags().Uint("baud", 115200, "the baud rate for serial monitoring")
 	cmd.Flags().Bool("proxy", false, "proxy the connected device to the local network")
 	cmd.Flags().String("envelope", "", "name or path of the firmware envelope")
+	cmd.Flags().Bool("reconnect", false, "reopen the port when the connection is lost, for example when the device reboots")
+	cmd.Flags().Duration("reconnect-interval", time.Second, "the initial time between attempts to reopen the port")
+	cmd.Flags().Int("reconnect-attempts", 0, "give up after this many failed attempts to reopen the port (0 means never)")
+	cmd.Flags().Bool("timestamps", false, "prefix each line with the time it was received")
+	cmd.Flags().String("time-format", "rfc3339", "format of the timestamps: rfc3339, relative, both, or none (implies '--timestamps')")
+	cmd.Flags().String("grep", "", "only print lines matching this regular expression")
+	cmd.Flags().String("exclude", "", "don't print lines matching this regular expression (wins over '--grep')")
+	cmd.Flags().StringP("output", "o", "", "also write all received lines to this file")
+	cmd.Flags().Bool("append", false, "append to the '--output' file instead of overwriting it")
+	cmd.Flags().Bool("decode", true, "decode stack traces inline, falling back to the most recently deployed snapshot")
 	return cmd
 }
 
+// monitorLogFlushInterval is how often the monitor log is flushed to disk.
+const monitorLogFlushInterval = time.Second
+
+// monitorLog writes the monitored lines to a file. Writes are buffered and
+// flushed periodically. A nil monitorLog discards all lines.
+type monitorLog struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	done   chan struct{}
+}
+
+func openMonitorLog(path string, appendToFile bool) (*monitorLog, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appendToFile {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open '%s': %w", path, err)
+	}
+	res := &monitorLog{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(monitorLogFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				res.mutex.Lock()
+				res.writer.Flush()
+				res.mutex.Unlock()
+			case <-res.done:
+				return
+			}
+		}
+	}()
+	return res, nil
+}
+
+func (l *monitorLog) writeLine(line string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.writer.WriteString(line)
+	l.writer.WriteByte('\n')
+}
+
+func (l *monitorLog) Close() error {
+	close(l.done)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.writer.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// monitorOptions control how the lines from the device are printed.
+// The zero value prints all lines unchanged.
+type monitorOptions struct {
+	timestamps *lineTimestamper
+	filter     *lineFilter
+	log        *monitorLog
+	raw        bool
+	// See Decoder.useLastDeployed.
+	useLastDeployed bool
+}
+
+// lineFilter selects the lines to print. A nil lineFilter matches all lines.
+type lineFilter struct {
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+func parseLineFilterFlags(cmd *cobra.Command) (*lineFilter, error) {
+	include, err := cmd.Flags().GetString("grep")
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := cmd.Flags().GetString("exclude")
+	if err != nil {
+		return nil, err
+	}
+	if include == "" && exclude == "" {
+		return nil, nil
+	}
+	res := &lineFilter{}
+	if include != "" {
+		if res.include, err = regexp.Compile(include); err != nil {
+			return nil, fmt.Errorf("invalid --grep '%s': %w", include, err)
+		}
+	}
+	if exclude != "" {
+		if res.exclude, err = regexp.Compile(exclude); err != nil {
+			return nil, fmt.Errorf("invalid --exclude '%s': %w", exclude, err)
+		}
+	}
+	return res, nil
+}
+
+func (f *lineFilter) Match(line string) bool {
+	if f == nil {
+		return true
+	}
+	if f.exclude != nil && f.exclude.MatchString(line) {
+		return false
+	}
+	return f.include == nil || f.include.MatchString(line)
+}
+
+// lineTimestamper computes the timestamp prefixes of monitored lines.
+// A nil lineTimestamper doesn't add any prefix.
+type lineTimestamper struct {
+	wallClock bool
+	relative  bool
+	// The time relative timestamps are measured from.
+	start time.Time
+}
+
+func parseTimestampFlags(cmd *cobra.Command) (*lineTimestamper, error) {
+	enabled, err := cmd.Flags().GetBool("timestamps")
+	if err != nil {
+		return nil, err
+	}
+	format, err := cmd.Flags().GetString("time-format")
+	if err != nil {
+		return nil, err
+	}
+	if !enabled && !cmd.Flags().Changed("time-format") {
+		return nil, nil
+	}
+	res := &lineTimestamper{start: time.Now()}
+	switch format {
+	case "rfc3339":
+		res.wallClock = true
+	case "relative":
+		res.relative = true
+	case "both":
+		res.wallClock = true
+		res.relative = true
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("invalid --time-format '%s', must be one of rfc3339, relative, both, or none", format)
+	}
+	return res, nil
+}
+
+func (t *lineTimestamper) prefix(now time.Time) string {
+	if t == nil {
+		return ""
+	}
+	res := ""
+	if t.wallClock {
+		// Use a fixed number of fractional digits, so the lines stay aligned.
+		res += "[" + now.Format("2006-01-02T15:04:05.000Z07:00") + "] "
+	}
+	if t.relative {
+		res += fmt.Sprintf("[+%10.3fs] ", now.Sub(t.start).Seconds())
+	}
+	return res
+}
+
+// maxReconnectInterval caps the time between attempts to reopen the port.
+const maxReconnectInterval = 30 * time.Second
+
+// monitorReader decodes the output from the reader until the reader fails
+// or the context is cancelled.
+func monitorReader(ctx context.Context, logReader io.Reader, envelope string, pretty bool, plain bool, opts monitorOptions) error {
+	scanner := bufio.NewScanner(logReader)
+
+	// Create a context-aware decoder that can be interrupted.
+	decoder := NewDecoder(scanner, ctx, envelope)
+	decoder.timestamps = opts.timestamps
+	decoder.filter = opts.filter
+	decoder.log = opts.log
+	decoder.raw = opts.raw
+	decoder.useLastDeployed = opts.useLastDeployed
+	done := make(chan error, 1)
+	go func() {
+		decoder.decode(pretty, plain)
+		done <- scanner.Err()
+	}()
+
+	// Wait for either completion or context cancellation.
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reopenSerial tries to open the port until it succeeds, the context is
+// cancelled, or the attempts are exhausted. The time between attempts
+// doubles, starting at the given interval.
+func reopenSerial(ctx context.Context, port string, mode *serial.Mode, interval time.Duration, attempts int) (*serialPort, error) {
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		dev, err := serialOpen(port, mode)
+		if err == nil {
+			return dev, nil
+		}
+		if attempts > 0 && attempt >= attempts {
+			return nil, fmt.Errorf("failed to reopen port '%s' after %d attempts: %w", port, attempts, err)
+		}
+		interval *= 2
+		if interval > maxReconnectInterval {
+			interval = maxReconnectInterval
+		}
+	}
+}
+
 func serialOpen(port string, mode *serial.Mode) (*serialPort, error) {
 	dev, err := serial.Open(port, mode)
 	if os.IsNotExist(err) {
@@ -0,0 +1,120 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	notifyErrors = "errors"
+	notifyAll    = "all"
+
+	// The notification commands return quickly, except on Windows, where
+	// the icon must stay around while the notification is shown.
+	notifyTimeout = 15 * time.Second
+)
+
+// desktopNotifier sends desktop notifications about the runs of
+// 'jag watch --notify'.
+type desktopNotifier struct {
+	// Also notify about successful runs.
+	all bool
+	// The command that shows a notification. It gets the title and the
+	// message.
+	command func(ctx context.Context, title string, message string) *exec.Cmd
+
+	// Makes sure a failure to notify is only reported once.
+	failedOnce sync.Once
+}
+
+// newDesktopNotifier returns a notifier for the given '--notify' mode. It
+// returns an error if notifications aren't available on this system.
+func newDesktopNotifier(mode string) (*desktopNotifier, error) {
+	res := &desktopNotifier{all: mode == notifyAll}
+	switch runtime.GOOS {
+	case "darwin":
+		if _, err := exec.LookPath("osascript"); err != nil {
+			return nil, err
+		}
+		res.command = func(ctx context.Context, title string, message string) *exec.Cmd {
+			script := fmt.Sprintf("display notification %s with title %s", appleScriptString(message), appleScriptString(title))
+			return exec.CommandContext(ctx, "osascript", "-e", script)
+		}
+	case "linux":
+		if _, err := exec.LookPath("notify-send"); err != nil {
+			return nil, fmt.Errorf("%w, install 'libnotify' to get notifications", err)
+		}
+		res.command = func(ctx context.Context, title string, message string) *exec.Cmd {
+			return exec.CommandContext(ctx, "notify-send", "--app-name=Jaguar", title, message)
+		}
+	case "windows":
+		if _, err := exec.LookPath("powershell"); err != nil {
+			return nil, err
+		}
+		res.command = func(ctx context.Context, title string, message string) *exec.Cmd {
+			script := "Add-Type -AssemblyName System.Windows.Forms;" +
+				"$n = New-Object System.Windows.Forms.NotifyIcon;" +
+				"$n.Icon = [System.Drawing.SystemIcons]::Information;" +
+				"$n.Visible = $true;" +
+				fmt.Sprintf("$n.ShowBalloonTip(5000, %s, %s, 'None');", powerShellString(title), powerShellString(message)) +
+				"Start-Sleep -Seconds 5;" +
+				"$n.Dispose()"
+			return exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+		}
+	default:
+		return nil, fmt.Errorf("not supported on %s", runtime.GOOS)
+	}
+	return res, nil
+}
+
+// notify shows a notification for the end of a run. It doesn't wait for the
+// notification to be shown. Failures are reported once through warnf.
+func (n *desktopNotifier) notify(event WatchEvent, warnf func(format string, a ...interface{})) {
+	if n == nil || event.Type != WatchEventRunEnd || event.Exit == nil {
+		return
+	}
+	failed := *event.Exit != 0
+	if !failed && !n.all {
+		return
+	}
+	target := fmt.Sprintf("'%s'", event.Entrypoint)
+	if event.Device != "" {
+		target += fmt.Sprintf(" on '%s'", event.Device)
+	}
+	title := "Jaguar: run finished"
+	message := target + " finished successfully"
+	if failed {
+		title = "Jaguar: run failed"
+		// Compile errors span many lines. The first one says what is wrong.
+		message = target + ": " + strings.SplitN(event.Error, "\n", 2)[0]
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if err := n.command(ctx, title, message).Run(); err != nil {
+			n.failedOnce.Do(func() {
+				warnf("Warning: failed to show a desktop notification: %v\n", err)
+			})
+		}
+	}()
+}
+
+// appleScriptString quotes s as an AppleScript string literal.
+func appleScriptString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// powerShellString quotes s as a single-quoted PowerShell string literal.
+func powerShellString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -5,15 +5,24 @@
 package commands
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 func PingCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:          "ping",
-		Short:        "Ping a Jaguar device to see if it is active",
+		Use:   "ping",
+		Short: "Ping a Jaguar device to see if it is active",
+		Long: "Ping a Jaguar device to see if it is active.\n" +
+			"The pings use the same HTTP endpoint as the other commands, so they\n" +
+			"test the connection that is used when running programs.\n" +
+			"With '--count' several pings are sent, and the round-trip times and the\n" +
+			"loss are reported. The command fails if the loss exceeds '--fail-over'.",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			deviceSelect, err := parseDeviceFlag(cmd)
@@ -21,7 +30,38 @@ func PingCmd() *cobra.Command {
 				return err
 			}
 
+			timeout, err := cmd.Flags().GetDuration("timeout")
+			if err != nil {
+				return err
+			}
+			count, err := cmd.Flags().GetInt("count")
+			if err != nil {
+				return err
+			}
+			if count < 1 {
+				return fmt.Errorf("--count must be at least 1, got %d", count)
+			}
+			interval, err := cmd.Flags().GetDuration("interval")
+			if err != nil {
+				return err
+			}
+			failOver, err := cmd.Flags().GetFloat64("fail-over")
+			if err != nil {
+				return err
+			}
+			if failOver < 0 || failOver > 100 {
+				return fmt.Errorf("--fail-over must be a percentage between 0 and 100, got %v", failOver)
+			}
+			jsonOutput, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return err
+			}
+
 			ctx := cmd.Context()
+			if jsonOutput {
+				// Keep stdout for the JSON.
+				ctx = withOutput(ctx, os.Stderr)
+			}
 			sdk, err := GetSDK(ctx)
 			if err != nil {
 				return err
@@ -31,17 +71,145 @@ func PingCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			if !device.Ping(ctx, sdk) {
-				cmd.SilenceUsage = true
-				return fmt.Errorf("couldn't ping the device")
+
+			if count == 1 && !jsonOutput {
+				if !pingOnce(ctx, sdk, device, timeout, nil) {
+					return fmt.Errorf("couldn't ping the device")
+				}
+				fmt.Println("Got pong from the device")
+				return nil
+			}
+
+			var stats pingStats
+			for i := 0; i < count; i++ {
+				if i > 0 {
+					select {
+					case <-time.After(interval):
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+				var rtt time.Duration
+				ok := pingOnce(ctx, sdk, device, timeout, &rtt)
+				stats.add(ok, rtt)
+				if jsonOutput {
+					continue
+				}
+				if ok {
+					fmt.Printf("Pong from '%s': seq=%d time=%s\n", device.Name(), i+1, rtt.Round(time.Millisecond/10))
+				} else {
+					fmt.Printf("No pong from '%s': seq=%d\n", device.Name(), i+1)
+				}
 			}
 
-			fmt.Println("Got pong from the device")
+			if jsonOutput {
+				if err := stats.printJson(device); err != nil {
+					return err
+				}
+			} else {
+				stats.print(device)
+			}
+			if stats.loss() > failOver {
+				return fmt.Errorf("loss of %.1f%% exceeds %.1f%%", stats.loss(), failOver)
+			}
 			return nil
 		},
 	}
 
 	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
 	cmd.Flags().DurationP("timeout", "t", pingTimeout, "how long to wait for a reply")
+	cmd.Flags().IntP("count", "c", 1, "number of pings to send")
+	cmd.Flags().DurationP("interval", "i", time.Second, "time to wait between pings")
+	cmd.Flags().Float64("fail-over", 0, "fail if the loss in percent exceeds this")
+	cmd.Flags().Bool("json", false, "print the statistics as JSON")
 	return cmd
 }
+
+// pingOnce pings the device and stores the round-trip time in rtt, if given.
+func pingOnce(ctx context.Context, sdk *SDK, device Device, timeout time.Duration, rtt *time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	ok := device.Ping(ctx, sdk)
+	if rtt != nil {
+		*rtt = time.Since(start)
+	}
+	return ok
+}
+
+type pingStats struct {
+	sent     int
+	received int
+	min      time.Duration
+	max      time.Duration
+	total    time.Duration
+}
+
+func (s *pingStats) add(ok bool, rtt time.Duration) {
+	s.sent++
+	if !ok {
+		return
+	}
+	if s.received == 0 || rtt < s.min {
+		s.min = rtt
+	}
+	if rtt > s.max {
+		s.max = rtt
+	}
+	s.received++
+	s.total += rtt
+}
+
+func (s *pingStats) avg() time.Duration {
+	if s.received == 0 {
+		return 0
+	}
+	return s.total / time.Duration(s.received)
+}
+
+// loss returns the percentage of pings that didn't get a reply.
+func (s *pingStats) loss() float64 {
+	return float64(s.sent-s.received) * 100 / float64(s.sent)
+}
+
+func (s *pingStats) print(device Device) {
+	fmt.Println()
+	fmt.Printf("%d pings sent to '%s', %d pongs received, %.1f%% loss\n", s.sent, device.Name(), s.received, s.loss())
+	if s.received > 0 {
+		round := time.Millisecond / 10
+		fmt.Printf("rtt min/avg/max = %s/%s/%s\n", s.min.Round(round), s.avg().Round(round), s.max.Round(round))
+	}
+}
+
+// pingJson is the output of 'jag ping --json'. Round-trip times are null if
+// no pong was received.
+type pingJson struct {
+	Device   string   `json:"device"`
+	Sent     int      `json:"sent"`
+	Received int      `json:"received"`
+	Loss     float64  `json:"loss_percent"`
+	MinMs    *float64 `json:"min_ms"`
+	AvgMs    *float64 `json:"avg_ms"`
+	MaxMs    *float64 `json:"max_ms"`
+}
+
+func (s *pingStats) printJson(device Device) error {
+	res := pingJson{
+		Device:   device.Name(),
+		Sent:     s.sent,
+		Received: s.received,
+		Loss:     s.loss(),
+	}
+	if s.received > 0 {
+		ms := func(d time.Duration) *float64 {
+			v := float64(d) / float64(time.Millisecond)
+			return &v
+		}
+		res.MinMs = ms(s.min)
+		res.AvgMs = ms(s.avg())
+		res.MaxMs = ms(s.max)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(res)
+}
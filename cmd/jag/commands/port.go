@@ -5,6 +5,7 @@
 package commands
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -57,6 +58,7 @@ func PortCmd() *cobra.Command {
 	}
 
 	cmd.AddCommand(PortSetCmd())
+	cmd.AddCommand(PortListCmd())
 	cmd.Flags().BoolP("list", "l", false, "if set, list the ports")
 	cmd.Flags().StringP("output", "o", "short", "set output format to json, yaml or short (works only with '--list')")
 	cmd.Flags().Bool("all", false, "if set, will show all available ports")
@@ -94,6 +96,144 @@ func PortSetCmd() *cobra.Command {
 	return cmd
 }
 
+func PortListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the serial ports with their USB details",
+		Long: "List the serial ports with their USB vendor and product IDs, serial\n" +
+			"numbers and descriptions, where the operating system provides them.\n" +
+			"Ports with the USB IDs of Espressif chips, or of the USB to UART bridges\n" +
+			"that are common on ESP32 boards, are marked as likely ESP32 devices.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			all, err := cmd.Flags().GetBool("all")
+			if err != nil {
+				return err
+			}
+			jsonOutput, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return err
+			}
+
+			ports, err := getPortDetails(all)
+			if err != nil {
+				return err
+			}
+
+			if jsonOutput {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(ports)
+			}
+			if len(ports) == 0 {
+				fmt.Println("No serial ports found")
+				return nil
+			}
+			for _, p := range ports {
+				marker := "  "
+				if p.Configured {
+					marker = "* "
+				}
+				ids := "-"
+				if p.USB {
+					ids = p.VID + ":" + p.PID
+				}
+				var details []string
+				if p.Product != "" {
+					details = append(details, p.Product)
+				}
+				if p.SerialNumber != "" {
+					details = append(details, "serial "+p.SerialNumber)
+				}
+				if p.Hint != "" {
+					details = append(details, p.Hint)
+				}
+				fmt.Printf("%s%-24s %-9s %s\n", marker, p.Name, ids, strings.Join(details, ", "))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().Bool("all", false, "if set, will show all available ports")
+	cmd.Flags().Bool("json", false, "print the ports as a JSON array")
+	return cmd
+}
+
+// portDetails is an element of the 'jag port list --json' output.
+type portDetails struct {
+	Name         string `json:"name"`
+	USB          bool   `json:"usb"`
+	VID          string `json:"vid,omitempty"`
+	PID          string `json:"pid,omitempty"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	Product      string `json:"product,omitempty"`
+	// Set if the USB IDs belong to an Espressif chip or to a USB to UART
+	// bridge that is common on ESP32 boards.
+	ESP32 bool   `json:"esp32"`
+	Hint  string `json:"hint,omitempty"`
+	// Set for the port selected with 'jag port set'.
+	Configured bool `json:"configured"`
+}
+
+// esp32USBIDs maps the USB vendor IDs, or vendor and product IDs, of the
+// chips found on ESP32 boards to a description.
+var esp32USBIDs = map[string]string{
+	"303A":      "Espressif USB",
+	"10C4:EA60": "CP210x USB to UART bridge",
+	"1A86:7523": "CH340 USB to UART bridge",
+	"1A86:55D3": "CH343 USB to UART bridge",
+	"1A86:55D4": "CH9102 USB to UART bridge",
+	"0403:6001": "FTDI USB to UART bridge",
+	"0403:6010": "FTDI USB to UART bridge",
+	"0403:6015": "FTDI USB to UART bridge",
+}
+
+func getPortDetails(all bool) ([]portDetails, error) {
+	configured := ConfiguredPort()
+	res := []portDetails{}
+	detailed, err := detailedPorts()
+	if err != nil {
+		// Not every OS provides the details. The names are better than
+		// nothing.
+		ports, err := getPorts(all)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range ports.Ports {
+			res = append(res, portDetails{Name: string(p), Configured: string(p) == configured})
+		}
+		return res, nil
+	}
+
+	var names []string
+	for _, d := range detailed {
+		names = append(names, d.Name)
+	}
+	if !all {
+		names = filterPorts(names)
+	}
+	shown := map[string]struct{}{}
+	for _, name := range names {
+		shown[name] = struct{}{}
+	}
+	for _, p := range detailed {
+		if _, ok := shown[p.Name]; !ok {
+			continue
+		}
+		p.Configured = p.Name == configured
+		if p.USB {
+			hint, ok := esp32USBIDs[p.VID+":"+p.PID]
+			if !ok {
+				hint, ok = esp32USBIDs[p.VID]
+			}
+			p.ESP32 = ok
+			p.Hint = hint
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
 func PortExists(port string) (bool, error) {
 	// If 'port' is a symlink, resolve it to the actual path.
 	stat, err := os.Lstat(port)
@@ -148,6 +288,50 @@ func CheckPort(port string) (string, error) {
 	return GetPort(cfg, false, true)
 }
 
+// checkMonitorPort is like CheckPort, but never prompts for a port, since the
+// output of the monitor is often redirected.
+// An explicitly given port must exist. Otherwise the configured port is used
+// if it exists, or the only connected port. If there are several, they are
+// listed in the error.
+func checkMonitorPort(port string, explicit bool) (string, error) {
+	if port != "" {
+		exists, err := PortExists(port)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return port, nil
+		}
+	}
+
+	ports, err := getPorts(false)
+	if err != nil {
+		return "", err
+	}
+	if explicit {
+		return "", fmt.Errorf("the port '%s' was not found%s", port, portCandidates(ports))
+	}
+	switch ports.Len() {
+	case 0:
+		return "", fmt.Errorf("no serial ports detected. Have you installed the driver for the ESP32 you have connected?")
+	case 1:
+		return string(ports.Ports[0]), nil
+	default:
+		return "", fmt.Errorf("found several serial ports, use '--port' to pick one%s", portCandidates(ports))
+	}
+}
+
+func portCandidates(ports Ports) string {
+	if ports.Len() == 0 {
+		return ""
+	}
+	res := "\nAvailable ports:"
+	for _, p := range ports.Ports {
+		res += "\n  " + string(p)
+	}
+	return res
+}
+
 func pickPort(all bool) (string, error) {
 	ports, err := getPorts(all)
 	if err != nil || ports.Len() == 0 {
@@ -0,0 +1,37 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+//go:build !darwin || cgo
+// +build !darwin cgo
+
+package commands
+
+import (
+	"strings"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// detailedPorts returns all serial ports with their USB details.
+func detailedPorts() ([]portDetails, error) {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil, err
+	}
+	var res []portDetails
+	for _, port := range ports {
+		p := portDetails{
+			Name:         port.Name,
+			USB:          port.IsUSB,
+			SerialNumber: port.SerialNumber,
+			Product:      port.Product,
+		}
+		if port.IsUSB {
+			p.VID = strings.ToUpper(port.VID)
+			p.PID = strings.ToUpper(port.PID)
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
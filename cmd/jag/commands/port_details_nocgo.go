@@ -0,0 +1,16 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+//go:build darwin && !cgo
+// +build darwin,!cgo
+
+package commands
+
+import "fmt"
+
+// detailedPorts returns all serial ports with their USB details. On macOS
+// the details are read through IOKit, which requires cgo.
+func detailedPorts() ([]portDetails, error) {
+	return nil, fmt.Errorf("USB details aren't available without cgo")
+}
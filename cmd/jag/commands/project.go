@@ -0,0 +1,157 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// projectConfigName is the name of the project-local configuration file.
+// It is found by walking up from the directory of the entrypoint.
+const projectConfigName = "jag.yaml"
+
+const ctxKeyProjectConfig ctxKey = "project-config"
+
+type projectConfig struct {
+	// SDKVersion is the version of the Toit SDK the project must be built
+	// with. Empty if the project doesn't pin a version.
+	SDKVersion string `yaml:"sdk-version"`
+
+	// Default values for the flags of 'jag run' and 'jag watch', keyed by
+	// the long flag name. Flags given on the command line take precedence.
+	Run   map[string]interface{} `yaml:"run"`
+	Watch map[string]interface{} `yaml:"watch"`
+
+	// The path of the configuration file.
+	path string
+}
+
+// findProjectConfig returns the configuration of the project that contains
+// the given file or directory, or nil if it isn't in a project.
+func findProjectConfig(start string) (*projectConfig, error) {
+	dir, err := filepath.Abs(start)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := os.Stat(dir); err == nil && !stat.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+	for {
+		path := filepath.Join(dir, projectConfigName)
+		content, err := os.ReadFile(path)
+		if err == nil {
+			res := &projectConfig{path: path}
+			if err := yaml.Unmarshal(content, res); err != nil {
+				return nil, fmt.Errorf("failed to parse '%s': %w", path, err)
+			}
+			return res, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// withProjectConfig finds the project configuration for the entrypoints and
+// stores it in the context, so GetSDK can honor it. All entrypoints must
+// agree on the pinned SDK version and the default flags.
+func withProjectConfig(ctx context.Context, entrypoints ...string) (context.Context, error) {
+	var res *projectConfig
+	for _, entrypoint := range entrypoints {
+		config, err := findProjectConfig(entrypoint)
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			continue
+		}
+		if res != nil && res.SDKVersion != config.SDKVersion {
+			return nil, fmt.Errorf("'%s' pins Toit SDK %s, but '%s' pins %s", res.path, res.SDKVersion, config.path, config.SDKVersion)
+		}
+		if res != nil && (!reflect.DeepEqual(res.Run, config.Run) || !reflect.DeepEqual(res.Watch, config.Watch)) {
+			return nil, fmt.Errorf("'%s' and '%s' set different default flags", res.path, config.path)
+		}
+		res = config
+	}
+	if res == nil {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, ctxKeyProjectConfig, res), nil
+}
+
+func projectConfigFromContext(ctx context.Context) *projectConfig {
+	config, _ := ctx.Value(ctxKeyProjectConfig).(*projectConfig)
+	return config
+}
+
+// checkPinnedVersion returns an error if the project in the context pins a
+// different SDK version.
+func (s *SDK) checkPinnedVersion(ctx context.Context) error {
+	config := projectConfigFromContext(ctx)
+	if config == nil || config.SDKVersion == "" || config.SDKVersion == s.Version {
+		return nil
+	}
+	mismatch := fmt.Sprintf("'%s' pins Toit SDK %s, but the SDK in '%s' is version %s", config.path, config.SDKVersion, s.Path, s.Version)
+	if info := GetInfo(ctx); config.SDKVersion == info.SDKVersion {
+		return fmt.Errorf("%s.\nRun 'jag sdk use default' or 'jag setup' to use it", mismatch)
+	}
+	if installed, err := installedSDKPath(config.SDKVersion); err == nil && installed != "" {
+		return fmt.Errorf("%s.\nRun 'jag sdk use %s' to use it", mismatch, config.SDKVersion)
+	}
+	return fmt.Errorf("%s.\nRun 'jag sdk install %s' and 'jag sdk use %s' to use it", mismatch, config.SDKVersion, config.SDKVersion)
+}
+
+// applyProjectFlags sets the flags of the command that weren't given on the
+// command line to the defaults of the project configuration. Lists set flags
+// that can be repeated.
+func applyProjectFlags(cmd *cobra.Command, config *projectConfig, defaults map[string]interface{}) error {
+	var names []string
+	for name := range defaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil {
+			return fmt.Errorf("'%s': unknown flag '--%s' for 'jag %s'", config.path, name, cmd.Name())
+		}
+		if flag.Changed {
+			continue
+		}
+		var values []interface{}
+		switch value := defaults[name].(type) {
+		case []interface{}:
+			repeatable := strings.HasSuffix(flag.Value.Type(), "Array") || strings.HasSuffix(flag.Value.Type(), "Slice")
+			if !repeatable {
+				return fmt.Errorf("'%s': '--%s' can't be given more than once", config.path, name)
+			}
+			values = value
+		case map[interface{}]interface{}, nil:
+			return fmt.Errorf("'%s': the value of '--%s' must be a string, a number, a boolean, or a list", config.path, name)
+		default:
+			values = []interface{}{value}
+		}
+		for _, value := range values {
+			if err := cmd.Flags().Set(name, fmt.Sprint(value)); err != nil {
+				return fmt.Errorf("'%s': invalid value for '--%s': %w", config.path, name, err)
+			}
+		}
+	}
+	return nil
+}
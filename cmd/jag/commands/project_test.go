@@ -0,0 +1,228 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+)
+
+func TestFindProjectConfig(t *testing.T) {
+	dir := t.TempDir()
+	project := filepath.Join(dir, "project")
+	writeFile(t, filepath.Join(project, projectConfigName), "sdk-version: v2.0.0\n")
+	writeFile(t, filepath.Join(project, "src", "app", "main.toit"), "")
+	// A nested project shadows the outer one.
+	writeFile(t, filepath.Join(project, "nested", projectConfigName), "sdk-version: v3.0.0\n")
+	writeFile(t, filepath.Join(project, "nested", "main.toit"), "")
+	writeFile(t, filepath.Join(dir, "outside", "main.toit"), "")
+
+	tests := []struct {
+		start   string
+		want    string
+		version string
+	}{
+		{"project/src/app/main.toit", "project", "v2.0.0"},
+		{"project/src/app", "project", "v2.0.0"},
+		{"project", "project", "v2.0.0"},
+		{"project/nested/main.toit", "project/nested", "v3.0.0"},
+		// A file that doesn't exist yet is treated like a directory.
+		{"project/new.toit", "project", "v2.0.0"},
+	}
+	for _, test := range tests {
+		config, err := findProjectConfig(filepath.Join(dir, test.start))
+		if err != nil {
+			t.Fatalf("%s: %v", test.start, err)
+		}
+		if config == nil {
+			t.Errorf("%s: no configuration found", test.start)
+			continue
+		}
+		if want := filepath.Join(dir, test.want, projectConfigName); config.path != want {
+			t.Errorf("%s: found '%s', want '%s'", test.start, config.path, want)
+		}
+		if config.SDKVersion != test.version {
+			t.Errorf("%s: got version %s, want %s", test.start, config.SDKVersion, test.version)
+		}
+	}
+
+	// The temporary directory might be in a project, which is fine as
+	// long as it isn't the one of this test.
+	config, err := findProjectConfig(filepath.Join(dir, "outside", "main.toit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil && strings.HasPrefix(config.path, dir) {
+		t.Errorf("found '%s' outside of the project", config.path)
+	}
+
+	writeFile(t, filepath.Join(dir, "bad", projectConfigName), "sdk-version: [\n")
+	if _, err := findProjectConfig(filepath.Join(dir, "bad")); err == nil {
+		t.Errorf("no error for a malformed configuration")
+	}
+}
+
+func TestWithProjectConfig(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a", "main.toit")
+	b := filepath.Join(dir, "b", "main.toit")
+	c := filepath.Join(dir, "c", "main.toit")
+	writeFile(t, filepath.Join(dir, "a", projectConfigName), "sdk-version: v2.0.0\n")
+	writeFile(t, filepath.Join(dir, "b", projectConfigName), "sdk-version: v2.0.0\n")
+	writeFile(t, filepath.Join(dir, "c", projectConfigName), "sdk-version: v3.0.0\n")
+
+	ctx, err := withProjectConfig(context.Background(), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config := projectConfigFromContext(ctx); config == nil || config.SDKVersion != "v2.0.0" {
+		t.Errorf("got %+v, want the pin of v2.0.0", config)
+	}
+	if _, err := withProjectConfig(context.Background(), a, c); err == nil {
+		t.Errorf("no error for entrypoints that pin different versions")
+	}
+}
+
+func TestCheckPinnedVersion(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, projectConfigName)
+	sdk := &SDK{Path: filepath.Join(dir, "sdk"), Version: "v2.0.0"}
+	check := func(pinned string) error {
+		ctx := SetInfo(context.Background(), Info{SDKVersion: "v1.0.0"})
+		if pinned != "" {
+			ctx = context.WithValue(ctx, ctxKeyProjectConfig, &projectConfig{SDKVersion: pinned, path: configPath})
+		}
+		return sdk.checkPinnedVersion(ctx)
+	}
+
+	if err := check(""); err != nil {
+		t.Errorf("got %v without a pinned version", err)
+	}
+	if err := check("v2.0.0"); err != nil {
+		t.Errorf("got %v for the pinned version", err)
+	}
+
+	tests := []struct {
+		pinned string
+		want   string
+	}{
+		// The version Jaguar was built for.
+		{"v1.0.0", "jag sdk use default"},
+		{"v3.0.0", "jag sdk install v3.0.0"},
+	}
+	for _, test := range tests {
+		err := check(test.pinned)
+		if err == nil || !strings.Contains(err.Error(), test.want) || !strings.Contains(err.Error(), configPath) {
+			t.Errorf("%s: got %v, want an error about '%s' that suggests '%s'", test.pinned, err, configPath, test.want)
+		}
+	}
+
+	// An installed version only needs to be selected.
+	sdksPath, err := directory.GetSDKsCachePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, directory.GetToitPath(filepath.Join(sdksPath, "v3.0.0")), "")
+	if err := check("v3.0.0"); err == nil || !strings.Contains(err.Error(), "jag sdk use v3.0.0") {
+		t.Errorf("got %v, want an error that suggests 'jag sdk use v3.0.0'", err)
+	}
+}
+
+// parseWatchCmd returns 'jag watch' with the command line arguments parsed.
+func parseWatchCmd(t *testing.T, args ...string) *cobra.Command {
+	t.Helper()
+	cmd := WatchCmd()
+	if err := cmd.Flags().Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+// loadProjectConfig writes the jag.yaml file and parses it.
+func loadProjectConfig(t *testing.T, content string) *projectConfig {
+	t.Helper()
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, projectConfigName), content)
+	config, err := findProjectConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestApplyProjectFlags(t *testing.T) {
+	config := loadProjectConfig(t, `watch:
+  device: mydevice
+  optimization-level: 2
+  assets:
+    - a.assets
+    - b.assets
+  verbose: true
+  debounce: 50ms
+`)
+	get := func(cmd *cobra.Command) string {
+		devices, _ := cmd.Flags().GetStringArray("device")
+		level, _ := cmd.Flags().GetString("optimization-level")
+		assets, _ := cmd.Flags().GetStringArray("assets")
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		debounce, _ := cmd.Flags().GetDuration("debounce")
+		return fmt.Sprintf("%q %s %q %v %s", devices, level, assets, verbose, debounce)
+	}
+
+	cmd := parseWatchCmd(t)
+	if err := applyProjectFlags(cmd, config, config.Watch); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := get(cmd), `["mydevice"] 2 ["a.assets" "b.assets"] true 50ms`; got != want {
+		t.Errorf("got %s, want the defaults of the project: %s", got, want)
+	}
+
+	// The command line takes precedence, also for lists.
+	cmd = parseWatchCmd(t, "-d", "other", "-O", "0", "--assets", "c.assets", "--verbose=false")
+	if err := applyProjectFlags(cmd, config, config.Watch); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := get(cmd), `["other"] 0 ["c.assets"] false 50ms`; got != want {
+		t.Errorf("got %s, want the command line and the project's debounce: %s", got, want)
+	}
+}
+
+func TestApplyProjectFlagsMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"unknown flag", "watch:\n  no-such-flag: 1\n", "unknown flag '--no-such-flag'"},
+		{"list for a single flag", "watch:\n  debounce: [1s, 2s]\n", "can't be given more than once"},
+		{"map", "watch:\n  device:\n    name: a\n", "must be a string"},
+		{"empty value", "watch:\n  device:\n", "must be a string"},
+		{"invalid value", "watch:\n  debounce: soon\n", "invalid value for '--debounce'"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := loadProjectConfig(t, test.content)
+			err := applyProjectFlags(parseWatchCmd(t), config, config.Watch)
+			if err == nil || !strings.Contains(err.Error(), test.want) || !strings.Contains(err.Error(), config.path) {
+				t.Errorf("got %v, want an error about '%s' containing %q", err, config.path, test.want)
+			}
+		})
+	}
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, projectConfigName), "watch: [device\n")
+	if _, err := findProjectConfig(dir); err == nil {
+		t.Errorf("no error for a malformed '%s'", projectConfigName)
+	}
+}
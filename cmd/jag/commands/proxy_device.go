@@ -27,6 +27,7 @@ const (
 	commandFirmware       = 5
 	commandInstall        = 6
 	commandRun            = 7
+	commandStop           = 8
 
 	responseAck = 255
 
@@ -205,6 +206,13 @@ func (d *uartDevice) Uninstall(containerName string) error {
 	return err
 }
 
+func (d *uartDevice) Stop() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, err := d.sendRequest(commandStop, []byte{})
+	return err
+}
+
 func (d *uartDevice) Firmware(newFirmware []byte) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
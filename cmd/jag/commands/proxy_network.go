@@ -32,6 +32,7 @@ const (
 	headerContainerName     = "X-Jaguar-Container-Name"
 	headerContainerTimeout  = "X-Jaguar-Container-Timeout"
 	headerContainerInterval = "X-Jaguar-Container-Interval"
+	headerRunArguments      = "X-Jaguar-Run-Arguments"
 
 	defineJagDisabled = "jag.disabled"
 	defineJagWifi     = "jag.wifi"
@@ -149,6 +150,29 @@ func runProxyServer(ud *uartDevice, identity *uartIdentity) error {
 		}
 		w.WriteHeader(http.StatusOK)
 	})
+	mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		if !checkValidDeviceId(w, r) || !checkIsPut(w, r) {
+			return
+		}
+		if r.Header.Get(headerContainerName) != "" {
+			// The serial protocol can only stop all programs.
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		err := ud.Stop()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/reboot", func(w http.ResponseWriter, r *http.Request) {
+		if !checkValidDeviceId(w, r) || !checkIsPut(w, r) {
+			return
+		}
+		// The serial protocol has no command to reboot the device.
+		w.WriteHeader(http.StatusNotImplemented)
+	})
 	mux.HandleFunc("/firmware", func(w http.ResponseWriter, r *http.Request) {
 		if !checkValidDeviceId(w, r) || !checkIsPut(w, r) {
 			return
@@ -191,6 +215,11 @@ func runProxyServer(ud *uartDevice, identity *uartIdentity) error {
 		if !checkValidDeviceId(w, r) || !checkSameSDK(w, r) || !checkIsPut(w, r) {
 			return
 		}
+		if r.Header.Get(headerRunArguments) != "" {
+			// The serial protocol can't pass arguments to programs.
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
 		defines := extractDefines(r)
 		image, err := readBody(r.Body, r.ContentLength)
 		if err != nil {
@@ -8,14 +8,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -94,6 +100,10 @@ func RunCmd() *cobra.Command {
 			"If you specify the device to be 'host' with the option '-d host', then the\n" +
 			"program runs on the current computer instead.\n" +
 			"\n" +
+			"If <file> is '-', the program is read from stdin, for example with\n" +
+			"'echo \"main: print 42\" | jag run -'. Imports are resolved relative to the\n" +
+			"current directory.\n" +
+			"\n" +
 			"The following define flags have a special meaning:\n" +
 			"	'-D jag.wifi=false': Disable Jaguar's WiFi-based HTTP server while the program.\n" +
 			"     is running.\n" +
@@ -102,84 +112,639 @@ func RunCmd() *cobra.Command {
 			"     If jag.wifi=false is set, then the default is 10 seconds.\n" +
 			"\n" +
 			"For example 'jag run -D jag.wifi=false wifi-scan.toit' will run the wifi-scan\n" +
-			"program on the device without Jaguar using the network.",
+			"program on the device without Jaguar using the network.\n" +
+			"\n" +
+			"With '--watch' the program is re-run whenever the file or one of its\n" +
+			"dependencies changes, just like 'jag watch'.\n" +
+			"\n" +
+			"The file can also be a precompiled snapshot, for example one produced by\n" +
+			"'jag compile' in CI. Files that are ar archives with 'toit' as their first\n" +
+			"entry are treated as snapshots, regardless of their extension. Snapshots\n" +
+			"are deployed as they are, so they can't be combined with\n" +
+			"'--optimization-level' or '--watch'. Assets are still attached.\n" +
+			"\n" +
+			"Instead of building an assets file, '--assets-from-dir <dir>' bundles the\n" +
+			"files in the directory and its subdirectories. Each asset is named by the\n" +
+			"path of its file relative to the directory, like 'images/logo.png'.\n" +
+			"Hidden files are skipped. With '--watch' changes to the files re-run the\n" +
+			"program.\n" +
+			"\n" +
+			"Defaults for the flags can be given in the 'run' section of a 'jag.yaml'\n" +
+			"file in the directory of <file> or any of its parents, like 'device: lamp'.\n" +
+			"Flags given on the command line take precedence.\n" +
+			"\n" +
+			"Several files, a pattern like 'tests/*.toit', or '--dir <dir>' run the\n" +
+			"files one after the other on the device, and print a summary of which\n" +
+			"ones passed. The command fails if any of them failed. With '--fail-fast'\n" +
+			"the remaining files are skipped after the first failure.\n" +
+			"\n" +
+			"When running on host, a non-zero exit code of the program becomes the exit\n" +
+			"code of jag. Devices respond as soon as the program has started, so runs on\n" +
+			"devices only fail if the program can't be compiled or deployed.\n" +
+			"\n" +
+			"With '--format json' a single JSON object with the device, whether the\n" +
+			"program was compiled and deployed, the exit code, the durations and the\n" +
+			"sizes is printed when the run is done. Failed runs have an 'error' field.\n" +
+			"Everything else is printed to stderr.",
 		Args:         cobra.MinimumNArgs(0),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			ctx := cmd.Context()
-
-			deviceSelect, err := parseDeviceFlag(cmd)
-			if err != nil {
-				return err
-			}
-
-			optimizationLevel := -1
-			if cmd.Flags().Changed("optimization-level") {
-				optimizationLevel, err = cmd.Flags().GetInt("optimization-level")
-				if err != nil {
-					return err
-				}
-			}
-
-			if name, ok := deviceSelect.(deviceNameSelect); ok && string(name) == "host" {
-				if cmd.Flags().Changed("define") {
-					return fmt.Errorf("--define/-D is not yet supported when running on host")
+			// The project configuration supplies defaults for the flags, so
+			// it must be found before any flag is read.
+			projectStart := "."
+			if len(args) > 0 && args[0] != "-" {
+				if _, err := os.Stat(args[0]); err == nil {
+					projectStart = args[0]
 				}
-				return runOnHost(ctx, cmd, args, optimizationLevel)
-			}
-
-			if cmd.Flags().Changed("expression") {
-				return fmt.Errorf("--expression/-s is not yet supported when running on devices")
 			}
-
-			if len(args) == 0 {
-				return fmt.Errorf("no input file provided")
-			} else if len(args) > 1 {
-				return fmt.Errorf("passing arguments is only supported with 'jag run -d host'")
+			if dir, _ := cmd.Flags().GetString("dir"); dir != "" {
+				projectStart = dir
 			}
-
-			programAssetsPath, err := GetProgramAssetsPath(cmd.Flags(), "assets")
+			ctx, err := withProjectConfig(cmd.Context(), projectStart)
 			if err != nil {
 				return err
 			}
-
-			entrypoint := args[0]
-			if stat, err := os.Stat(entrypoint); err != nil {
-				if os.IsNotExist(err) {
-					return fmt.Errorf("no such file or directory: '%s'", entrypoint)
+			cmd.SetContext(ctx)
+			if config := projectConfigFromContext(ctx); config != nil {
+				if err := applyProjectFlags(cmd, config, config.Run); err != nil {
+					return err
 				}
-				return fmt.Errorf("can't stat file '%s', reason: %w", entrypoint, err)
-			} else if stat.IsDir() {
-				return fmt.Errorf("can't run directory: '%s'", entrypoint)
 			}
 
-			sdk, err := GetSDK(ctx)
+			format, err := cmd.Flags().GetString("format")
 			if err != nil {
 				return err
 			}
-
-			device, err := GetDevice(ctx, sdk, true, deviceSelect)
-			if err != nil {
-				return err
+			switch format {
+			case "text":
+				return runCommand(ctx, cmd, args, os.Stdout, nil)
+			case "json":
+			default:
+				return fmt.Errorf("invalid --format '%s', must be 'text' or 'json'", format)
 			}
 
-			defines, err := parseDefineFlags(cmd, "define")
+			// Everything the run prints goes to stderr, so stdout only
+			// holds the JSON object.
+			report := &runReport{}
+			start := time.Now()
+			err = runCommand(withColor(ctx, false), cmd, args, os.Stderr, report)
+			report.finish(err, time.Since(start))
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if encodeErr := encoder.Encode(report); encodeErr != nil {
+				return encodeErr
+			}
 			if err != nil {
-				return err
+				// The error is in the JSON object.
+				cmd.SilenceErrors = true
 			}
-
-			return RunFile(cmd, device, sdk, entrypoint, defines, programAssetsPath, optimizationLevel)
+			return err
 		},
 	}
 
 	cmd.Flags().StringP("expression", "s", "", "evaluate immediate Toit expression")
 	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
 	cmd.Flags().StringArrayP("define", "D", nil, "define settings to control run on device")
-	cmd.Flags().String("assets", "", "attach assets to the program")
-	cmd.Flags().IntP("optimization-level", "O", 1, "optimization level")
+	cmd.Flags().StringArray("assets", nil, "attach assets to the program (can be repeated to merge several assets files)")
+	cmd.Flags().StringArray("assets-from-dir", nil, "attach the files in the directory and its subdirectories as assets, named by their relative paths (can be repeated)")
+	cmd.Flags().Bool("assets-overwrite", false, "let later '--assets' files replace assets of the same name instead of failing")
+	cmd.Flags().StringP("optimization-level", "O", "1", optimizationLevelUsage)
+	cmd.Flags().Bool("watch", false, "watch the file and its dependencies and re-run on changes")
+	cmd.Flags().Duration("wait", 0, "keep looking for the device for this long if it can't be found")
+	cmd.Flags().Bool("dry-run", false, "print what would be compiled and deployed, without doing it")
+	cmd.Flags().String("name", "", "run the program under this name, so it only replaces the program with the same name")
+	cmd.Flags().Int("repeat", 1, "deploy and run the program this many times")
+	cmd.Flags().Bool("repeat-forever", false, "deploy and run the program until interrupted")
+	cmd.Flags().Duration("repeat-delay", 0, "time to wait between repeated runs")
+	cmd.Flags().Int("deploy-retries", defaultDeployRetries, "how often to retry sending the code after a timeout or a broken connection")
+	cmd.Flags().String("dir", "", "run all Toit files in the directory, one after the other")
+	cmd.Flags().StringArray("run-args", nil, "pass an argument to the program (can be repeated)")
+	cmd.Flags().BoolP("quiet", "q", false, "only print the output of the program and errors")
+	cmd.Flags().Bool("fail-fast", false, "stop running several files at the first failure")
+	cmd.Flags().Bool("size", false, "print the size of the compiled program and of the data sent to the device")
+	cmd.Flags().String("format", "text", "output format, 'text' or 'json' for a JSON object with the result of the run")
 	return cmd
 }
 
+// runReport is the output of 'jag run --format json'. Like the 'run-end'
+// events of 'jag watch --json', Exit is 0 for a successful run and non-zero
+// otherwise.
+type runReport struct {
+	Entrypoint string `json:"entrypoint,omitempty"`
+	Device     string `json:"device,omitempty"`
+	// Compiled is set if the program was compiled, or is a snapshot, and
+	// Deployed if it was sent to the device.
+	Compiled   bool   `json:"compiled"`
+	Deployed   bool   `json:"deployed"`
+	Exit       int    `json:"exit"`
+	DurationMs int64  `json:"duration_ms"`
+	CompileMs  *int64 `json:"compile_ms,omitempty"`
+	SendMs     *int64 `json:"send_ms,omitempty"`
+	// The sizes of the compiled program and of the data sent to the
+	// device. Only set for successful runs.
+	SnapshotSize *int64 `json:"snapshot_bytes,omitempty"`
+	SentBytes    *int   `json:"sent_bytes,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// record fills in the outcome of RunFile.
+func (r *runReport) record(result RunResult, err error) {
+	var sendErr *sendError
+	r.Compiled = err == nil || errors.As(err, &sendErr)
+	if err != nil {
+		return
+	}
+	r.Deployed = true
+	if result.CompileDuration > 0 {
+		compileMs := result.CompileDuration.Milliseconds()
+		r.CompileMs = &compileMs
+	}
+	sendMs := result.SendDuration.Milliseconds()
+	r.SendMs = &sendMs
+	r.SnapshotSize = &result.SnapshotSize
+	r.SentBytes = &result.SentBytes
+}
+
+func (r *runReport) finish(err error, duration time.Duration) {
+	r.DurationMs = duration.Milliseconds()
+	if err == nil {
+		return
+	}
+	r.Exit = 1
+	var exitErr *ExitCodeError
+	if errors.As(err, &exitErr) {
+		r.Exit = exitErr.Code
+	}
+	r.Error = err.Error()
+}
+
+// runCommand implements 'jag run' once the project configuration has been
+// applied. Human readable output goes to out. If report is non-nil, it is
+// filled in for '--format json'.
+func runCommand(ctx context.Context, cmd *cobra.Command, args []string, out io.Writer, report *runReport) error {
+	ctx = withOutput(ctx, out)
+	// The defines are parsed with the context of the command.
+	cmd.SetContext(ctx)
+	deviceSelect, err := parseDeviceFlag(cmd)
+	if err != nil {
+		return err
+	}
+
+	ctx, err = parseDeployRetriesFlag(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	ctx, err = parseQuietFlag(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	// '--watch' runs with the context of the command.
+	cmd.SetContext(ctx)
+
+	optimizationLevel, err := parseOptimizationLevelFlag(cmd)
+	if err != nil {
+		return err
+	}
+
+	watch, err := cmd.Flags().GetBool("watch")
+	if err != nil {
+		return err
+	}
+
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	if dryRun && watch {
+		return fmt.Errorf("--dry-run can't be used with --watch")
+	}
+
+	repeat, err := cmd.Flags().GetInt("repeat")
+	if err != nil {
+		return err
+	}
+	if repeat < 1 {
+		return fmt.Errorf("--repeat must be at least 1, got %d", repeat)
+	}
+	repeatForever, err := cmd.Flags().GetBool("repeat-forever")
+	if err != nil {
+		return err
+	}
+	if repeatForever && cmd.Flags().Changed("repeat") {
+		return fmt.Errorf("--repeat and --repeat-forever are exclusive")
+	}
+	if repeatForever {
+		// Zero repeats until interrupted.
+		repeat = 0
+	}
+	repeatDelay, err := cmd.Flags().GetDuration("repeat-delay")
+	if err != nil {
+		return err
+	}
+	if repeatDelay < 0 {
+		return fmt.Errorf("--repeat-delay must not be negative, got %s", repeatDelay)
+	}
+	repeated := repeat != 1
+	if repeated && (watch || dryRun) {
+		return fmt.Errorf("--repeat and --repeat-forever can't be used with --watch or --dry-run")
+	}
+	if report != nil && (watch || dryRun || repeated) {
+		return fmt.Errorf("--format json can't be used with --watch, --dry-run, --repeat or --repeat-forever")
+	}
+
+	name, err := parseProgramNameFlag(cmd)
+	if err != nil {
+		return err
+	}
+
+	runArgs, err := cmd.Flags().GetStringArray("run-args")
+	if err != nil {
+		return err
+	}
+
+	suiteDir, err := cmd.Flags().GetString("dir")
+	if err != nil {
+		return err
+	}
+	failFast, err := cmd.Flags().GetBool("fail-fast")
+	if err != nil {
+		return err
+	}
+
+	if name, ok := deviceSelect.(deviceNameSelect); ok && string(name) == "host" {
+		if dryRun {
+			return fmt.Errorf("--dry-run is not yet supported when running on host")
+		}
+		if watch {
+			return fmt.Errorf("--watch is not yet supported when running on host")
+		}
+		if cmd.Flags().Changed("define") {
+			return fmt.Errorf("--define/-D is not yet supported when running on host")
+		}
+		if repeated {
+			return fmt.Errorf("--repeat is not yet supported when running on host")
+		}
+		if report != nil {
+			return fmt.Errorf("--format json is not yet supported when running on host")
+		}
+		if suiteDir != "" {
+			return fmt.Errorf("--dir is not yet supported when running on host")
+		}
+		return runOnHost(ctx, cmd, append(args, runArgs...), optimizationLevel)
+	}
+
+	if cmd.Flags().Changed("expression") {
+		return fmt.Errorf("--expression/-s is not yet supported when running on devices")
+	}
+
+	// Several files, a glob, or a directory run as a suite.
+	var suite []string
+	if suiteDir != "" || len(args) > 1 || (len(args) == 1 && isGlob(args[0])) {
+		if watch || dryRun || repeated || report != nil {
+			return fmt.Errorf("several files or --dir can't be used with --watch, --dry-run, --repeat or --format json")
+		}
+		suite, err = suiteEntrypoints(suiteDir, args)
+		if err != nil {
+			return err
+		}
+	} else if failFast {
+		return fmt.Errorf("--fail-fast can only be used with several files or --dir")
+	} else if len(args) == 0 {
+		return fmt.Errorf("no input file provided")
+	}
+
+	programAssetsPaths, err := GetProgramAssetsPaths(cmd.Flags(), "assets")
+	if err != nil {
+		return err
+	}
+
+	programAssetsDirs, err := getProgramAssetsDirs(cmd.Flags(), "assets-from-dir")
+	if err != nil {
+		return err
+	}
+
+	assetsOverwrite, err := cmd.Flags().GetBool("assets-overwrite")
+	if err != nil {
+		return err
+	}
+
+	if suite != nil {
+		return runSuite(ctx, cmd, deviceSelect, suite, name, programAssetsPaths, programAssetsDirs, assetsOverwrite, optimizationLevel, runArgs, failFast)
+	}
+
+	entrypoint := args[0]
+	if report != nil {
+		report.Entrypoint = entrypoint
+	}
+	if entrypoint == "-" {
+		if watch {
+			return fmt.Errorf("--watch can't be used when reading the program from stdin")
+		}
+		stdinFile, err := writeStdinProgram()
+		if err != nil {
+			return err
+		}
+		defer os.Remove(stdinFile)
+		entrypoint = stdinFile
+	}
+	if stat, err := os.Stat(entrypoint); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no such file or directory: '%s'", entrypoint)
+		}
+		return fmt.Errorf("can't stat file '%s', reason: %w", entrypoint, err)
+	} else if stat.IsDir() {
+		return fmt.Errorf("can't run directory: '%s'", entrypoint)
+	}
+
+	if IsSnapshot(entrypoint) {
+		if cmd.Flags().Changed("optimization-level") {
+			return fmt.Errorf("--optimization-level can't be used with snapshot '%s', which is already compiled", entrypoint)
+		}
+		if watch {
+			return fmt.Errorf("--watch can't be used with snapshot '%s', which has no source files to watch", entrypoint)
+		}
+	}
+
+	sdk, err := GetSDK(ctx)
+	if err != nil {
+		return err
+	}
+
+	wait, err := cmd.Flags().GetDuration("wait")
+	if err != nil {
+		return err
+	}
+
+	device, err := GetDeviceWaiting(ctx, sdk, true, deviceSelect, wait)
+	if err != nil {
+		return err
+	}
+	if report != nil {
+		report.Device = device.Name()
+	}
+
+	defines, err := parseDefineFlags(cmd, "define")
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		return printRunPlan(ctx, device, sdk, entrypoint, defines, programAssetsPaths, programAssetsDirs, optimizationLevel)
+	}
+
+	if watch {
+		options := watchOptions{
+			debounce:        defaultDebounce,
+			defines:         defines,
+			assetsOverwrite: assetsOverwrite,
+			assetsDirs:      programAssetsDirs,
+			name:            name,
+			quiet:           isQuiet(ctx),
+			color:           useColor(ctx),
+			runArgs:         runArgs,
+		}
+		return watchFiles(cmd, []Device{device}, sdk, []string{entrypoint}, programAssetsPaths, optimizationLevel, options)
+	}
+
+	programAssetsPath, cleanupAssets, err := prepareAssets(ctx, sdk, programAssetsPaths, programAssetsDirs, assetsOverwrite)
+	if err != nil {
+		return err
+	}
+	defer cleanupAssets()
+
+	showSize, err := cmd.Flags().GetBool("size")
+	if err != nil {
+		return err
+	}
+
+	if repeated {
+		return repeatRunFile(ctx, cmd, device, sdk, entrypoint, name, defines, runArgs, programAssetsPath, optimizationLevel, repeat, repeatDelay, showSize)
+	}
+
+	result, err := RunFile(ctx, cmd, device, sdk, entrypoint, name, defines, runArgs, programAssetsPath, optimizationLevel)
+	if report != nil {
+		report.record(result, err)
+	}
+	if err != nil {
+		return err
+	}
+	if showSize {
+		result.printSize(ctx, device)
+	}
+	return nil
+}
+
+// isGlob returns whether the argument is a pattern, like 'tests/*.toit',
+// rather than a file. Shells on Windows don't expand patterns.
+func isGlob(arg string) bool {
+	if _, err := os.Stat(arg); err == nil {
+		return false
+	}
+	return strings.ContainsAny(arg, "*?[")
+}
+
+// suiteEntrypoints returns the sorted files to run for the arguments, which
+// can be patterns, and the Toit files in dir, if it isn't empty.
+func suiteEntrypoints(dir string, args []string) ([]string, error) {
+	seen := map[string]struct{}{}
+	var res []string
+	add := func(path string) {
+		if _, ok := seen[path]; !ok {
+			seen[path] = struct{}{}
+			res = append(res, path)
+		}
+	}
+	if dir != "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("no such directory: '%s'", dir)
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && filepath.Ext(entry.Name()) == ".toit" {
+				add(filepath.Join(dir, entry.Name()))
+			}
+		}
+		if len(res) == 0 {
+			return nil, fmt.Errorf("no Toit files in '%s'", dir)
+		}
+	}
+	for _, arg := range args {
+		if arg == "-" {
+			return nil, fmt.Errorf("the program can't be read from stdin when running several files")
+		}
+		if !isGlob(arg) {
+			if stat, err := os.Stat(arg); err != nil {
+				return nil, fmt.Errorf("no such file or directory: '%s'", arg)
+			} else if stat.IsDir() {
+				return nil, fmt.Errorf("can't run directory: '%s' (use --dir to run the files in it)", arg)
+			}
+			add(arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %w", arg, err)
+		}
+		found := false
+		for _, match := range matches {
+			if stat, err := os.Stat(match); err == nil && !stat.IsDir() {
+				add(match)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no files match '%s'", arg)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// runSuite runs the files one after the other and prints a summary. It
+// returns an error if any of them failed. With failFast the remaining files
+// are skipped after the first failure.
+func runSuite(
+	ctx context.Context,
+	cmd *cobra.Command,
+	deviceSelect deviceSelect,
+	entrypoints []string,
+	name string,
+	assetsPaths []string,
+	assetsDirs []string,
+	assetsOverwrite bool,
+	optimizationLevel int,
+	runArgs []string,
+	failFast bool) error {
+	sdk, err := GetSDK(ctx)
+	if err != nil {
+		return err
+	}
+	wait, err := cmd.Flags().GetDuration("wait")
+	if err != nil {
+		return err
+	}
+	device, err := GetDeviceWaiting(ctx, sdk, true, deviceSelect, wait)
+	if err != nil {
+		return err
+	}
+	defines, err := parseDefineFlags(cmd, "define")
+	if err != nil {
+		return err
+	}
+	assetsPath, cleanupAssets, err := prepareAssets(ctx, sdk, assetsPaths, assetsDirs, assetsOverwrite)
+	if err != nil {
+		return err
+	}
+	defer cleanupAssets()
+
+	// An interrupt ends the suite, so the summary is still printed.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	results := make([]error, len(entrypoints))
+	ran := 0
+	for i, entrypoint := range entrypoints {
+		if ctx.Err() != nil {
+			break
+		}
+		_, err := RunFile(ctx, cmd, device, sdk, entrypoint, name, defines, runArgs, assetsPath, optimizationLevel)
+		if err != nil && ctx.Err() != nil {
+			// Interrupted. The run doesn't count.
+			break
+		}
+		results[i] = err
+		ran++
+		if err != nil && failFast {
+			break
+		}
+	}
+
+	passed, failed := 0, 0
+	fmt.Fprintln(output(ctx))
+	for i, entrypoint := range entrypoints {
+		switch {
+		case i >= ran:
+			fmt.Fprintf(output(ctx), "%s  %s\n", paint(ctx, styleChange, "SKIP"), entrypoint)
+		case results[i] != nil:
+			failed++
+			fmt.Fprintf(output(ctx), "%s  %s: %v\n", paint(ctx, styleError, "FAIL"), entrypoint, results[i])
+		default:
+			passed++
+			fmt.Fprintf(output(ctx), "%s  %s\n", paint(ctx, styleSuccess, "PASS"), entrypoint)
+		}
+	}
+	fmt.Fprintf(output(ctx), "%d of %d files run on '%s': %d passed, %d failed\n", ran, len(entrypoints), device.Name(), passed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, ran)
+	}
+	return nil
+}
+
+// repeatRunFile runs the program the given number of times, or until
+// interrupted if repeat is 0. Failed runs don't stop the repetition. It
+// returns an error if any run failed.
+func repeatRunFile(
+	ctx context.Context,
+	cmd *cobra.Command,
+	device Device,
+	sdk *SDK,
+	path string,
+	name string,
+	defines map[string]interface{},
+	runArgs []string,
+	assetsPath string,
+	optimizationLevel int,
+	repeat int,
+	delay time.Duration,
+	showSize bool) error {
+	// An interrupt ends the repetition, so the summary is still printed.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	passed, failed := 0, 0
+	for i := 0; repeat == 0 || i < repeat; i++ {
+		if i > 0 && delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if repeat == 0 {
+			infof(ctx, "-- run %d --\n", i+1)
+		} else {
+			infof(ctx, "-- run %d of %d --\n", i+1, repeat)
+		}
+		runCtx, cancel := context.WithCancel(ctx)
+		result, err := RunFile(runCtx, cmd, device, sdk, path, name, defines, runArgs, assetsPath, optimizationLevel)
+		cancel()
+		if err == nil && showSize {
+			result.printSize(ctx, device)
+		}
+		if err != nil && ctx.Err() != nil {
+			// Interrupted. The run doesn't count.
+			break
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintf(output(ctx), "Run %d failed: %v\n", i+1, err)
+		} else {
+			passed++
+		}
+	}
+
+	fmt.Fprintf(output(ctx), "%d runs of '%s' on '%s': %d passed, %d failed\n", passed+failed, path, device.Name(), passed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d runs failed", failed, passed+failed)
+	}
+	return nil
+}
+
 func runOnHost(ctx context.Context, cmd *cobra.Command, args []string, optimizationLevel int) error {
 	sdk, err := GetSDK(ctx)
 	if err != nil {
@@ -205,21 +770,79 @@ func runOnHost(ctx context.Context, cmd *cobra.Command, args []string, optimizat
 	}
 
 	runCmd.Stderr = os.Stderr
-	runCmd.Stdout = os.Stdout
+	runCmd.Stdout = output(ctx)
 	runCmd.Stdin = os.Stdin
-	return runCmd.Run()
+	err = runCmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		// The program has printed its own errors.
+		cmd.SilenceErrors = true
+		return &ExitCodeError{exitErr.ExitCode()}
+	}
+	return err
+}
+
+// RunResult is the outcome of running a program. Jaguar devices respond
+// as soon as the program has started, so it doesn't have the exit code of
+// the program.
+type RunResult struct {
+	// SnapshotSize is the size of the compiled program, and SentBytes the
+	// size of the image that was sent to the device, including the assets.
+	// Both are zero if nothing was sent.
+	SnapshotSize int64
+	SentBytes    int
+	// CompileDuration is the time it took to compile the program, zero for
+	// snapshots, and SendDuration the time it took to send it.
+	CompileDuration time.Duration
+	SendDuration    time.Duration
+}
+
+// printSize prints the sizes of the program that was deployed, for
+// '--size'.
+func (r RunResult) printSize(ctx context.Context, device Device) {
+	fmt.Fprintf(output(ctx), "Program size: snapshot %s, sent %s to '%s'\n", formatSize(r.SnapshotSize), formatSize(int64(r.SentBytes)), device.Name())
+}
+
+func formatSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.1fKB", float64(n)/1024)
+}
+
+// ExitCodeError is returned when a program exited with a non-zero exit
+// code. The jag command exits with the same code.
+type ExitCodeError struct {
+	Code int
+}
+
+func (e *ExitCodeError) Error() string {
+	return fmt.Sprintf("program exited with code %d", e.Code)
 }
 
 func RunFile(
+	ctx context.Context,
 	cmd *cobra.Command,
 	device Device,
 	sdk *SDK,
 	path string,
+	name string,
 	defines map[string]interface{},
+	runArgs []string,
 	assetsPath string,
-	optimizationLevel int) error {
-	fmt.Printf("Running '%s' on '%s' ...\n", path, device.Name())
-	return sendCodeFromFile(cmd, device, sdk, "/run", path, "", defines, assetsPath, optimizationLevel)
+	optimizationLevel int) (RunResult, error) {
+	if name != "" {
+		infof(ctx, "Running '%s' as '%s' on '%s' ...\n", path, name, device.Name())
+	} else {
+		infof(ctx, "Running '%s' on '%s' ...\n", path, device.Name())
+	}
+	stats, err := sendCodeFromFile(ctx, cmd, device, sdk, "/run", path, name, defines, runArgs, assetsPath, optimizationLevel)
+	return RunResult{
+		SnapshotSize:    stats.snapshotSize,
+		SentBytes:       stats.sentBytes,
+		CompileDuration: stats.compileTime,
+		SendDuration:    stats.sendTime,
+	}, err
 }
 
 func InstallFile(
@@ -232,10 +855,120 @@ func InstallFile(
 	assetsPath string,
 	optimizationLevel int) error {
 	fmt.Printf("Installing container '%s' from '%s' on '%s' ...\n", name, path, device.Name())
-	return sendCodeFromFile(cmd, device, sdk, "/install", path, name, defines, assetsPath, optimizationLevel)
+	_, err := sendCodeFromFile(cmd.Context(), cmd, device, sdk, "/install", path, name, defines, nil, assetsPath, optimizationLevel)
+	return err
+}
+
+// programNamePattern is the set of names that can be given to programs with
+// '--name'.
+var programNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// parseProgramNameFlag returns the validated '--name' flag, or "" if it
+// wasn't given.
+func parseProgramNameFlag(cmd *cobra.Command) (string, error) {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return "", err
+	}
+	if cmd.Flags().Changed("name") && !programNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid --name '%s': names must start with a letter or digit, consist of letters, digits, '.', '_' and '-', and be at most 64 characters long", name)
+	}
+	return name, nil
+}
+
+// writeStdinProgram writes the program read from stdin to a temporary file
+// and returns its path. The file is created in the current directory, if
+// possible, so relative imports and packages resolve like for a file there.
+// The caller must remove the file.
+func writeStdinProgram() (string, error) {
+	source, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the program from stdin: %w", err)
+	}
+	f, err := os.CreateTemp(".", ".jag-stdin-*.toit")
+	if err != nil {
+		f, err = os.CreateTemp("", "jag-stdin-*.toit")
+		if err != nil {
+			return "", err
+		}
+	}
+	defer f.Close()
+	if _, err := f.Write(source); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// printRunPlan prints what 'jag run' would do for the entrypoint, without
+// compiling or deploying anything.
+func printRunPlan(
+	ctx context.Context,
+	device Device,
+	sdk *SDK,
+	entrypoint string,
+	defines map[string]interface{},
+	assetsPaths []string,
+	assetsDirs []string,
+	optimizationLevel int) error {
+
+	fmt.Fprintln(output(ctx), "Dry run, nothing is compiled or deployed.")
+	fmt.Fprintf(output(ctx), "Entrypoint:         %s\n", entrypoint)
+	fmt.Fprintf(output(ctx), "Device:             %s (%s, %s)\n", device.Name(), device.Address(), device.Chip())
+	fmt.Fprintf(output(ctx), "SDK:                %s (%s)\n", sdk.Version, sdk.Path)
+	if optimizationLevel >= 0 {
+		fmt.Fprintf(output(ctx), "Optimization level: %d\n", optimizationLevel)
+	} else {
+		fmt.Fprintln(output(ctx), "Optimization level: compiler default")
+	}
+	assetsPath := ""
+	switch len(assetsPaths) {
+	case 0:
+		fmt.Fprintln(output(ctx), "Assets:             none")
+	case 1:
+		assetsPath = assetsPaths[0]
+		fmt.Fprintf(output(ctx), "Assets:             %s\n", assetsPath)
+	default:
+		assetsPath = "<merged-assets>"
+		fmt.Fprintf(output(ctx), "Assets:             %s (merged)\n", strings.Join(assetsPaths, ", "))
+	}
+	if len(assetsDirs) > 0 {
+		assetsPath = "<merged-assets>"
+		fmt.Fprintf(output(ctx), "Assets from:        %s\n", strings.Join(assetsDirs, ", "))
+	}
+	if len(defines) > 0 {
+		encoded, err := json.Marshal(defines)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(output(ctx), "Defines:            %s\n", encoded)
+	}
+
+	snapshot := entrypoint
+	if !IsSnapshot(entrypoint) {
+		snapshot = "<snapshot>"
+		fmt.Fprintf(output(ctx), "Compile command:    %s\n", strings.Join(sdk.compileCommand(ctx, snapshot, entrypoint, optimizationLevel).Args, " "))
+	}
+	fmt.Fprintf(output(ctx), "Image command:      %s\n", strings.Join(sdk.buildCommand(ctx, device, snapshot, assetsPath, "<image>").Args, " "))
+
+	if IsSnapshot(entrypoint) {
+		return nil
+	}
+	paths, err := analyzeDependencies(ctx, sdk, entrypoint, nil)
+	sort.Strings(paths)
+	fmt.Fprintln(output(ctx), "Source files:")
+	for _, p := range paths {
+		fmt.Fprintf(output(ctx), "  %s\n", p)
+	}
+	if err != nil {
+		// The plan is still useful if the program doesn't compile.
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	return nil
 }
 
 func sendCodeFromFile(
+	ctx context.Context,
 	cmd *cobra.Command,
 	device Device,
 	sdk *SDK,
@@ -243,16 +976,17 @@ func sendCodeFromFile(
 	path string,
 	name string,
 	defines map[string]interface{},
+	runArgs []string,
 	assetsPath string,
-	optimizationLevel int) error {
+	optimizationLevel int) (deployStats, error) {
 
-	ctx := cmd.Context()
 	snapshotsStateDir, err := directory.GetSnapshotsStatePath()
 	if err != nil {
-		return err
+		return deployStats{}, err
 	}
 
 	var snapshot string = ""
+	var compileTime time.Duration
 
 	if IsSnapshot(path) {
 		snapshot = path
@@ -261,28 +995,30 @@ func sendCodeFromFile(
 		// snapshot first.
 		tempdir, err := os.MkdirTemp("", "jag_run")
 		if err != nil {
-			return err
+			return deployStats{}, err
 		}
 		defer os.RemoveAll(tempdir)
 
 		snapshotFile, err := os.CreateTemp(tempdir, "jag_run_*.snapshot")
 		if err != nil {
-			return err
+			return deployStats{}, err
 		}
 		snapshot = snapshotFile.Name()
+		startCompile := time.Now()
 		err = sdk.Compile(ctx, snapshot, path, optimizationLevel)
+		compileTime = time.Since(startCompile)
 		if err != nil {
 			// We assume the error has been printed.
 			// Mark the command as silent to avoid printing the error twice.
 			cmd.SilenceErrors = true
 			cmd.SilenceUsage = true
-			return err
+			return deployStats{}, err
 		}
 	}
 
 	programId, err := GetUuid(snapshot)
 	if err != nil {
-		return err
+		return deployStats{}, err
 	}
 
 	cacheDestination := filepath.Join(snapshotsStateDir, programId.String()+".snapshot")
@@ -296,31 +1032,31 @@ func sendCodeFromFile(
 	if cacheDestination != snapshot {
 		tempFileInCacheDirectory, err := os.CreateTemp(snapshotsStateDir, "jag_run_*.snapshot")
 		if err != nil {
-			fmt.Printf("Failed to write temporary file in '%s'\n", snapshotsStateDir)
-			return err
+			fmt.Fprintf(output(ctx), "Failed to write temporary file in '%s'\n", snapshotsStateDir)
+			return deployStats{}, err
 		}
 		defer tempFileInCacheDirectory.Close()
 		defer os.Remove(tempFileInCacheDirectory.Name())
 
 		source, err := os.Open(snapshot)
 		if err != nil {
-			fmt.Printf("Failed to read '%s'n", snapshot)
-			return err
+			fmt.Fprintf(output(ctx), "Failed to read '%s'n", snapshot)
+			return deployStats{}, err
 		}
 		defer source.Close()
 		defer tempFileInCacheDirectory.Close()
 
 		_, err = io.Copy(tempFileInCacheDirectory, source)
 		if err != nil {
-			fmt.Printf("Failed to write '%s'n", tempFileInCacheDirectory.Name())
-			return err
+			fmt.Fprintf(output(ctx), "Failed to write '%s'n", tempFileInCacheDirectory.Name())
+			return deployStats{}, err
 		}
 		tempFileInCacheDirectory.Close()
 
 		// Atomic move so no other process can see a half-written snapshot file.
 		err = os.Rename(tempFileInCacheDirectory.Name(), cacheDestination)
 		if err != nil {
-			return err
+			return deployStats{}, err
 		}
 	}
 
@@ -328,12 +1064,19 @@ func sendCodeFromFile(
 	// and the ones we send along as assets.
 	headersMap := make(map[string]string)
 	headersMap[JaguarContainerNameHeader] = name
+	if len(runArgs) > 0 {
+		encoded, err := json.Marshal(runArgs)
+		if err != nil {
+			return deployStats{}, err
+		}
+		headersMap[JaguarRunArgumentsHeader] = string(encoded)
+	}
 	assetsMap := make(map[string]interface{})
 	for key, value := range defines {
 		if strings.HasPrefix(key, "jag.") {
 			if key == "jag.disabled" || key == "jag.wifi" {
 				if key == "jag.disabled" {
-					fmt.Println("Warning: jag.disabled is deprecated, use jag.wifi=false instead")
+					fmt.Fprintln(output(ctx), "Warning: jag.disabled is deprecated, use jag.wifi=false instead")
 				}
 				switch converted := value.(type) {
 				case bool:
@@ -341,7 +1084,7 @@ func sendCodeFromFile(
 						headersMap[JaguarWifiDisabledHeader] = "true"
 					}
 				default:
-					return fmt.Errorf("jag.wifi must be a bool")
+					return deployStats{}, fmt.Errorf("jag.wifi must be a bool")
 				}
 			} else if key == "jag.timeout" {
 				switch converted := value.(type) {
@@ -350,25 +1093,25 @@ func sendCodeFromFile(
 				case string:
 					duration, err := time.ParseDuration(converted)
 					if err != nil {
-						return fmt.Errorf("cannot parse jag.timeout ('%s') as a duration", converted)
+						return deployStats{}, fmt.Errorf("cannot parse jag.timeout ('%s') as a duration", converted)
 					}
 					headersMap[JaguarContainerTimeoutHeader] = fmt.Sprint(int(math.Ceil(duration.Seconds())))
 				default:
-					return fmt.Errorf("jag.timeout must be a string or an int")
+					return deployStats{}, fmt.Errorf("jag.timeout must be a string or an int")
 				}
 			} else if key == "jag.interval" {
 				switch converted := value.(type) {
 				case string:
 					_, err := time.ParseDuration(converted)
 					if err != nil {
-						return fmt.Errorf("cannot parse jag.interval ('%s') as a duration", converted)
+						return deployStats{}, fmt.Errorf("cannot parse jag.interval ('%s') as a duration", converted)
 					}
 					headersMap[JaguarContainerIntervalHeader] = converted
 				default:
-					return fmt.Errorf("cannot parse jag.interval ('%s') as a duration", converted)
+					return deployStats{}, fmt.Errorf("cannot parse jag.interval ('%s') as a duration", converted)
 				}
 			} else {
-				return fmt.Errorf("unsupported Jaguar define: %s", key)
+				return deployStats{}, fmt.Errorf("unsupported Jaguar define: %s", key)
 			}
 		} else {
 			assetsMap[key] = value
@@ -378,7 +1121,7 @@ func sendCodeFromFile(
 	if len(assetsMap) > 0 {
 		temporaryAssetsFile, err := os.CreateTemp("", "jag_run_*.assets")
 		if err != nil {
-			return err
+			return deployStats{}, err
 		}
 		defer temporaryAssetsFile.Close()
 		defer os.Remove(temporaryAssetsFile.Name())
@@ -386,26 +1129,168 @@ func sendCodeFromFile(
 		assetsPath = temporaryAssetsFile.Name()
 	}
 
+	stats := deployStats{compileTime: compileTime}
+	if stat, err := os.Stat(cacheDestination); err == nil {
+		stats.snapshotSize = stat.Size()
+	}
+
 	b, err := sdk.Build(ctx, device, cacheDestination, assetsPath)
 	if err != nil {
 		// We assume the error has been printed.
 		// Mark the command as silent to avoid printing the error twice.
 		cmd.SilenceErrors = true
 		cmd.SilenceUsage = true
-		return err
+		return deployStats{}, err
 	}
 	startSend := time.Now()
-	if err := device.SendCode(ctx, sdk, request, b, headersMap); err != nil {
-		fmt.Println("Error:", err)
+	retries := deployRetries(ctx)
+	for attempt := 0; ; attempt++ {
+		err = device.SendCode(ctx, sdk, request, b, headersMap)
+		if err == nil || attempt >= retries || !isTransientDeployError(ctx, err) {
+			break
+		}
+		infof(ctx, "Sending code to '%s' failed: %v, retrying (%d of %d) ...\n", device.Name(), err, attempt+1, retries)
+		// The connection of the device session might be broken.
+		resetDeviceSession(device)
+		select {
+		case <-time.After(time.Duration(attempt+1) * deployRetryDelay):
+		case <-ctx.Done():
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(output(ctx), paint(ctx, styleError, "Error:"), err)
 		// We just printed the error.
 		// Mark the command as silent to avoid printing the error twice.
 		cmd.SilenceErrors = true
 		cmd.SilenceUsage = true
-		return err
+		return deployStats{}, &sendError{err}
 	}
 	elapsed := time.Since(startSend)
-	fmt.Printf("Success: Sent %dKB code to '%s' in %.2fs\n", len(b)/1024, device.Name(), elapsed.Seconds())
-	return nil
+	infof(ctx, "%s Sent %dKB code to '%s' in %.2fs\n", paint(ctx, styleSuccess, "Success:"), len(b)/1024, device.Name(), elapsed.Seconds())
+	// Remember the snapshot, so 'jag monitor' can use it to decode stack
+	// traces. Failing to do so doesn't make the run fail.
+	if err := os.WriteFile(filepath.Join(snapshotsStateDir, lastDeployedFile), []byte(programId.String()), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record the deployed snapshot: %v\n", err)
+	}
+	stats.sentBytes = len(b)
+	stats.sendTime = elapsed
+	return stats, nil
+}
+
+// deployStats holds the sizes of a program that was sent to a device, and
+// the time it took to compile and send it.
+type deployStats struct {
+	snapshotSize int64
+	sentBytes    int
+	compileTime  time.Duration
+	sendTime     time.Duration
+}
+
+const ctxKeyDeployRetries ctxKey = "deploy-retries"
+
+const (
+	// defaultDeployRetries is how often sending the code is retried after a
+	// transient error, unless '--deploy-retries' is given.
+	defaultDeployRetries = 2
+	// deployRetryDelay is the delay before the first retry. Later retries
+	// wait longer.
+	deployRetryDelay = 500 * time.Millisecond
+)
+
+// parseDeployRetriesFlag returns the context with the '--deploy-retries' of
+// the command.
+func parseDeployRetriesFlag(ctx context.Context, cmd *cobra.Command) (context.Context, error) {
+	retries, err := cmd.Flags().GetInt("deploy-retries")
+	if err != nil {
+		return nil, err
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("--deploy-retries must not be negative, got %d", retries)
+	}
+	return context.WithValue(ctx, ctxKeyDeployRetries, retries), nil
+}
+
+const ctxKeyQuiet ctxKey = "quiet"
+
+// parseQuietFlag returns the context with the '--quiet' of the command.
+func parseQuietFlag(ctx context.Context, cmd *cobra.Command) (context.Context, error) {
+	quiet, err := cmd.Flags().GetBool("quiet")
+	if err != nil {
+		return nil, err
+	}
+	return context.WithValue(ctx, ctxKeyQuiet, quiet), nil
+}
+
+// isQuiet returns whether '--quiet' was given.
+func isQuiet(ctx context.Context) bool {
+	quiet, _ := ctx.Value(ctxKeyQuiet).(bool)
+	return quiet
+}
+
+const ctxKeyOutput ctxKey = "output"
+
+// withOutput returns the context with the writer that the human readable
+// output of a run goes to. With '--format json' it is stderr, so stdout
+// only holds the JSON object.
+func withOutput(ctx context.Context, out io.Writer) context.Context {
+	return context.WithValue(ctx, ctxKeyOutput, out)
+}
+
+// output returns the writer for human readable output, stdout by default.
+func output(ctx context.Context) io.Writer {
+	if out, ok := ctx.Value(ctxKeyOutput).(io.Writer); ok {
+		return out
+	}
+	return os.Stdout
+}
+
+// infof prints a progress message, unless '--quiet' was given. Errors and
+// the output of the program are always printed.
+func infof(ctx context.Context, format string, a ...interface{}) {
+	if !isQuiet(ctx) {
+		fmt.Fprintf(output(ctx), format, a...)
+	}
+}
+
+// deployRetries returns how often sending the code is retried.
+func deployRetries(ctx context.Context) int {
+	if retries, ok := ctx.Value(ctxKeyDeployRetries).(int); ok {
+		return retries
+	}
+	return defaultDeployRetries
+}
+
+// isTransientDeployError returns whether sending the code failed in a way
+// that likely succeeds when tried again, like a timeout or a reset
+// connection. Errors reported by the device, like a wrong SDK version, and
+// failures to connect are permanent.
+func isTransientDeployError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op != "dial"
+}
+
+// sendError is returned when the code was built, but sending it to the
+// device failed.
+type sendError struct {
+	err error
+}
+
+func (e *sendError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sendError) Unwrap() error {
+	return e.err
 }
 
 func buildAssets(ctx context.Context, sdk *SDK, output *os.File, inputPath string, assetsMap map[string]interface{}) error {
@@ -438,6 +1323,6 @@ func runAssetsTool(ctx context.Context, sdk *SDK, assetsPath string, args ...str
 	args = append([]string{"-e", assetsPath}, args...)
 	cmd := sdk.AssetsTool(ctx, args...)
 	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = output(ctx)
 	return cmd.Run()
 }
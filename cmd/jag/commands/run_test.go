@@ -0,0 +1,57 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsTransientDeployError(t *testing.T) {
+	wrap := func(err error) error {
+		return &url.Error{Op: "Put", URL: "http://192.168.1.10:9000/run", Err: err}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"timeout", wrap(timeoutError{}), true},
+		{"EOF", wrap(io.EOF), true},
+		{"unexpected EOF", fmt.Errorf("reading the response: %w", io.ErrUnexpectedEOF), true},
+		{"reset", wrap(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), true},
+		{"broken pipe", wrap(&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}), true},
+		{"aborted", wrap(syscall.ECONNABORTED), true},
+		// The device isn't there, which retrying doesn't fix.
+		{"connection refused", wrap(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), false},
+		{"reported by the device", errors.New("the device runs SDK v2.0.0"), false},
+	}
+	for _, test := range tests {
+		if got := isTransientDeployError(context.Background(), test.err); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// Nothing is retried once the run was cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if isTransientDeployError(ctx, wrap(timeoutError{})) {
+		t.Errorf("a timeout after the cancellation is transient")
+	}
+}
@@ -6,8 +6,12 @@ package commands
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -65,36 +69,63 @@ func ScanCmd() *cobra.Command {
 				return fmt.Errorf("listing and device-selection are exclusive")
 			}
 
+			filter, err := parseDeviceFilter(cmd)
+			if err != nil {
+				return err
+			}
+
+			count, err := cmd.Flags().GetInt("count")
+			if err != nil {
+				return err
+			}
+			if count < 0 {
+				return fmt.Errorf("--count must not be negative, got %d", count)
+			}
+
+			jsonOutput, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return err
+			}
+			if jsonOutput && (outputter != nil || autoSelect != nil) {
+				return fmt.Errorf("--json can't be used with --list or a device selection")
+			}
+
 			cmd.SilenceUsage = true
+			if jsonOutput {
+				scanCtx, cancel := context.WithTimeout(ctx, timeout)
+				scanned, err := scanNetwork(scanCtx, port, filter, count)
+				cancel()
+				if err != nil {
+					return err
+				}
+				return printScanJson(scanned)
+			}
+
 			if outputter != nil {
-				var devices []Device
-				var err error
-				scanCtx, cancel := context.WithTimeout(ctx, scanTimeout)
-				devices, err = ScanNetwork(scanCtx, autoSelect, port)
+				scanCtx, cancel := context.WithTimeout(ctx, timeout)
+				scanned, err := scanNetwork(scanCtx, port, filter, count)
 				cancel()
 				if err != nil {
 					return err
 				}
 
-				return outputter.Encode(Devices{devices})
+				return outputter.Encode(Devices{scannedDevices(scanned)})
 			}
 
-			device, _, err := scanAndPickDevice(ctx, timeout, port, autoSelect, false)
+			device, _, err := scanAndPickDevice(ctx, timeout, port, autoSelect, filter, count, false)
 			if err != nil {
 				return err
 			}
 
-			json := device.ToJson()
 			if autoSelect != nil {
 				outputter = yaml.NewEncoder(os.Stdout)
-				err = outputter.Encode(json)
+				err = outputter.Encode(device.ToJson())
 				if err != nil {
 					return err
 				}
 			}
 
-			cfg.Set("device", json)
-			return cfg.WriteConfig()
+			return storeDevice(cfg, device)
 		},
 	}
 
@@ -102,9 +133,143 @@ func ScanCmd() *cobra.Command {
 	cmd.Flags().StringP("output", "o", "short", "set output format to json, yaml or short (works only with '--list')")
 	cmd.Flags().UintP("port", "p", scanPort, "UDP port to scan for devices on (ignored when an address is given)")
 	cmd.Flags().DurationP("timeout", "t", scanTimeout, "how long to scan")
+	cmd.Flags().Int("count", 0, "stop scanning once this many devices have been found (0 means no limit)")
+	cmd.Flags().Bool("json", false, "print the found devices as a JSON array")
+	cmd.Flags().String("filter", "", "only show devices whose name contains this (case-insensitive)")
+	cmd.Flags().String("address", "", "only show devices with this IP address or in this CIDR range")
 	return cmd
 }
 
+// deviceFilter narrows down the devices found by a scan. A nil filter
+// matches all devices.
+type deviceFilter struct {
+	name    string
+	network *net.IPNet
+}
+
+func parseDeviceFilter(cmd *cobra.Command) (*deviceFilter, error) {
+	name, err := cmd.Flags().GetString("filter")
+	if err != nil {
+		return nil, err
+	}
+	address, err := cmd.Flags().GetString("address")
+	if err != nil {
+		return nil, err
+	}
+	if name == "" && address == "" {
+		return nil, nil
+	}
+
+	res := &deviceFilter{name: strings.ToLower(name)}
+	if address != "" {
+		if strings.Contains(address, "/") {
+			_, network, err := net.ParseCIDR(address)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --address '%s': %w", address, err)
+			}
+			res.network = network
+		} else {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid --address '%s': not an IP address or CIDR range", address)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			res.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+	}
+	return res, nil
+}
+
+func (f *deviceFilter) Match(d Device) bool {
+	if f == nil {
+		return true
+	}
+	if f.name != "" && !strings.Contains(strings.ToLower(d.Name()), f.name) {
+		return false
+	}
+	if f.network != nil {
+		u, err := url.Parse(d.Address())
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(u.Hostname())
+		if ip == nil || !f.network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *deviceFilter) filter(devices []Device) []Device {
+	if f == nil {
+		return devices
+	}
+	var res []Device
+	for _, d := range devices {
+		if f.Match(d) {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+func (f *deviceFilter) String() string {
+	var parts []string
+	if f.name != "" {
+		parts = append(parts, fmt.Sprintf("name '%s'", f.name))
+	}
+	if f.network != nil {
+		parts = append(parts, fmt.Sprintf("address '%s'", f.network))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// scanJsonDevice is an element of the 'jag scan --json' output. Scripts rely
+// on the field names, so they must stay stable.
+type scanJsonDevice struct {
+	Name       string `json:"name"`
+	ID         string `json:"id"`
+	Address    string `json:"address"`
+	Port       int    `json:"port"`
+	Chip       string `json:"chip"`
+	SDKVersion string `json:"sdk_version"`
+	LastSeen   string `json:"last_seen"`
+}
+
+func printScanJson(scanned []scannedDevice) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(scanJsonDevices(scanned))
+}
+
+func scanJsonDevices(scanned []scannedDevice) []scanJsonDevice {
+	// Always return an array, so "no devices" can be told apart from a
+	// failed scan.
+	res := []scanJsonDevice{}
+	for _, s := range scanned {
+		host := s.Address()
+		port := 0
+		if u, err := url.Parse(s.Address()); err == nil && u.Host != "" {
+			host = u.Hostname()
+			port, _ = strconv.Atoi(u.Port())
+		}
+		res = append(res, scanJsonDevice{
+			Name:       s.Name(),
+			ID:         s.ID(),
+			Address:    host,
+			Port:       port,
+			Chip:       s.Chip(),
+			SDKVersion: s.SDKVersion(),
+			LastSeen:   s.lastSeen.UTC().Format(time.RFC3339),
+		})
+	}
+	return res
+}
+
 type deviceSelect interface {
 	Match(d Device) bool
 	Address() string
@@ -164,27 +329,52 @@ func (s deviceAddressSelect) String() string {
 	return fmt.Sprintf("device with address: '%s'", string(s))
 }
 
-func scanAndPickDevice(ctx context.Context, scanTimeout time.Duration, port uint, autoSelect deviceSelect, manualPick bool) (Device, bool, error) {
+func scanAndPickDevice(ctx context.Context, scanTimeout time.Duration, port uint, autoSelect deviceSelect, filter *deviceFilter, count int, manualPick bool) (Device, bool, error) {
 	if autoSelect == nil {
-		fmt.Println("Scanning ...")
+		infof(ctx, "Scanning ...\n")
 	} else {
-		fmt.Println("Scanning for", autoSelect)
+		infof(ctx, "Scanning for %s\n", autoSelect)
 	}
 	var devices []Device
 	var err error
-	if autoSelect != nil && autoSelect.Address() != "" {
+	if hostname, ok := autoSelect.(deviceHostnameSelect); ok {
+		resolved, err := hostname.resolve(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+		identifyCtx, cancel := context.WithTimeout(ctx, identifyTimeout)
+		devices, err = Identify(identifyCtx, resolved)
+		cancel()
+		if err != nil {
+			return nil, false, fmt.Errorf("'%s' resolved to %s, but the device isn't reachable: %w", hostname.Address(), resolved.Address(), err)
+		}
+	} else if autoSelect != nil && autoSelect.Address() != "" {
 		identifyCtx, cancel := context.WithTimeout(ctx, identifyTimeout)
 		devices, err = Identify(identifyCtx, autoSelect)
 		cancel()
 	} else {
 		scanCtx, cancel := context.WithTimeout(ctx, scanTimeout)
-		devices, err = ScanNetwork(scanCtx, autoSelect, port)
+		var scanned []scannedDevice
+		scanned, err = scanNetwork(scanCtx, port, filter, count)
+		devices = scannedDevices(scanned)
 		cancel()
 	}
 	if err != nil {
 		return nil, false, err
 	}
 
+	if filter != nil {
+		devices = filter.filter(devices)
+		if len(devices) == 0 {
+			return nil, false, fmt.Errorf("didn't find any Jaguar devices matching %s", filter)
+		}
+	}
+
+	if autoSelect == nil && count == 1 && len(devices) == 1 {
+		// The user asked for any device, so there is nothing to choose from.
+		return devices[0], false, nil
+	}
+
 	if len(devices) == 0 {
 		return nil, false, fmt.Errorf("didn't find any Jaguar devices.\nPerhaps you need to be on the same wifi as the device.\nYou can also specify the IP address of the device")
 	}
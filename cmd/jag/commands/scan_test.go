@@ -0,0 +1,76 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// parseTestDeviceFilter parses the '--filter' and '--address' flags of
+// 'jag scan' from the arguments.
+func parseTestDeviceFilter(t *testing.T, args ...string) (*deviceFilter, error) {
+	t.Helper()
+	cmd := &cobra.Command{}
+	cmd.Flags().String("filter", "", "")
+	cmd.Flags().String("address", "", "")
+	if err := cmd.Flags().Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return parseDeviceFilter(cmd)
+}
+
+func TestDeviceFilter(t *testing.T) {
+	kitchen := &DeviceNetwork{DeviceBase: DeviceBase{name: "Kitchen-Sensor", address: "http://192.168.1.10:9000"}}
+	garage := &DeviceNetwork{DeviceBase: DeviceBase{name: "garage", address: "http://10.0.0.5:9000"}}
+	v6 := &DeviceNetwork{DeviceBase: DeviceBase{name: "sensor-v6", address: "http://[fd00::5]:9000"}}
+	devices := []Device{kitchen, garage, v6}
+
+	tests := []struct {
+		args []string
+		want []Device
+	}{
+		{nil, devices},
+		// Names match case insensitively, anywhere in the name.
+		{[]string{"--filter", "SENSOR"}, []Device{kitchen, v6}},
+		{[]string{"--address", "192.168.1.0/24"}, []Device{kitchen}},
+		{[]string{"--address", "10.0.0.5"}, []Device{garage}},
+		{[]string{"--address", "10.0.0.6"}, nil},
+		{[]string{"--address", "fd00::/64"}, []Device{v6}},
+		{[]string{"--filter", "sensor", "--address", "192.168.0.0/16"}, []Device{kitchen}},
+	}
+	for _, test := range tests {
+		filter, err := parseTestDeviceFilter(t, test.args...)
+		if err != nil {
+			t.Fatalf("%q: %v", test.args, err)
+		}
+		got := filter.filter(devices)
+		if len(got) != len(test.want) {
+			t.Errorf("%q: got %v, want %v", test.args, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%q: got %v, want %v", test.args, got, test.want)
+				break
+			}
+		}
+	}
+
+	filter, err := parseTestDeviceFilter(t, "--filter", "Sensor", "--address", "10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := filter.String(), "name 'sensor' and address '10.0.0.0/8'"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, address := range []string{"10.0.0.300", "10.0.0.0/33", "kitchen"} {
+		if _, err := parseTestDeviceFilter(t, "--address", address); err == nil {
+			t.Errorf("no error for the address '%s'", address)
+		}
+	}
+}
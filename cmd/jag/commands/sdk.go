@@ -0,0 +1,307 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+)
+
+// SDKVersionCfgKey is the key in the user configuration that holds the SDK
+// version selected with 'jag sdk use'. If it isn't set, the SDK installed by
+// 'jag setup' is used.
+const SDKVersionCfgKey = "sdk.version"
+
+func SDKCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sdk",
+		Short: "Manage the installed Toit SDKs",
+		Long: "Manage the installed Toit SDKs.\n" +
+			"By default Jaguar uses the SDK installed by 'jag setup', which is the\n" +
+			"version Jaguar was built with. Other versions can be installed with\n" +
+			"'jag sdk install' and selected with 'jag sdk use'.\n" +
+			"Programs built with a different SDK can only run on devices whose\n" +
+			"firmware uses the same SDK.\n" +
+			"Without a subcommand, print the SDK that is used.",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sdks, err := installedSDKs(cmd)
+			if err != nil {
+				return err
+			}
+			for _, sdk := range sdks {
+				if sdk.Active {
+					fmt.Printf("Using Toit SDK %s in '%s'\n", sdk.Version, sdk.Path)
+					return nil
+				}
+			}
+			path, _, err := activeSDKPath(cmd.Context())
+			if err != nil {
+				return err
+			}
+			if version := sdkVersionAt(cmd, path); version != "" {
+				// An SDK given with '--sdk' isn't in the list.
+				fmt.Printf("Using Toit SDK %s in '%s'\n", version, path)
+				return nil
+			}
+			return fmt.Errorf("no Toit SDK is installed.\nRun 'jag setup' to install one")
+		},
+	}
+
+	cmd.AddCommand(SDKListCmd())
+	cmd.AddCommand(SDKUseCmd())
+	cmd.AddCommand(SDKInstallCmd())
+	return cmd
+}
+
+// installedSDK is an element of the 'jag sdk list --json' output.
+type installedSDK struct {
+	Version string `json:"version"`
+	Path    string `json:"path"`
+	// Default is set for the SDK installed by 'jag setup'.
+	Default bool `json:"default"`
+	Active  bool `json:"active"`
+}
+
+func SDKListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "list",
+		Short:        "List the installed Toit SDKs",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			jsonOutput, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return err
+			}
+
+			sdks, err := installedSDKs(cmd)
+			if err != nil {
+				return err
+			}
+
+			if jsonOutput {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(sdks)
+			}
+
+			if len(sdks) == 0 {
+				fmt.Println("No Toit SDKs are installed. Run 'jag setup' to install one")
+				return nil
+			}
+			for _, sdk := range sdks {
+				marker := "  "
+				if sdk.Active {
+					marker = "* "
+				}
+				suffix := ""
+				if sdk.Default {
+					suffix = " (default)"
+				}
+				fmt.Printf("%s%s%s  %s\n", marker, sdk.Version, suffix, sdk.Path)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("json", false, "print the SDKs as a JSON array")
+	return cmd
+}
+
+func SDKUseCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "use <version>",
+		Short: "Select the Toit SDK to use",
+		Long: "Select the Toit SDK to use.\n" +
+			"Use 'default' to go back to the SDK installed by 'jag setup'.",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := directory.GetUserConfig()
+			if err != nil {
+				return err
+			}
+
+			version := args[0]
+			if version == "default" || version == GetInfo(cmd.Context()).SDKVersion {
+				cfg, err = unsetConfigKey(cfg, SDKVersionCfgKey)
+				if err != nil {
+					return err
+				}
+				if err := directory.WriteConfig(cfg); err != nil {
+					return err
+				}
+				fmt.Println("Using the default Toit SDK", GetInfo(cmd.Context()).SDKVersion)
+				return nil
+			}
+
+			path, err := installedSDKPath(version)
+			if err != nil {
+				return err
+			}
+			if path == "" {
+				return fmt.Errorf("Toit SDK %s isn't installed.\nRun 'jag sdk install %s' to install it", version, version)
+			}
+			cfg.Set(SDKVersionCfgKey, version)
+			if err := directory.WriteConfig(cfg); err != nil {
+				return err
+			}
+			fmt.Printf("Using Toit SDK %s in '%s'\n", version, path)
+			return nil
+		},
+	}
+	return cmd
+}
+
+func SDKInstallCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "install <version>",
+		Short:        "Install another version of the Toit SDK",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			version := args[0]
+			if !strings.HasPrefix(version, "v") {
+				return fmt.Errorf("invalid SDK version '%s', versions start with 'v', like 'v2.0.0'", version)
+			}
+			sdksPath, err := directory.GetSDKsCachePath()
+			if err != nil {
+				return err
+			}
+			if err := downloadSdkTo(cmd.Context(), version, filepath.Join(sdksPath, version)); err != nil {
+				return err
+			}
+			fmt.Printf("Run 'jag sdk use %s' to use it\n", version)
+			return nil
+		},
+	}
+	return cmd
+}
+
+// installedSDKPath returns the path of the SDK with the given version that
+// was installed with 'jag sdk install', or "" if it isn't installed.
+func installedSDKPath(version string) (string, error) {
+	sdksPath, err := directory.GetSDKsCachePath()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(sdksPath, version)
+	if _, err := os.Stat(directory.GetToitPath(path)); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return path, nil
+}
+
+// sdkPathOverride returns the SDK path given with '--sdk', or "" if none was
+// given. The path is validated, since it is often mistyped.
+func sdkPathOverride(ctx context.Context) (string, error) {
+	path, _ := ctx.Value(ctxKeySDKPath).(string)
+	if path == "" {
+		return "", nil
+	}
+	toitPath := directory.GetToitPath(path)
+	if stat, err := os.Stat(toitPath); err == nil && !stat.IsDir() {
+		return path, nil
+	}
+	if stat, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("invalid --%s '%s': %w", sdkFlagName, path, err)
+	} else if !stat.IsDir() || filepath.Base(path) == "bin" {
+		return "", fmt.Errorf("invalid --%s '%s': it must be the SDK directory, which contains '%s'", sdkFlagName, path, filepath.Join("bin", directory.Executable("toit")))
+	}
+	return "", fmt.Errorf("invalid --%s '%s': it doesn't hold a Toit SDK, missing '%s'", sdkFlagName, path, toitPath)
+}
+
+// activeSDKPath returns the path of the SDK to use, and whether it was given
+// with '--sdk' or selected with 'jag sdk use'.
+func activeSDKPath(ctx context.Context) (string, bool, error) {
+	if path, err := sdkPathOverride(ctx); err != nil || path != "" {
+		return path, path != "", err
+	}
+	if _, ok := directory.GetRepoPath(); ok {
+		path, err := directory.GetSDKPath()
+		return path, false, err
+	}
+	cfg, err := directory.GetUserConfig()
+	if err != nil {
+		return "", false, err
+	}
+	if version := cfg.GetString(SDKVersionCfgKey); version != "" {
+		path, err := installedSDKPath(version)
+		if err != nil {
+			return "", false, err
+		}
+		if path == "" {
+			return "", false, fmt.Errorf("the selected Toit SDK %s isn't installed.\nRun 'jag sdk install %s', or 'jag sdk use default' to use the default SDK", version, version)
+		}
+		return path, true, nil
+	}
+	path, err := directory.GetSDKPath()
+	return path, false, err
+}
+
+func installedSDKs(cmd *cobra.Command) ([]installedSDK, error) {
+	activePath, _, _ := activeSDKPath(cmd.Context())
+	res := []installedSDK{}
+
+	defaultPath, err := directory.GetSDKCachePath()
+	if err != nil {
+		return nil, err
+	}
+	if version := sdkVersionAt(cmd, defaultPath); version != "" {
+		res = append(res, installedSDK{
+			Version: version,
+			Path:    defaultPath,
+			Default: true,
+			Active:  defaultPath == activePath,
+		})
+	}
+
+	sdksPath, err := directory.GetSDKsCachePath()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(sdksPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var others []installedSDK
+	for _, entry := range entries {
+		path := filepath.Join(sdksPath, entry.Name())
+		if !entry.IsDir() || sdkVersionAt(cmd, path) == "" {
+			continue
+		}
+		others = append(others, installedSDK{
+			Version: entry.Name(),
+			Path:    path,
+			Active:  path == activePath,
+		})
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].Version < others[j].Version })
+	return append(res, others...), nil
+}
+
+// sdkVersionAt returns the version of the SDK in the given directory, or ""
+// if it doesn't hold a working SDK.
+func sdkVersionAt(cmd *cobra.Command, path string) string {
+	output, err := exec.CommandContext(cmd.Context(), directory.GetToitPath(path), "version").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+)
+
+func TestSDKUseDefault(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		// A setting that must be kept.
+		keep string
+	}{
+		{"selected version", "sdk:\n  version: v2.0.0\n  other: kept\n", "sdk.other"},
+		{"no selection", "wifi:\n  ssid: Home\n", "wifi.ssid"},
+		// Hand-edited configurations.
+		{"string", "sdk: v2.0.0\n", "sdk"},
+		{"list", "sdk:\n  - v2.0.0\n", "sdk"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			writeFile(t, path, test.content)
+			t.Setenv(directory.UserConfigPathEnv, path)
+
+			cmd := SDKUseCmd()
+			cmd.SetContext(SetInfo(context.Background(), Info{SDKVersion: "v1.0.0"}))
+			cmd.SetArgs([]string{"default"})
+			if err := cmd.Execute(); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := directory.GetUserConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.IsSet(SDKVersionCfgKey) {
+				t.Errorf("'%s' is still set to %q", SDKVersionCfgKey, cfg.GetString(SDKVersionCfgKey))
+			}
+			if !cfg.IsSet(test.keep) {
+				t.Errorf("'%s' was lost", test.keep)
+			}
+		})
+	}
+}
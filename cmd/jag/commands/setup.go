@@ -9,11 +9,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
 
+	"github.com/libp2p/go-reuseport"
 	"github.com/spf13/cobra"
 	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"go.bug.st/serial"
 )
 
 func getToitSDKURL(version string) (string, error) {
@@ -94,16 +98,7 @@ func SetupCmd(info Info) *cobra.Command {
 			}
 
 			if check {
-				if _, err := GetSDK(ctx); err != nil {
-					return err
-				}
-
-				if _, err := directory.GetJaguarSnapshotPath(); err != nil {
-					return err
-				}
-
-				fmt.Println("Jaguar setup is valid.")
-				return nil
+				return setupCheck(ctx)
 			}
 
 			sdkPath, err := directory.GetSDKCachePath()
@@ -142,7 +137,7 @@ func SetupCmd(info Info) *cobra.Command {
 		},
 	}
 	cmd.AddCommand(SetupSdkCmd(info))
-	cmd.Flags().BoolP("check", "c", false, "if set, will check the local setup")
+	cmd.Flags().BoolP("check", "c", false, "if set, will check the local setup and report each check as pass or fail")
 	cmd.Flags().BoolP("skip-assets", "s", false, "if set, will skip the assets download")
 	cmd.Flags().MarkHidden("skip-assets")
 	cmd.Flags().String("print-path", "", "if set to assets|sdk, will print the assets|sdk path")
@@ -150,6 +145,84 @@ func SetupCmd(info Info) *cobra.Command {
 	return cmd
 }
 
+// setupCheck runs all checks of 'jag setup --check', even if some of them
+// fail, so users see all problems at once.
+func setupCheck(ctx context.Context) error {
+	failed := 0
+	total := 0
+	report := func(name string, detail string, err error) {
+		total++
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+		} else {
+			fmt.Printf("PASS  %s: %s\n", name, detail)
+		}
+	}
+
+	sdk, err := GetSDK(ctx)
+	if sdk != nil {
+		report("Toit SDK", fmt.Sprintf("%s in '%s'", sdk.Version, sdk.Path), err)
+	} else {
+		report("Toit SDK", "", err)
+	}
+
+	if sdk != nil {
+		// The compiler and the analyzer are both part of the 'toit' binary.
+		for _, tool := range []string{"compile", "analyze"} {
+			help := exec.CommandContext(ctx, sdk.ToitPath(), tool, "--help")
+			if output, err := help.CombinedOutput(); err != nil {
+				report("toit "+tool, "", fmt.Errorf("'%s %s' isn't runnable: %w\n%s", sdk.ToitPath(), tool, err, strings.TrimSpace(string(output))))
+			} else {
+				report("toit "+tool, fmt.Sprintf("'%s' (%s)", sdk.ToitPath(), sdk.Version), nil)
+			}
+		}
+	}
+
+	if assetsPath, err := directory.GetAssetsPath(); err != nil {
+		report("Jaguar assets", "", err)
+	} else if snapshot, err := directory.GetJaguarSnapshotPath(); err != nil {
+		report("Jaguar assets", "", err)
+	} else {
+		report("Jaguar assets", fmt.Sprintf("'%s' in '%s'", filepath.Base(snapshot), assetsPath), nil)
+	}
+
+	if cfg, err := directory.GetDeviceConfig(); err != nil {
+		report("Device configuration", "", err)
+	} else {
+		report("Device configuration", fmt.Sprintf("'%s'", cfg.ConfigFileUsed()), nil)
+	}
+
+	// 'jag scan' listens for the broadcasts of the devices on this port.
+	if pc, err := reuseport.ListenPacket("udp4", fmt.Sprintf(":%d", scanPort)); err != nil {
+		report(fmt.Sprintf("UDP port %d", scanPort), "", fmt.Errorf("can't listen for devices: %w", err))
+	} else {
+		pc.Close()
+		report(fmt.Sprintf("UDP port %d", scanPort), "can listen for devices", nil)
+	}
+
+	if port := ConfiguredPort(); port != "" {
+		if exists, err := PortExists(port); err != nil {
+			report(fmt.Sprintf("Serial port '%s'", port), "", err)
+		} else if !exists {
+			report(fmt.Sprintf("Serial port '%s'", port), "", fmt.Errorf("not connected"))
+		} else if dev, err := serialOpen(port, &serial.Mode{BaudRate: 115200}); err != nil {
+			report(fmt.Sprintf("Serial port '%s'", port), "", fmt.Errorf("can't be opened: %w", err))
+		} else {
+			dev.Close()
+			report(fmt.Sprintf("Serial port '%s'", port), "accessible", nil)
+		}
+	} else {
+		fmt.Println("SKIP  Serial port: no port set with 'jag port set'")
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, total)
+	}
+	fmt.Println("Jaguar setup is valid.")
+	return nil
+}
+
 func SetupSdkCmd(info Info) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:          "sdk",
@@ -36,7 +36,7 @@ type SDK struct {
 }
 
 func GetSDK(ctx context.Context) (*SDK, error) {
-	sdkPath, err := directory.GetSDKPath()
+	sdkPath, selected, err := activeSDKPath(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -62,7 +62,13 @@ func GetSDK(ctx context.Context) (*SDK, error) {
 	if !directory.IsReleaseBuild {
 		_, skipVersionCheck = os.LookupEnv(directory.ToitRepoPathEnv)
 	}
+	// An SDK given with '--sdk' or selected with 'jag sdk use' deliberately
+	// differs from the one Jaguar was built with.
+	skipVersionCheck = skipVersionCheck || selected
 	err = res.validate(info, skipVersionCheck)
+	if err == nil {
+		err = res.checkPinnedVersion(ctx)
+	}
 	return res, err
 }
 
@@ -75,15 +81,22 @@ func GetProgramAssetsPath(flags *pflag.FlagSet, flagName string) (string, error)
 	if err != nil {
 		return "", err
 	}
+	if err := checkAssetsPath(assetsPath); err != nil {
+		return "", err
+	}
+	return assetsPath, nil
+}
+
+func checkAssetsPath(assetsPath string) error {
 	if stat, err := os.Stat(assetsPath); err != nil {
 		if os.IsNotExist(err) {
-			return "", fmt.Errorf("no such file or directory: '%s'", assetsPath)
+			return fmt.Errorf("no such file or directory: '%s'", assetsPath)
 		}
-		return "", fmt.Errorf("can't stat file '%s', reason: %w", assetsPath, err)
+		return fmt.Errorf("can't stat file '%s', reason: %w", assetsPath, err)
 	} else if stat.IsDir() {
-		return "", fmt.Errorf("can't use directory as assets: '%s'", assetsPath)
+		return fmt.Errorf("can't use directory as assets: '%s' (use --assets-from-dir to bundle its files)", assetsPath)
 	}
-	return assetsPath, nil
+	return nil
 }
 
 func (s *SDK) ToitPath() string {
@@ -182,15 +195,19 @@ func (s *SDK) Stacktrace(ctx context.Context, args ...string) *exec.Cmd {
 	return exec.CommandContext(ctx, s.ToitPath(), append([]string{"tool", "esp", "stacktrace"}, args...)...)
 }
 
-func (s *SDK) Compile(ctx context.Context, snapshot string, entrypoint string, optimizationLevel int) error {
-	var buildSnap *exec.Cmd
+// compileCommand returns the command that compiles the entrypoint to a
+// snapshot.
+func (s *SDK) compileCommand(ctx context.Context, snapshot string, entrypoint string, optimizationLevel int) *exec.Cmd {
 	if optimizationLevel >= 0 {
-		buildSnap = s.ToitCompile(ctx, "--snapshot", "-o", snapshot, "-O"+strconv.Itoa(optimizationLevel), entrypoint)
-	} else {
-		buildSnap = s.ToitCompile(ctx, "--snapshot", "-o", snapshot, entrypoint)
+		return s.ToitCompile(ctx, "--snapshot", "-o", snapshot, "-O"+strconv.Itoa(optimizationLevel), entrypoint)
 	}
+	return s.ToitCompile(ctx, "--snapshot", "-o", snapshot, entrypoint)
+}
+
+func (s *SDK) Compile(ctx context.Context, snapshot string, entrypoint string, optimizationLevel int) error {
+	buildSnap := s.compileCommand(ctx, snapshot, entrypoint, optimizationLevel)
 	buildSnap.Stderr = os.Stderr
-	buildSnap.Stdout = os.Stdout
+	buildSnap.Stdout = output(ctx)
 	if err := buildSnap.Run(); err != nil {
 		return err
 	}
@@ -205,6 +222,19 @@ func (s *SDK) Build(ctx context.Context, device Device, snapshotPath string, ass
 	image.Close()
 	defer os.Remove(image.Name())
 
+	buildImage := s.buildCommand(ctx, device, snapshotPath, assetsPath, image.Name())
+	buildImage.Stderr = os.Stderr
+	buildImage.Stdout = output(ctx)
+	if err := buildImage.Run(); err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(image.Name())
+}
+
+// buildCommand returns the command that turns the snapshot into an image
+// for the device.
+func (s *SDK) buildCommand(ctx context.Context, device Device, snapshotPath string, assetsPath string, imagePath string) *exec.Cmd {
 	bits := "-m32"
 	if device.WordSize() == 8 {
 		bits = "-m64"
@@ -212,20 +242,13 @@ func (s *SDK) Build(ctx context.Context, device Device, snapshotPath string, ass
 
 	arguments := []string{
 		"--format=binary", bits,
-		"--output", image.Name(),
+		"--output", imagePath,
 		snapshotPath,
 	}
 	if assetsPath != "" {
 		arguments = append(arguments, "--assets", assetsPath)
 	}
-	buildImage := s.SnapshotToImage(ctx, arguments...)
-	buildImage.Stderr = os.Stderr
-	buildImage.Stdout = os.Stdout
-	if err := buildImage.Run(); err != nil {
-		return nil, err
-	}
-
-	return os.ReadFile(image.Name())
+	return s.SnapshotToImage(ctx, arguments...)
 }
 
 func (s *SDK) PassThrough(ctx context.Context, args []string) *exec.Cmd {
@@ -325,6 +348,87 @@ type encoder interface {
 	Encode(interface{}) error
 }
 
+// parseEnvFlags parses repeated KEY=VALUE flags. Unlike defines, the values
+// are always strings.
+func parseEnvFlags(cmd *cobra.Command, flagName string) (map[string]interface{}, error) {
+	if !cmd.Flags().Changed(flagName) {
+		return nil, nil
+	}
+
+	envFlags, err := cmd.Flags().GetStringArray(flagName)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]interface{})
+	for _, element := range envFlags {
+		indexOfAssign := strings.Index(element, "=")
+		if indexOfAssign < 0 {
+			return nil, fmt.Errorf("--%s '%s' must be of the form KEY=VALUE", flagName, element)
+		}
+		key := element[0:indexOfAssign]
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("--%s '%s' has an invalid key", flagName, element)
+		}
+		if strings.HasPrefix(key, "jag.") {
+			return nil, fmt.Errorf("--%s '%s' can't set Jaguar defines, use -D instead", flagName, element)
+		}
+		res[key] = element[indexOfAssign+1:]
+	}
+	return res, nil
+}
+
+// The optimization levels supported by the Toit compiler, with names for
+// the most common ones.
+const (
+	minOptimizationLevel = 0
+	maxOptimizationLevel = 2
+)
+
+var optimizationLevelNames = map[string]int{
+	"none":  0,
+	"size":  1,
+	"speed": 2,
+}
+
+const optimizationLevelUsage = "optimization level: 0-2, or one of none, size, speed"
+
+// parseOptimizationLevelFlag returns the '--optimization-level' given on the
+// command line, or -1 if the flag wasn't given and the compiler should use
+// its default.
+func parseOptimizationLevelFlag(cmd *cobra.Command) (int, error) {
+	if !cmd.Flags().Changed("optimization-level") {
+		return -1, nil
+	}
+	value, err := cmd.Flags().GetString("optimization-level")
+	if err != nil {
+		return -1, err
+	}
+	return parseOptimizationLevel(value)
+}
+
+// parseOptimizationLevel parses an optimization level given as a number or
+// as one of the names.
+func parseOptimizationLevel(value string) (int, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if level, ok := optimizationLevelNames[value]; ok {
+		return level, nil
+	}
+	level, err := strconv.Atoi(value)
+	if err != nil || level < minOptimizationLevel || level > maxOptimizationLevel {
+		return -1, fmt.Errorf("invalid optimization level '%s', valid options are 0, 1, 2, none, size and speed", value)
+	}
+	return level, nil
+}
+
+// optimizationLevelName describes the optimization level for messages.
+func optimizationLevelName(level int) string {
+	if level < 0 {
+		return "the compiler default"
+	}
+	return strconv.Itoa(level)
+}
+
 func parseDefineFlags(cmd *cobra.Command, flagName string) (map[string]interface{}, error) {
 	if !cmd.Flags().Changed(flagName) {
 		return nil, nil
@@ -358,18 +462,19 @@ func parseDefineFlags(cmd *cobra.Command, flagName string) (map[string]interface
 			}
 		}
 		if key == "jag.disabled" {
-			fmt.Println("Warning: Using '-D jag.disabled' is deprecated. Use '-D jag.wifi=false' instead.")
+			fmt.Fprintln(output(cmd.Context()), "Warning: Using '-D jag.disabled' is deprecated. Use '-D jag.wifi=false' instead.")
 			key = "jag.wifi"
 			value = false
 		}
 		definesMap[key] = value
 		if key == "run.boot" {
-			fmt.Println()
-			fmt.Println("*********************************************")
-			fmt.Println("* Using 'jag run -D run.boot' is deprecated *")
-			fmt.Println("* .. use 'jag container install' instead .. *")
-			fmt.Println("*********************************************")
-			fmt.Println()
+			out := output(cmd.Context())
+			fmt.Fprintln(out)
+			fmt.Fprintln(out, "*********************************************")
+			fmt.Fprintln(out, "* Using 'jag run -D run.boot' is deprecated *")
+			fmt.Fprintln(out, "* .. use 'jag container install' instead .. *")
+			fmt.Fprintln(out, "*********************************************")
+			fmt.Fprintln(out)
 		}
 	}
 	if len(definesMap) == 0 {
@@ -420,6 +525,23 @@ func parseDeviceFlag(cmd *cobra.Command) (deviceSelect, error) {
 	return parseDeviceSelection(d), nil
 }
 
+// parseDevicesFlag parses a '--device' flag that can be given multiple times.
+func parseDevicesFlag(cmd *cobra.Command) ([]deviceSelect, error) {
+	if !cmd.Flags().Changed("device") {
+		return nil, nil
+	}
+
+	ds, err := cmd.Flags().GetStringArray("device")
+	if err != nil {
+		return nil, err
+	}
+	var res []deviceSelect
+	for _, d := range ds {
+		res = append(res, parseDeviceSelection(d))
+	}
+	return res, nil
+}
+
 func parseDeviceSelection(d string) deviceSelect {
 	if _, err := uuid.Parse(d); err == nil {
 		return deviceIDSelect(d)
@@ -437,6 +559,13 @@ func parseDeviceSelection(d string) deviceSelect {
 	if ip := net.ParseIP(d); ip != nil {
 		return deviceAddressSelect(d)
 	}
+	host := d
+	if colonIdx > 0 {
+		host = d[:colonIdx]
+	}
+	if isMDNSHostname(host) {
+		return deviceHostnameSelect(d)
+	}
 	return deviceNameSelect(d)
 }
 
@@ -494,16 +623,22 @@ func getWifiCredentials(cmd *cobra.Command) (string, string, error) {
 			return "", "", err
 		}
 	}
+	if wifiSSID == "" {
+		return "", "", fmt.Errorf("the WiFi network name (SSID) must not be empty")
+	}
 
+	// The password in the environment or the configuration belongs to the
+	// network configured there, not to one given with --wifi-ssid.
+	ssidFromFlag := cmd.Flags().Changed("wifi-ssid")
 	var wifiPassword string
 	if cmd.Flags().Changed("wifi-password") {
 		wifiPassword, err = cmd.Flags().GetString("wifi-password")
 		if err != nil {
 			return "", "", err
 		}
-	} else if v, ok := os.LookupEnv(directory.WifiPasswordEnv); ok {
+	} else if v, ok := os.LookupEnv(directory.WifiPasswordEnv); ok && !ssidFromFlag {
 		wifiPassword = v
-	} else if cfg.IsSet(WifiCfgKey + "." + WifiPasswordCfgKey) {
+	} else if cfg.IsSet(WifiCfgKey+"."+WifiPasswordCfgKey) && !ssidFromFlag {
 		wifiPassword = cfg.GetString(WifiCfgKey + "." + WifiPasswordCfgKey)
 	} else {
 		fmt.Printf("Enter WiFi password for '%s': ", wifiSSID)
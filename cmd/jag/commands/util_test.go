@@ -0,0 +1,181 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"golang.org/x/term"
+)
+
+func TestParseOptimizationLevel(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"0", 0},
+		{"1", 1},
+		{"2", 2},
+		{"none", 0},
+		{"size", 1},
+		{"speed", 2},
+		{" Speed ", 2},
+		{"NONE", 0},
+	}
+	for _, test := range tests {
+		got, err := parseOptimizationLevel(test.value)
+		if err != nil || got != test.want {
+			t.Errorf("parseOptimizationLevel(%q) = %d, %v, want %d", test.value, got, err, test.want)
+		}
+	}
+	for _, value := range []string{"", "-1", "3", "fast", "1.5"} {
+		if got, err := parseOptimizationLevel(value); err == nil {
+			t.Errorf("parseOptimizationLevel(%q) = %d, want an error", value, got)
+		}
+	}
+}
+
+func TestParseOptimizationLevelFlag(t *testing.T) {
+	newCmd := func(args ...string) *cobra.Command {
+		cmd := &cobra.Command{}
+		cmd.Flags().StringP("optimization-level", "O", "1", optimizationLevelUsage)
+		if err := cmd.Flags().Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return cmd
+	}
+	// Without the flag the compiler default is used, not the default of
+	// the flag.
+	if got, err := parseOptimizationLevelFlag(newCmd()); err != nil || got != -1 {
+		t.Errorf("got %d, %v without the flag, want -1", got, err)
+	}
+	if got, err := parseOptimizationLevelFlag(newCmd("-O", "speed")); err != nil || got != 2 {
+		t.Errorf("got %d, %v for '-O speed', want 2", got, err)
+	}
+	if _, err := parseOptimizationLevelFlag(newCmd("-O", "9")); err == nil {
+		t.Errorf("no error for '-O 9'")
+	}
+}
+
+func TestParseDevicesFlag(t *testing.T) {
+	newCmd := func(args ...string) *cobra.Command {
+		cmd := &cobra.Command{}
+		cmd.Flags().StringArrayP("device", "d", nil, "")
+		if err := cmd.Flags().Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return cmd
+	}
+	if got, err := parseDevicesFlag(newCmd()); err != nil || got != nil {
+		t.Errorf("got %v, %v without the flag, want nil", got, err)
+	}
+
+	got, err := parseDevicesFlag(newCmd(
+		"-d", "kitchen",
+		"-d", "a1b2c3d4-0000-4000-8000-000000000000",
+		"-d", "http://192.168.1.2:9000",
+		"-d", "192.168.1.3",
+		"-d", "192.168.1.4:9000",
+		"-d", "::1",
+		"-d", "jag.local",
+		"-d", "jag.local:9000",
+		"-d", "name:with-colon",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []deviceSelect{
+		deviceNameSelect("kitchen"),
+		deviceIDSelect("a1b2c3d4-0000-4000-8000-000000000000"),
+		deviceAddressSelect("http://192.168.1.2:9000"),
+		deviceAddressSelect("192.168.1.3"),
+		deviceAddressSelect("192.168.1.4:9000"),
+		deviceAddressSelect("::1"),
+		deviceHostnameSelect("jag.local"),
+		deviceHostnameSelect("jag.local:9000"),
+		deviceNameSelect("name:with-colon"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
+
+func TestGetWifiCredentials(t *testing.T) {
+	if term.IsTerminal(int(syscall.Stdin)) {
+		t.Skip("the password prompt would read from the terminal")
+	}
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, configPath, "wifi:\n  ssid: Home\n  password: home-secret\n")
+	t.Setenv(directory.UserConfigPathEnv, configPath)
+	for _, env := range []string{directory.WifiSSIDEnv, directory.WifiPasswordEnv} {
+		// Restored by Setenv after the test.
+		t.Setenv(env, "")
+		os.Unsetenv(env)
+	}
+	newCmd := func(args ...string) *cobra.Command {
+		cmd := &cobra.Command{}
+		addFirmwareFlashFlags(cmd, "esp32", "")
+		if err := cmd.Flags().Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return cmd
+	}
+	// Answers the password prompt.
+	typePassword := func(password string) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.WriteString(password + "\n"); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		stdin := os.Stdin
+		os.Stdin = r
+		t.Cleanup(func() {
+			os.Stdin = stdin
+			r.Close()
+		})
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      string
+		typed    string
+		ssid     string
+		password string
+	}{
+		{"configured", nil, "", "", "Home", "home-secret"},
+		{"environment", nil, "env-secret", "", "Home", "env-secret"},
+		{"flags", []string{"--wifi-ssid", "Guest", "--wifi-password", "guest-secret"}, "env-secret", "", "Guest", "guest-secret"},
+		{"open network", []string{"--wifi-ssid", "Guest", "--wifi-password", ""}, "", "", "Guest", ""},
+		// The stored password is for another network, so it is asked for.
+		{"only the network", []string{"--wifi-ssid", "Guest"}, "env-secret", "typed-secret", "Guest", "typed-secret"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.env != "" {
+				t.Setenv(directory.WifiPasswordEnv, test.env)
+			}
+			if test.typed != "" {
+				typePassword(test.typed)
+			}
+			ssid, password, err := getWifiCredentials(newCmd(test.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ssid != test.ssid || password != test.password {
+				t.Errorf("got %q and %q, want %q and %q", ssid, password, test.ssid, test.password)
+			}
+		})
+	}
+}
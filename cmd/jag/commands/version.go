@@ -5,41 +5,83 @@
 package commands
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 
 	"github.com/spf13/cobra"
 )
 
+// versionInfo is the output of 'jag version --json'.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	// The SDK Jaguar was built with, and the one it uses. SDKVersion is
+	// empty if no SDK is installed.
+	BuildSDKVersion string `json:"build_sdk_version"`
+	SDKVersion      string `json:"sdk_version,omitempty"`
+	SDKPath         string `json:"sdk_path,omitempty"`
+	// Set if the SDK is installed, but can't be used.
+	SDKError string `json:"sdk_error,omitempty"`
+}
+
 func VersionCmd(info Info, isReleaseBuild bool) *cobra.Command {
 	cmd := &cobra.Command{
-		Use:          "version",
-		Short:        "Prints the version of Jaguar",
+		Use:   "version",
+		Short: "Prints the version of Jaguar",
+		Long: "Print the version of Jaguar, the commit it was built from, and the\n" +
+			"version of the Toit SDK it uses. No device is needed.",
 		Args:         cobra.NoArgs,
 		SilenceUsage: true,
-		Run: func(cmd *cobra.Command, args []string) {
-			version := "---"
-			sdkVersion := "unknown"
-			buildDate := info.Date
+		RunE: func(cmd *cobra.Command, args []string) error {
+			jsonOutput, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return err
+			}
 
+			res := versionInfo{
+				Version:         "---",
+				Commit:          info.Commit,
+				BuildDate:       info.Date,
+				BuildSDKVersion: info.SDKVersion,
+			}
 			if isReleaseBuild {
-				version = info.Version
-				sdkVersion = info.SDKVersion
-			} else {
-				ctx := cmd.Context()
-				sdk, err := GetSDK(ctx)
+				res.Version = info.Version
+			}
+			// A missing SDK is reported, not an error, so the command
+			// works on broken setups.
+			sdk, err := GetSDK(cmd.Context())
+			if sdk != nil && sdk.Version != "" {
+				res.SDKVersion = sdk.Version
+				res.SDKPath = sdk.Path
 				if err != nil {
-					fmt.Println("Error:", err)
-					return
-				}
-				if sdk == nil || sdk.Version != "" {
-					sdkVersion = sdk.Version
+					res.SDKError = err.Error()
 				}
 			}
 
-			fmt.Println("Version:\t", version)
-			fmt.Println("SDK version:\t", sdkVersion)
-			fmt.Println("Build date:\t", buildDate)
+			if jsonOutput {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(res)
+			}
+
+			fmt.Println("Version:\t", res.Version)
+			fmt.Println("Commit:\t\t", res.Commit)
+			fmt.Println("Build date:\t", res.BuildDate)
+			if res.SDKVersion == "" {
+				fmt.Println("SDK version:\t not installed")
+			} else {
+				fmt.Println("SDK version:\t", res.SDKVersion)
+				fmt.Println("SDK path:\t", res.SDKPath)
+			}
+			if res.SDKError != "" {
+				fmt.Fprintf(os.Stderr, "Warning: %s\n", res.SDKError)
+			}
+			return nil
 		},
 	}
+
+	cmd.Flags().Bool("json", false, "print the versions as JSON")
 	return cmd
 }
@@ -5,256 +5,2933 @@
 package commands
 
 import (
-	"bufio"
-	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cobra"
+	"github.com/toitlang/jaguar/cmd/jag/directory"
+	"go.bug.st/serial"
+	"golang.org/x/term"
 )
 
 func WatchCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:          "watch <file>",
-		Short:        "Watch for changes to <file> and its dependencies and automatically re-run the code",
-		Args:         cobra.ExactArgs(1),
+		Use:   "watch <file> [<file>...]",
+		Short: "Watch for changes to <file> and its dependencies and automatically re-run the code",
+		Long: "Watch for changes to <file> and its dependencies and automatically re-run the code.\n" +
+			"When more than one file is given, a change only re-runs the files that depend on it.\n" +
+			"\n" +
+			"Changes to files matching a pattern in a '.jagignore' file (using the gitignore\n" +
+			"syntax) in the directory of <file> or any of its parents are ignored, even if\n" +
+			"<file> depends on them. Use '--no-ignore' to disable the '.jagignore' files.\n" +
+			"\n" +
+			"Changes are coalesced for the '--debounce' duration. With the default\n" +
+			"'--debounce-mode trailing', every change restarts the wait, so a burst of\n" +
+			"saves leads to a single run once the files have settled, but saving\n" +
+			"continuously delays the run. With '--debounce-mode global' the run starts\n" +
+			"one debounce after the first change of a burst, no matter which files\n" +
+			"change afterwards. Runs start sooner, but a burst that lasts longer than\n" +
+			"the debounce leads to more than one run.\n" +
+			"\n" +
+			"The '--on-change' command runs before every run, and the '--after-run'\n" +
+			"command after every run on a device, whether it succeeded or not, for\n" +
+			"example to tear down test fixtures. Both are killed when a newer change\n" +
+			"starts a new run. The '--after-run' command gets the exit status of the\n" +
+			"run (0 or 1), the entrypoint and the device in JAG_RUN_EXIT,\n" +
+			"JAG_ENTRYPOINT and JAG_DEVICE.\n" +
+			"\n" +
+			"With '--restart-device' the device is rebooted before every run, for\n" +
+			"programs that leave the hardware in a bad state. Each run then waits for\n" +
+			"the device to boot and reconnect, which takes a few seconds.\n" +
+			"\n" +
+			"Values given with '--env KEY=VALUE' are passed to every run in the\n" +
+			"'jag.defines' asset, like the '-D' defines of 'jag run'. The arguments\n" +
+			"given with '--run-args' are passed to the main function of every run.\n" +
+			"Devices with an older firmware ignore them.\n" +
+			"\n" +
+			"Defaults for the flags can be given in the 'watch' section of a 'jag.yaml'\n" +
+			"file in the directory of <file> or any of its parents. Flags given on the\n" +
+			"command line take precedence. Changes to the 'optimization-level' in it\n" +
+			"are picked up by the next run.\n" +
+			"\n" +
+			"With '--no-run' nothing is compiled or run. The files each <file> depends on\n" +
+			"are printed whenever they change, which helps debugging what is watched.\n" +
+			"\n" +
+			"If <file> is deleted, the watch stops with an error. With\n" +
+			"'--wait-for-entrypoint' it waits for the file to be created again instead.\n" +
+			"\n" +
+			"A run that fails to compile doesn't stop the watch, also not the first one.\n" +
+			"The change that fixes the error runs <file> again. '--once' exits after the\n" +
+			"first run, even if it failed to compile. With '--ignore-initial-error' it\n" +
+			"waits for a run that compiles instead.\n" +
+			"\n" +
+			"With '--recursive' all directories of the project of <file> are watched,\n" +
+			"which is the closest directory with a 'package.yaml' or 'jag.yaml' file.\n" +
+			"Changes to Toit files anywhere in it re-run <file>, also in new\n" +
+			"subdirectories. This sees files before they are imported, but watching\n" +
+			"many directories costs watches and leads to runs for unrelated files.\n" +
+			"Hidden and ignored directories are skipped.\n" +
+			"\n" +
+			"On Linux at most half of the inotify watches of the system are used by\n" +
+			"default. If the dependencies are in more directories than '--max-watch-dirs',\n" +
+			"the deepest ones are collapsed into their common ancestor, and changes in\n" +
+			"them are missed, which is reported. '--poll' sees all changes.\n" +
+			"\n" +
+			"Interrupting the watch stops the program on the device. Interrupt twice to exit\n" +
+			"without waiting for the device.",
+		Args:         cobra.MinimumNArgs(1),
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			programAssetsPath, err := GetProgramAssetsPath(cmd.Flags(), "assets")
+			// The SDK reloader keeps using this context, so reloaded SDKs
+			// must match the pinned version as well. The project
+			// configuration also supplies defaults for the flags, so it must
+			// be found before any flag is read.
+			ctx, err := withProjectConfig(cmd.Context(), args...)
+			if err != nil {
+				return err
+			}
+			cmd.SetContext(ctx)
+			// An optimization level from the project configuration can be
+			// edited during the session.
+			reloadOptimizationLevel := !cmd.Flags().Changed("optimization-level")
+			if config := projectConfigFromContext(ctx); config != nil {
+				if err := applyProjectFlags(cmd, config, config.Watch); err != nil {
+					return err
+				}
+			}
+
+			ctx, err = parseDeployRetriesFlag(ctx, cmd)
+			if err != nil {
+				return err
+			}
+			ctx, err = parseQuietFlag(ctx, cmd)
+			if err != nil {
+				return err
+			}
+			if jsonOutput, _ := cmd.Flags().GetBool("json"); jsonOutput {
+				ctx = withColor(ctx, false)
+			}
+			cmd.SetContext(ctx)
+
+			programAssetsPaths, err := GetProgramAssetsPaths(cmd.Flags(), "assets")
+			if err != nil {
+				return err
+			}
+
+			programAssetsDirs, err := getProgramAssetsDirs(cmd.Flags(), "assets-from-dir")
+			if err != nil {
+				return err
+			}
+
+			assetsOverwrite, err := cmd.Flags().GetBool("assets-overwrite")
 			if err != nil {
 				return err
 			}
 
-			entrypoint := args[0]
-			if stat, err := os.Stat(entrypoint); err != nil {
-				if os.IsNotExist(err) {
-					return fmt.Errorf("no such file or directory: '%s'", entrypoint)
+			entrypoints := args
+			for _, entrypoint := range entrypoints {
+				if entrypoint == "-" {
+					return fmt.Errorf("can't watch stdin, use 'jag run -' to run a program from stdin")
+				}
+				if stat, err := os.Stat(entrypoint); err != nil {
+					if os.IsNotExist(err) {
+						return fmt.Errorf("no such file or directory: '%s'", entrypoint)
+					}
+					return fmt.Errorf("can't stat file '%s', reason: %w", entrypoint, err)
+				} else if stat.IsDir() {
+					return fmt.Errorf("can't watch directory: '%s'", entrypoint)
 				}
-				return fmt.Errorf("can't stat file '%s', reason: %w", entrypoint, err)
-			} else if stat.IsDir() {
-				return fmt.Errorf("can't watch directory: '%s'", entrypoint)
 			}
 
-			ctx := cmd.Context()
-			deviceSelect, err := parseDeviceFlag(cmd)
+			deviceSelects, err := parseDevicesFlag(cmd)
+			if err != nil {
+				return err
+			}
+
+			allDevices, err := cmd.Flags().GetBool("all-devices")
+			if err != nil {
+				return err
+			}
+			if allDevices && len(deviceSelects) > 0 {
+				return fmt.Errorf("--all-devices and --device are exclusive")
+			}
+
+			buildOnly, err := cmd.Flags().GetBool("build-only")
+			if err != nil {
+				return err
+			}
+
+			name, err := parseProgramNameFlag(cmd)
+			if err != nil {
+				return err
+			}
+			if name != "" && len(entrypoints) > 1 {
+				return fmt.Errorf("--name can't be used with more than one entrypoint")
+			}
+			if buildOnly && (allDevices || len(deviceSelects) > 0) {
+				return fmt.Errorf("--build-only can't be used with --device or --all-devices")
+			}
+
+			noRun, err := cmd.Flags().GetBool("no-run")
 			if err != nil {
 				return err
 			}
+			if noRun && (buildOnly || allDevices || len(deviceSelects) > 0) {
+				return fmt.Errorf("--no-run can't be used with --build-only, --device, or --all-devices")
+			}
 
 			sdk, err := GetSDK(ctx)
 			if err != nil {
 				return err
 			}
 
-			device, err := GetDevice(ctx, sdk, true, deviceSelect)
+			wait, err := cmd.Flags().GetDuration("wait")
+			if err != nil {
+				return err
+			}
+
+			var devices []Device
+			switch {
+			case buildOnly || noRun:
+				// Builds don't need a device.
+			case allDevices:
+				fmt.Println("Scanning ...")
+				scanCtx, cancel := context.WithTimeout(ctx, scanTimeout)
+				devices, err = ScanNetwork(scanCtx, nil, scanPort)
+				cancel()
+				if err != nil {
+					return err
+				}
+				if len(devices) == 0 {
+					return fmt.Errorf("didn't find any Jaguar devices")
+				}
+			case len(deviceSelects) <= 1:
+				var deviceSelect deviceSelect
+				if len(deviceSelects) == 1 {
+					deviceSelect = deviceSelects[0]
+				}
+				device, err := GetDeviceWaiting(ctx, sdk, true, deviceSelect, wait)
+				if err != nil {
+					return err
+				}
+				devices = []Device{device}
+			default:
+				for _, deviceSelect := range deviceSelects {
+					device, err := GetDeviceWaiting(ctx, sdk, true, deviceSelect, wait)
+					if err != nil {
+						return err
+					}
+					devices = append(devices, device)
+				}
+			}
+
+			optimizationLevel, err := parseOptimizationLevelFlag(cmd)
+			if err != nil {
+				return err
+			}
+
+			debounce, err := cmd.Flags().GetDuration("debounce")
+			if err != nil {
+				return err
+			}
+			if !cmd.Flags().Changed("debounce") {
+				if debounce, err = configuredDebounce(); err != nil {
+					return err
+				}
+			}
+			if debounce < 0 {
+				return fmt.Errorf("--debounce must not be negative, got %s", debounce)
+			}
+			debounceMode, err := cmd.Flags().GetString("debounce-mode")
+			if err != nil {
+				return err
+			}
+			if debounceMode != debounceTrailing && debounceMode != debounceGlobal {
+				return fmt.Errorf("invalid --debounce-mode '%s', must be '%s' or '%s'", debounceMode, debounceTrailing, debounceGlobal)
+			}
+
+			shouldClear, err := cmd.Flags().GetBool("clear")
+			if err != nil {
+				return err
+			}
+
+			onChange, err := cmd.Flags().GetString("on-change")
+			if err != nil {
+				return err
+			}
+
+			afterRun, err := cmd.Flags().GetString("after-run")
+			if err != nil {
+				return err
+			}
+			if afterRun != "" && (buildOnly || noRun) {
+				return fmt.Errorf("--after-run can't be used with --build-only or --no-run, which don't run anything")
+			}
+
+			runArgs, err := cmd.Flags().GetStringArray("run-args")
+			if err != nil {
+				return err
+			}
+			if len(runArgs) > 0 && (buildOnly || noRun) {
+				return fmt.Errorf("--run-args can't be used with --build-only or --no-run, which don't run anything")
+			}
+
+			restartDevice, err := cmd.Flags().GetBool("restart-device")
+			if err != nil {
+				return err
+			}
+			if restartDevice && (buildOnly || noRun) {
+				return fmt.Errorf("--restart-device can't be used with --build-only or --no-run, which don't run anything")
+			}
+
+			jsonOutput, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return err
+			}
+
+			noIgnore, err := cmd.Flags().GetBool("no-ignore")
+			if err != nil {
+				return err
+			}
+			ignores := map[string]*ignoreMatcher{}
+			if !noIgnore {
+				for _, entrypoint := range entrypoints {
+					if ignores[entrypoint], err = loadIgnoreMatcher(entrypoint); err != nil {
+						return err
+					}
+				}
+			}
+
+			runTimeout, err := cmd.Flags().GetDuration("run-timeout")
+			if err != nil {
+				return err
+			}
+			if runTimeout < 0 {
+				return fmt.Errorf("--run-timeout must not be negative, got %s", runTimeout)
+			}
+
+			analyzeTimeout, err := cmd.Flags().GetDuration("analyze-timeout")
+			if err != nil {
+				return err
+			}
+			if analyzeTimeout < 0 {
+				return fmt.Errorf("--analyze-timeout must not be negative, got %s", analyzeTimeout)
+			}
+
+			once, err := cmd.Flags().GetBool("once")
+			if err != nil {
+				return err
+			}
+
+			ignoreInitialError, err := cmd.Flags().GetBool("ignore-initial-error")
+			if err != nil {
+				return err
+			}
+
+			verbose, err := cmd.Flags().GetBool("verbose")
+			if err != nil {
+				return err
+			}
+
+			waitForEntrypoint, err := cmd.Flags().GetBool("wait-for-entrypoint")
+			if err != nil {
+				return err
+			}
+
+			dependencyFormat, err := cmd.Flags().GetString("dependency-format")
+			if err != nil {
+				return err
+			}
+			if _, ok := dependencyFormats[dependencyFormat]; dependencyFormat != "" && !ok {
+				return fmt.Errorf("--dependency-format flag '%s' was not recognized. Must be either plain or ninja", dependencyFormat)
+			}
+
+			poll, err := cmd.Flags().GetDuration("poll")
+			if err != nil {
+				return err
+			}
+			if poll < 0 {
+				return fmt.Errorf("--poll must not be negative, got %s", poll)
+			}
+
+			recursive, err := cmd.Flags().GetBool("recursive")
+			if err != nil {
+				return err
+			}
+
+			maxWatchDirs, err := cmd.Flags().GetInt("max-watch-dirs")
+			if err != nil {
+				return err
+			}
+			if maxWatchDirs < 0 {
+				return fmt.Errorf("--max-watch-dirs must not be negative, got %d", maxWatchDirs)
+			}
+			if poll == 0 {
+				for _, entrypoint := range entrypoints {
+					if fs, ok := unreliableFilesystem(filepath.Dir(entrypoint)); ok {
+						fmt.Fprintf(os.Stderr, "Warning: '%s' is on a '%s' filesystem, where changes might not be noticed.\n", entrypoint, fs)
+						fmt.Fprintf(os.Stderr, "Use '--poll 1s' if 'jag watch' doesn't pick up your changes.\n")
+						break
+					}
+				}
+			}
+
+			monitor, err := cmd.Flags().GetBool("monitor")
+			if err != nil {
+				return err
+			}
+			monitorPort := ""
+			monitorBaud, err := cmd.Flags().GetUint("baud")
+			if err != nil {
+				return err
+			}
+			if monitor {
+				if buildOnly || noRun || once || jsonOutput || len(devices) != 1 {
+					return fmt.Errorf("--monitor needs a single device and can't be used with --build-only, --no-run, --once, or --json")
+				}
+				port, err := cmd.Flags().GetString("port")
+				if err != nil {
+					return err
+				}
+				if monitorPort, err = CheckPort(port); err != nil {
+					return err
+				}
+			}
+
+			defines, err := parseEnvFlags(cmd, "env")
+			if err != nil {
+				return err
+			}
+
+			snapshot, err := cmd.Flags().GetString("snapshot")
 			if err != nil {
 				return err
 			}
+			snapshotIsDir := false
+			if snapshot != "" && noRun {
+				return fmt.Errorf("--snapshot can't be used with --no-run")
+			}
+			if snapshot != "" {
+				if stat, err := os.Stat(snapshot); err == nil && stat.IsDir() {
+					snapshotIsDir = true
+				} else if stat, err := os.Stat(filepath.Dir(snapshot)); err != nil || !stat.IsDir() {
+					return fmt.Errorf("directory of --snapshot path doesn't exist: '%s'", filepath.Dir(snapshot))
+				} else if len(entrypoints) > 1 {
+					return fmt.Errorf("--snapshot must be a directory when watching more than one file")
+				}
+			}
 
-			optimizationLevel := -1
-			if cmd.Flags().Changed("optimization-level") {
-				optimizationLevel, err = cmd.Flags().GetInt("optimization-level")
+			var notifier *desktopNotifier
+			if cmd.Flags().Changed("notify") {
+				mode, err := cmd.Flags().GetString("notify")
 				if err != nil {
 					return err
 				}
+				if mode != notifyErrors && mode != notifyAll {
+					return fmt.Errorf("--notify must be either '%s' or '%s', got '%s'", notifyErrors, notifyAll, mode)
+				}
+				if notifier, err = newDesktopNotifier(mode); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: desktop notifications aren't available: %v\n", err)
+					notifier = nil
+				}
+			}
+
+			options := watchOptions{
+				once:               once,
+				ignoreInitialError: ignoreInitialError,
+				buildOnly:          buildOnly,
+				noRun:              noRun,
+				waitForEntrypoint:  waitForEntrypoint,
+				defines:            defines,
+				verbose:            verbose,
+				dependencyFormat:   dependencyFormat,
+				monitorPort:        monitorPort,
+				poll:               poll,
+				maxWatchDirs:       maxWatchDirs,
+				recursive:          recursive,
+				monitorBaud:        int(monitorBaud),
+				snapshot:           snapshot,
+				snapshotIsDir:      snapshotIsDir,
+				debounce:           debounce,
+				debounceMode:       debounceMode,
+				runTimeout:         runTimeout,
+				analyzeTimeout:     analyzeTimeout,
+				ignores:            ignores,
+				clear:              shouldClear && !jsonOutput && term.IsTerminal(int(os.Stdout.Fd())),
+				onChange:           onChange,
+				afterRun:           afterRun,
+				quiet:              isQuiet(ctx),
+				color:              useColor(ctx),
+				restartDevice:      restartDevice,
+				runArgs:            runArgs,
+				json:               jsonOutput,
+				assetsOverwrite:    assetsOverwrite,
+				assetsDirs:         programAssetsDirs,
+				name:               name,
+				notifier:           notifier,
+
+				reloadOptimizationLevel: reloadOptimizationLevel,
 			}
+			return watchFiles(cmd, devices, sdk, entrypoints, programAssetsPaths, optimizationLevel, options)
+		},
+	}
+	cmd.Flags().StringArrayP("device", "d", nil, "use device with a given name, id, or address (can be repeated)")
+	cmd.Flags().Bool("all-devices", false, "use all devices found by scanning")
+	cmd.Flags().StringArray("assets", nil, "attach assets to the program (can be repeated to merge several assets files)")
+	cmd.Flags().StringArray("assets-from-dir", nil, "attach the files in the directory and its subdirectories as assets, named by their relative paths (can be repeated)")
+	cmd.Flags().Bool("assets-overwrite", false, "let later '--assets' files replace assets of the same name instead of failing")
+	cmd.Flags().StringP("optimization-level", "O", "1", optimizationLevelUsage)
+	cmd.Flags().String("name", "", "run the program under this name, so each run only replaces the program with the same name")
+	cmd.Flags().Int("deploy-retries", defaultDeployRetries, "how often to retry sending the code after a timeout or a broken connection")
+	cmd.Flags().Duration("debounce", defaultDebounce, "how long to coalesce file changes before re-running (0 disables coalescing)")
+	cmd.Flags().String("debounce-mode", debounceTrailing, "'trailing' to re-run once the changes have settled, 'global' to re-run one debounce after the first change")
+	cmd.Flags().Bool("clear", false, "clear the terminal before each run")
+	cmd.Flags().String("on-change", "", "shell command to run before each run; the run is skipped if it fails")
+	cmd.Flags().String("after-run", "", "shell command to run after each run on a device; the exit status of the run is in JAG_RUN_EXIT")
+	cmd.Flags().StringArray("run-args", nil, "pass an argument to the program on every run (can be repeated)")
+	cmd.Flags().Bool("restart-device", false, "reboot the device before each run and wait for it to come back")
+	cmd.Flags().Bool("json", false, "print watch events as newline-delimited JSON")
+	cmd.Flags().BoolP("quiet", "q", false, "only print the output of the programs and errors (implied by '--json')")
+	cmd.Flags().Bool("no-ignore", false, "don't use '.jagignore' files")
+	cmd.Flags().Duration("run-timeout", 0, "abort a run that takes longer than this (0 means no timeout)")
+	cmd.Flags().Duration("analyze-timeout", 0, "abort a dependency analysis that takes longer than this (0 means no timeout)")
+	cmd.Flags().Bool("once", false, "exit after the first run, with its status")
+	cmd.Flags().Bool("ignore-initial-error", false, "keep watching if the first run fails to compile, also with --once, which then exits after the first run that compiles")
+	cmd.Flags().Bool("wait-for-entrypoint", false, "wait for a deleted <file> to be created again, instead of exiting")
+	cmd.Flags().Bool("build-only", false, "only compile on changes, without running on a device")
+	cmd.Flags().Bool("no-run", false, "only print the watched files whenever they change, without compiling or running")
+	cmd.Flags().Duration("wait", 0, "keep looking for the devices for this long if they can't be found")
+	cmd.Flags().Bool("verbose", false, "print the analyzer commands, the watched files, and all file events")
+	cmd.Flags().String("dependency-format", "", "the dependency format to request from the analyzer (plain or ninja)")
+	cmd.Flags().Duration("poll", 0, "poll for changes with this interval instead of relying on file system events")
+	cmd.Flags().Bool("recursive", false, "watch all directories of the project, not only the ones of the dependencies")
+	cmd.Flags().Int("max-watch-dirs", 0, "the most directories to watch, more are collapsed into their common ancestor (0 picks a limit from the OS)")
+	cmd.Flags().Bool("monitor", false, "show the serial output of the device after each run")
+	cmd.Flags().String("port", ConfiguredPort(), "serial port to monitor with --monitor")
+	cmd.Flags().Uint("baud", 115200, "the baud rate for --monitor")
+	cmd.Flags().StringArray("env", nil, "pass KEY=VALUE to every run, in the 'jag.defines' asset (can be repeated)")
+	cmd.Flags().String("snapshot", "", "write the snapshot of every successful compile to this file or directory")
+	cmd.Flags().String("notify", "", "show a desktop notification when a run fails ('errors'), or after every run ('all')")
+	cmd.Flags().Lookup("notify").NoOptDefVal = notifyErrors
+	return cmd
+}
+
+const defaultDebounce = 100 * time.Millisecond
+
+// The '--debounce-mode' values.
+const (
+	debounceTrailing = "trailing"
+	debounceGlobal   = "global"
+)
+
+// configuredDebounce returns the debounce set with 'jag config set
+// watch.debounce', or the default.
+func configuredDebounce() (time.Duration, error) {
+	cfg, err := directory.GetUserConfig()
+	if err != nil {
+		return 0, err
+	}
+	if !cfg.IsSet(WatchDebounceCfgKey) {
+		return defaultDebounce, nil
+	}
+	res, err := time.ParseDuration(cfg.GetString(WatchDebounceCfgKey))
+	if err != nil {
+		return 0, fmt.Errorf("invalid '%s' in the user configuration: %w", WatchDebounceCfgKey, err)
+	}
+	return res, nil
+}
+
+// watchOptions holds the settings that control how 'jag watch' reacts to
+// changes.
+type watchOptions struct {
+	debounce time.Duration
+	// Either debounceTrailing or debounceGlobal. Empty means debounceTrailing.
+	debounceMode string
+	// Clear the screen before every run. Only set when stdout is a terminal.
+	clear bool
+	// Defines passed to every run, like the '-D' flags of 'jag run'.
+	defines map[string]interface{}
+	// The arguments passed to the program on every run.
+	runArgs []string
+	// Shell command that is run before every run. The changed file is
+	// available in the JAG_CHANGED_FILE environment variable.
+	onChange string
+	// Shell command that is run after every run on a device, whether it
+	// succeeded or not. The exit status of the run, the entrypoint and the
+	// device are available in the JAG_RUN_EXIT, JAG_ENTRYPOINT and
+	// JAG_DEVICE environment variables.
+	afterRun string
+	// Reboot the device before every run, so each run starts from a clean
+	// state, for example of the peripherals.
+	restartDevice bool
+	// Print events as newline-delimited JSON instead of human readable text.
+	json bool
+	// The '.jagignore' patterns for each entrypoint.
+	ignores map[string]*ignoreMatcher
+	// Abort runs that take longer than this. Zero means no timeout.
+	runTimeout time.Duration
+	// Abort dependency analyses that take longer than this. Zero means no
+	// timeout.
+	analyzeTimeout time.Duration
+	// Stop after the first run and return its result.
+	once bool
+	// Keep watching if the first run fails to compile. Without once the
+	// watch always does. With once it stops after the first run that
+	// compiles.
+	ignoreInitialError bool
+	// Wait for a deleted entrypoint to be created again, instead of
+	// stopping the watch.
+	waitForEntrypoint bool
+	// Only compile the entrypoints. No device is used.
+	buildOnly bool
+	// Neither compile nor run the entrypoints. Only the dependencies are
+	// analyzed, and printed whenever they change. No device is used.
+	noRun bool
+	// Print the analyzer invocations, the watched paths and all file
+	// events.
+	verbose bool
+	// The dependency format requested from the analyzer. Empty means the
+	// default.
+	dependencyFormat string
+	// Poll for changes with this interval instead of using fsnotify. Zero
+	// means fsnotify is used.
+	poll time.Duration
+	// The most directories to watch. More are collapsed into their common
+	// ancestor. Zero picks a limit from the watch limit of the OS.
+	maxWatchDirs int
+	// Watch all directories of the project of each entrypoint, instead of
+	// only the ones of its dependencies.
+	recursive bool
+	// The serial port to monitor after each successful run. Empty means no
+	// monitoring.
+	monitorPort string
+	monitorBaud int
+	// Where to write the snapshot of every successful compile. If
+	// snapshotIsDir is set, a timestamped file is written in it.
+	snapshot      string
+	snapshotIsDir bool
+	// Let later assets files replace assets of the same name when merging
+	// several assets files.
+	assetsOverwrite bool
+	// Directories whose files are bundled as assets for every run. Changes
+	// to any file in them re-run all entrypoints.
+	assetsDirs []string
+	// The name the programs are run under, so every run only replaces the
+	// program with the same name. Empty means unnamed.
+	name string
+	// Suppress the human readable messages of the watcher, without JSON
+	// output.
+	quiet bool
+	// Color the status lines. Ignored with JSON output.
+	color bool
+	// Called for every event, from any goroutine. Calls are serialized.
+	onEvent func(WatchEvent)
+	// Shows desktop notifications about the runs. Nil if '--notify' isn't
+	// given.
+	notifier *desktopNotifier
+	// Read the optimization level from the 'watch' section of the project
+	// configuration again for every run. Set if it isn't given on the
+	// command line.
+	reloadOptimizationLevel bool
+	// Creates the watcher of the session. Nil uses newWatcher with poll.
+	// Tests use it to feed events to the session.
+	newWatcher func() (*watcher, error)
+}
+
+// WatchOptions configures Watch.
+type WatchOptions struct {
+	// The Toit files to watch and run.
+	Entrypoints []string
+	// The devices to run the entrypoints on. Must be empty if BuildOnly
+	// is set.
+	Devices []Device
+	SDK     *SDK
+	// The assets to attach to the programs. May be empty.
+	AssetsPath string
+	// More assets files, merged with AssetsPath before every run.
+	AssetsPaths []string
+	// Directories whose files are bundled as assets before every run,
+	// named by their paths relative to the directory.
+	AssetsDirs []string
+	// Let later assets files replace assets of the same name instead of
+	// failing the run.
+	AssetsOverwrite bool
+	// The optimization level of the compiler. -1 uses the default.
+	OptimizationLevel int
+	// Defines passed to every run, like the '-D' flags of 'jag run'.
+	Defines map[string]interface{}
+	// How long to coalesce file changes. Zero re-runs on every change.
+	Debounce time.Duration
+	// "trailing" to re-run once the changes have settled, or "global" to
+	// re-run one Debounce after the first change. Empty means "trailing".
+	DebounceMode string
+	// The arguments passed to the programs on every run.
+	RunArgs []string
+	// Abort runs that take longer than this. Zero means no timeout.
+	RunTimeout time.Duration
+	// Abort dependency analyses that take longer than this. Zero means no
+	// timeout.
+	AnalyzeTimeout time.Duration
+	// Only compile the entrypoints, without running them.
+	BuildOnly bool
+	// Stop after the first run and return its result.
+	Once bool
+	// Keep watching if the first run fails to compile. With Once, stop
+	// after the first run that compiles.
+	IgnoreInitialError bool
+	// Suppress the messages of the watcher. The compiler and the deploy
+	// still print to stdout and stderr.
+	Quiet bool
+	// Called for every event. Calls are serialized, but may come from
+	// different goroutines.
+	OnEvent func(WatchEvent)
+}
+
+// Watch runs the entrypoints and re-runs them whenever they or one of their
+// dependencies change, like 'jag watch'. It returns a channel that receives
+// the result once the context is cancelled, or after the first run if Once
+// is set.
+func Watch(ctx context.Context, opts WatchOptions) (<-chan error, error) {
+	if opts.BuildOnly && len(opts.Devices) > 0 {
+		return nil, fmt.Errorf("devices can't be used with BuildOnly")
+	}
+	if !opts.BuildOnly && len(opts.Devices) == 0 {
+		return nil, fmt.Errorf("no devices given")
+	}
+	if opts.DebounceMode != "" && opts.DebounceMode != debounceTrailing && opts.DebounceMode != debounceGlobal {
+		return nil, fmt.Errorf("invalid debounce mode '%s'", opts.DebounceMode)
+	}
+	if opts.OptimizationLevel != -1 && (opts.OptimizationLevel < minOptimizationLevel || opts.OptimizationLevel > maxOptimizationLevel) {
+		return nil, fmt.Errorf("invalid optimization level %d, valid levels are %d to %d", opts.OptimizationLevel, minOptimizationLevel, maxOptimizationLevel)
+	}
+	ignores := map[string]*ignoreMatcher{}
+	for _, entrypoint := range opts.Entrypoints {
+		matcher, err := loadIgnoreMatcher(entrypoint)
+		if err != nil {
+			return nil, err
+		}
+		ignores[entrypoint] = matcher
+	}
+	options := watchOptions{
+		debounce:           opts.Debounce,
+		debounceMode:       opts.DebounceMode,
+		defines:            opts.Defines,
+		ignores:            ignores,
+		runArgs:            opts.RunArgs,
+		runTimeout:         opts.RunTimeout,
+		analyzeTimeout:     opts.AnalyzeTimeout,
+		buildOnly:          opts.BuildOnly,
+		once:               opts.Once,
+		ignoreInitialError: opts.IgnoreInitialError,
+		quiet:              opts.Quiet,
+		onEvent:            opts.OnEvent,
+		assetsOverwrite:    opts.AssetsOverwrite,
+		assetsDirs:         opts.AssetsDirs,
+	}
+	var assetsPaths []string
+	if opts.AssetsPath != "" {
+		assetsPaths = append(assetsPaths, opts.AssetsPath)
+	}
+	assetsPaths = append(assetsPaths, opts.AssetsPaths...)
+	return startWatch(ctx, nil, opts.Devices, opts.SDK, opts.Entrypoints, assetsPaths, opts.OptimizationLevel, options)
+}
+
+// WatchEvent is a single line of the '--json' output of 'jag watch'.
+// Editors rely on the field names, so they must stay stable.
+type WatchEvent struct {
+	Type       string `json:"type"`
+	File       string `json:"file,omitempty"`
+	Entrypoint string `json:"entrypoint,omitempty"`
+	Device     string `json:"device,omitempty"`
+	Exit       *int   `json:"exit,omitempty"`
+	DurationMs *int64 `json:"duration_ms,omitempty"`
+	AnalyzeMs  *int64 `json:"analyze_ms,omitempty"`
+	TotalMs    *int64 `json:"total_ms,omitempty"`
+	// The sizes of the compiled program and of the data sent to the
+	// device. Only set for successful runs, and SentBytes only for runs on
+	// devices.
+	SnapshotSize *int64 `json:"snapshot_bytes,omitempty"`
+	SentBytes    *int   `json:"sent_bytes,omitempty"`
+	Error        string `json:"error,omitempty"`
+	// The files and directories the entrypoint depends on. Only set for
+	// 'deps' events.
+	Files []string `json:"files,omitempty"`
+	Dirs  []string `json:"dirs,omitempty"`
+}
+
+const (
+	WatchEventChanged      = "changed"
+	WatchEventRunStart     = "run-start"
+	WatchEventRunEnd       = "run-end"
+	WatchEventCompileError = "compile-error"
+	// Sent with '--no-run' when the watched paths of an entrypoint change.
+	WatchEventDeps = "deps"
+	// Sent when an entrypoint was deleted.
+	WatchEventDeleted = "deleted"
+)
+
+// watchOutput prints either human readable messages or JSON events,
+// depending on the '--json' flag.
+type watchOutput struct {
+	sync.Mutex
+	// Suppress the human readable messages. Set with JSON output.
+	quiet   bool
+	verbose bool
+	color   bool
+	// Only set with JSON output.
+	encoder  *json.Encoder
+	onEvent  func(WatchEvent)
+	notifier *desktopNotifier
+}
+
+func newWatchOutput(options watchOptions) *watchOutput {
+	res := &watchOutput{
+		quiet:    options.json || options.quiet,
+		verbose:  options.verbose,
+		color:    options.color && !options.json,
+		onEvent:  options.onEvent,
+		notifier: options.notifier,
+	}
+	if options.json {
+		res.encoder = json.NewEncoder(os.Stdout)
+	}
+	return res
+}
+
+// emit prints the event if JSON output is enabled, and passes it to the
+// event callback and the notifier, if any.
+func (o *watchOutput) emit(event WatchEvent) {
+	o.notifier.notify(event, o.errorf)
+	if o.encoder == nil && o.onEvent == nil {
+		return
+	}
+	o.Lock()
+	defer o.Unlock()
+	if o.encoder != nil {
+		o.encoder.Encode(event)
+	}
+	if o.onEvent != nil {
+		o.onEvent(event)
+	}
+}
+
+// printf prints a human readable message, unless JSON output is enabled.
+func (o *watchOutput) printf(format string, a ...interface{}) {
+	if o.quiet {
+		return
+	}
+	fmt.Printf(format, a...)
+}
+
+// paint returns the text in the style, if the output is colored.
+func (o *watchOutput) paint(s style, text string) string {
+	return s.apply(o.color && !o.quiet, text)
+}
+
+// errorf prints a problem with the watcher itself. With JSON output it
+// goes to stderr so it doesn't break the event stream.
+func (o *watchOutput) errorf(format string, a ...interface{}) {
+	if o.quiet {
+		fmt.Fprintf(os.Stderr, format, a...)
+		return
+	}
+	fmt.Printf(format, a...)
+}
+
+// verbosef prints a debugging message if '--verbose' is given. Like errorf,
+// it goes to stderr with JSON output.
+func (o *watchOutput) verbosef(format string, a ...interface{}) {
+	if !o.verbose {
+		return
+	}
+	o.errorf(format, a...)
+}
+
+const (
+	changedFileEnv = "JAG_CHANGED_FILE"
+	runExitEnv     = "JAG_RUN_EXIT"
+	entrypointEnv  = "JAG_ENTRYPOINT"
+	deviceEnv      = "JAG_DEVICE"
+)
+
+const (
+	// The device answers pings until it has gone down, so the wait for it
+	// to come back starts a bit after the reboot request.
+	rebootSettleDelay = time.Second
+	rebootTimeout     = 30 * time.Second
+)
+
+// rebootAndWait reboots the device for '--restart-device' and waits until
+// it answers pings again.
+func rebootAndWait(ctx context.Context, sdk *SDK, device Device, printf func(format string, a ...interface{})) error {
+	printf("Rebooting '%s' ...\n", device.Name())
+	if err := device.Reboot(ctx, sdk); err != nil {
+		return fmt.Errorf("failed to reboot '%s': %w", device.Name(), err)
+	}
+	resetDeviceSession(device)
+	select {
+	case <-time.After(rebootSettleDelay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	what := fmt.Sprintf("'%s' to reboot", device.Name())
+	return retryWaiting(ctx, rebootTimeout, what, printf, func() error {
+		if !device.Ping(ctx, sdk) {
+			return fmt.Errorf("'%s' doesn't answer", device.Name())
+		}
+		return nil
+	})
+}
+
+// runHook runs the given command through the shell. The command is killed
+// when the context is cancelled.
+func runHook(ctx context.Context, command string, env ...string) error {
+	var hook *exec.Cmd
+	if runtime.GOOS == "windows" {
+		hook = exec.CommandContext(ctx, "cmd", "/c", command)
+	} else {
+		hook = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	hook.Env = append(os.Environ(), env...)
+	hook.Stdin = os.Stdin
+	hook.Stdout = os.Stdout
+	hook.Stderr = os.Stderr
+	return hook.Run()
+}
+
+// watchFiles is the 'jag watch' command around startWatch. It stops the
+// programs on the devices when interrupted.
+func watchFiles(
+	cmd *cobra.Command,
+	devices []Device,
+	sdk *SDK,
+	entrypoints []string,
+	assetsPaths []string,
+	optimizationLevel int,
+	options watchOptions) error {
+	ctx, cancel := context.WithCancel(cmd.Context())
+	defer cancel()
+
+	out := newWatchOutput(options)
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signalChan)
+
+	interrupted := make(chan struct{})
+	go func() {
+		select {
+		case <-signalChan:
+		case <-ctx.Done():
+			return
+		}
+		if len(devices) > 0 {
+			out.printf("\nInterrupt received, stopping the program on the device ...\n")
+		} else {
+			out.printf("\nInterrupt received, shutting down ...\n")
+		}
+		close(interrupted)
+		cancel()
+		// Stopping the program might hang if the device is unreachable.
+		// A second interrupt exits immediately.
+		<-signalChan
+		os.Exit(130)
+	}()
+
+	waitCh, err := startWatch(ctx, cmd, devices, sdk, entrypoints, assetsPaths, optimizationLevel, options)
+	if err != nil {
+		return err
+	}
+
+	err = <-waitCh
+	select {
+	case <-interrupted:
+		stopDevices(out, devices, sdk)
+		return nil
+	default:
+		return err
+	}
+}
+
+// dependencyFiles holds one dependency file per entrypoint, in a temporary
+// directory that lives as long as the watch session. Reusing the files
+// avoids leaving stray temporary files behind when runs are cancelled.
+type dependencyFiles struct {
+	dir   string
+	files map[string]*dependencyFile
+
+	formatMutex sync.Mutex
+	format      string
+}
+
+type dependencyFile struct {
+	// Held while the analyzer writes to the file.
+	sync.Mutex
+	path string
+
+	// The result of the last successful analysis, together with the
+	// modification times of the dependencies at the time. If none of them
+	// changed, the analysis is skipped. Nil if there is no valid result.
+	cached []string
+	stamps map[string]time.Time
+	// The SDK the cached result was computed with.
+	cachedSDK string
+	// The file the entrypoint resolved to, in case it is a symlink that is
+	// re-pointed.
+	cachedTarget string
+}
+
+// dependencyStamps returns the modification times of the paths. It returns
+// nil if a path can't be stat'ed, or if it was modified after the given time,
+// since the analysis might then have seen an older version of the file.
+func dependencyStamps(paths []string, analyzeStart time.Time) map[string]time.Time {
+	res := map[string]time.Time{}
+	for _, p := range paths {
+		stat, err := os.Stat(p)
+		if err != nil || !stat.ModTime().Before(analyzeStart) {
+			return nil
+		}
+		res[p] = stat.ModTime()
+	}
+	return res
+}
+
+// cachedPaths returns the paths of the last analysis if none of them have
+// been modified since.
+func (f *dependencyFile) cachedPaths(sdk *SDK, target string) []string {
+	if f.cached == nil || f.cachedSDK != sdk.Path+"@"+sdk.Version || f.cachedTarget != target {
+		return nil
+	}
+	for p, stamp := range f.stamps {
+		stat, err := os.Stat(p)
+		if err != nil || !stat.ModTime().Equal(stamp) {
+			return nil
+		}
+	}
+	return append([]string(nil), f.cached...)
+}
+
+func newDependencyFiles(entrypoints []string, format string) (*dependencyFiles, error) {
+	if format == "" {
+		format = defaultDependencyFormat
+	}
+	dir, err := os.MkdirTemp("", "jag_watch_deps")
+	if err != nil {
+		return nil, err
+	}
+	res := &dependencyFiles{
+		dir:    dir,
+		files:  map[string]*dependencyFile{},
+		format: format,
+	}
+	for i, entrypoint := range entrypoints {
+		res.files[entrypoint] = &dependencyFile{
+			path: filepath.Join(dir, fmt.Sprintf("%d.txt", i)),
+		}
+	}
+	return res, nil
+}
+
+func (d *dependencyFiles) Close() error {
+	return os.RemoveAll(d.dir)
+}
+
+func (d *dependencyFiles) currentFormat() string {
+	d.formatMutex.Lock()
+	defer d.formatMutex.Unlock()
+	return d.format
+}
+
+// analyze runs analyzeDependencies on the entrypoint, using its dependency
+// file. Analyses of the same entrypoint are serialized.
+// If none of the dependencies found by the last successful analysis changed,
+// its result is returned without running the analyzer again.
+// If the SDK doesn't support the requested dependency format, the warning is
+// reported through warnf and the plain format is used from then on.
+func (d *dependencyFiles) analyze(
+	ctx context.Context,
+	sdk *SDK,
+	entrypoint string,
+	warnf func(format string, a ...interface{}),
+	logf func(format string, a ...interface{})) ([]string, error) {
+	file := d.files[entrypoint]
+	file.Lock()
+	defer file.Unlock()
+	target := resolveEntrypoint(entrypoint)
+	if cached := file.cachedPaths(sdk, target); cached != nil {
+		logf("The dependencies of '%s' didn't change, skipping the analyzer\n", entrypoint)
+		return cached, nil
+	}
+	analyzeStart := time.Now()
+	paths, err := d.analyzeUncached(ctx, sdk, entrypoint, file, warnf, logf)
+	// Compile errors and missing dependencies invalidate the cache.
+	file.cached = nil
+	if err == nil {
+		if stamps := dependencyStamps(paths, analyzeStart); stamps != nil {
+			// The caller may modify the returned paths.
+			file.cached = append([]string(nil), paths...)
+			file.stamps = stamps
+			file.cachedSDK = sdk.Path + "@" + sdk.Version
+			file.cachedTarget = target
+		}
+	}
+	return paths, err
+}
+
+// resolveEntrypoint returns the file the entrypoint points to, or "" if it
+// can't be resolved.
+func resolveEntrypoint(entrypoint string) string {
+	res, err := filepath.EvalSymlinks(entrypoint)
+	if err != nil {
+		return ""
+	}
+	if abs, err := filepath.Abs(res); err == nil {
+		res = abs
+	}
+	return res
+}
+
+// symlinkComponents returns the absolute paths of the symlinks in the path,
+// including the path itself. Re-pointing any of them changes the file the
+// path refers to.
+func symlinkComponents(path string) []string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	var res []string
+	for p := abs; ; p = filepath.Dir(p) {
+		// Lstat follows all but the last element, which is the one that is
+		// checked.
+		if stat, err := os.Lstat(p); err == nil && stat.Mode()&os.ModeSymlink != 0 {
+			res = append(res, p)
+		}
+		if filepath.Dir(p) == p {
+			return res
+		}
+	}
+}
+
+// invalidate drops the cached analysis of the entrypoint, for example after
+// it failed to compile.
+func (d *dependencyFiles) invalidate(entrypoint string) {
+	file := d.files[entrypoint]
+	file.Lock()
+	defer file.Unlock()
+	file.cached = nil
+}
+
+func (d *dependencyFiles) analyzeUncached(
+	ctx context.Context,
+	sdk *SDK,
+	entrypoint string,
+	file *dependencyFile,
+	warnf func(format string, a ...interface{}),
+	logf func(format string, a ...interface{})) ([]string, error) {
+	format := d.currentFormat()
+	paths, err := analyzeDependenciesTo(ctx, sdk, entrypoint, file.path, format, logf)
+	var formatErr *unsupportedDependencyFormatError
+	if errors.As(err, &formatErr) && format != defaultDependencyFormat {
+		d.formatMutex.Lock()
+		if d.format == format {
+			warnf("Warning: %v, falling back to '%s'\n", err, defaultDependencyFormat)
+			d.format = defaultDependencyFormat
+		}
+		d.formatMutex.Unlock()
+		return analyzeDependenciesTo(ctx, sdk, entrypoint, file.path, defaultDependencyFormat, logf)
+	}
+	return paths, err
+}
+
+// monitorSerialLog prints the serial output of the device until the context
+// is cancelled, which happens when the next change fires.
+func monitorSerialLog(ctx context.Context, out *watchOutput, mutex *sync.Mutex, port string, baud int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+
+	dev, err := serialOpen(port, &serial.Mode{
+		BaudRate: baud,
+	})
+	if err != nil {
+		out.errorf("Failed to monitor port '%s': %v\n", port, err)
+		return
+	}
+	defer dev.Close()
+
+	out.printf("-- monitoring '%s' --\n", port)
+	if err := monitorReader(ctx, dev, "", false, false, monitorOptions{}); err != nil && ctx.Err() == nil {
+		out.errorf("Stopped monitoring port '%s': %v\n", port, err)
+	}
+}
+
+// copyFileAtomic copies src to dest. The copy is written to a temporary file
+// next to dest first, so readers never see a half-written file.
+func copyFileAtomic(src string, dest string) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".jag_watch_*.snapshot")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, source); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// startWatch starts watching in the background. The returned channel
+// receives the result of the watch. The command may be nil.
+func startWatch(
+	ctx context.Context,
+	cmd *cobra.Command,
+	devices []Device,
+	sdk *SDK,
+	entrypoints []string,
+	assetsPaths []string,
+	optimizationLevel int,
+	options watchOptions) (<-chan error, error) {
+	if cmd == nil {
+		// Running code only uses the command to silence errors that have
+		// already been printed.
+		cmd = &cobra.Command{}
+	}
+	cmd.SetContext(ctx)
+
+	newSessionWatcher := options.newWatcher
+	if newSessionWatcher == nil {
+		newSessionWatcher = func() (*watcher, error) { return newWatcher(options.poll) }
+	}
+	watcher, err := newSessionWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	depFiles, err := newDependencyFiles(entrypoints, options.dependencyFormat)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	// Keep the connections to the devices open for the whole session,
+	// instead of reconnecting for every run.
+	sessions := make([]Device, len(devices))
+	var closeSessions []func()
+	for i, device := range devices {
+		var closeSession func()
+		sessions[i], closeSession = newDeviceSession(device)
+		closeSessions = append(closeSessions, closeSession)
+	}
+
+	resCh := make(chan error, 1)
+	go func() {
+		// The result is only sent once everything is cleaned up, so callers
+		// don't see leftovers of the session.
+		var res error
+		defer func() {
+			resCh <- res
+			close(resCh)
+		}()
+		defer watcher.Close()
+		defer depFiles.Close()
+		defer func() {
+			for _, closeSession := range closeSessions {
+				closeSession()
+			}
+		}()
+		waitCh, fn := onWatchChanges(cmd, watcher, depFiles, sessions, sdk, entrypoints, assetsPaths, optimizationLevel, options)
+		go fn()
+		res = <-waitCh
+	}()
+	return resCh, nil
+}
+
+const stopTimeout = 5 * time.Second
+
+// stopDevices stops the programs that were started on the devices, so a
+// watch session doesn't leave them running.
+func stopDevices(out *watchOutput, devices []Device, sdk *SDK) {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		wg.Add(1)
+		go func(device Device) {
+			defer wg.Done()
+			if err := device.Stop(ctx, sdk); err != nil {
+				out.errorf("Failed to stop the program on '%s': %v\n", device.Name(), err)
+			}
+		}(device)
+	}
+	wg.Wait()
+}
+
+func clearScreen() {
+	if runtime.GOOS == "windows" {
+		cls := exec.Command("cmd", "/c", "cls")
+		cls.Stdout = os.Stdout
+		cls.Run()
+		return
+	}
+	fmt.Print("\033[H\033[2J")
+}
+
+// fileWatcher is implemented by *fsnotify.Watcher and *pollWatcher.
+type fileWatcher interface {
+	Add(name string) error
+	Remove(name string) error
+	Close() error
+}
+
+type watcher struct {
+	sync.Mutex
+	watcher fileWatcher
+	events  chan fsnotify.Event
+	errors  chan error
+
+	// The directories that are watched. They are derived from the files
+	// and the directory dependencies below, since watching the directory
+	// of a file also sees it being replaced.
+	dirs map[string]struct{}
+	// The files whose changes are reported.
+	paths map[string]struct{}
+	// The files each entrypoint depends on. The union of these is 'paths'.
+	deps map[string]map[string]struct{}
+	// Directories in which any new or changed Toit file is considered a
+	// dependency of the entrypoint. Used while the entrypoint doesn't compile.
+	dirDeps map[string]map[string]struct{}
+	// Symlinks in the path of the entrypoint. They are watched without
+	// resolving them, so re-pointing them is noticed.
+	links map[string]map[string]struct{}
+	// Directories in which any file is considered a dependency of the
+	// entrypoint, like the directories of '--assets-from-dir'.
+	assetDirs map[string]map[string]struct{}
+	// The directories of the project tree of the entrypoint with
+	// '--recursive'. Any new or changed Toit file in them is considered a
+	// dependency, even if the entrypoint compiles.
+	treeDirs map[string]map[string]struct{}
+
+	// The most directories to watch. Zero means no limit.
+	maxDirs int
+	// Reports collapsed directories. The last report avoids repeating it
+	// on every update.
+	warnf        func(format string, a ...interface{})
+	lastCollapse string
+}
+
+// newWatcher creates a watcher that uses fsnotify, or polls with the given
+// interval if it isn't zero.
+func newWatcher(poll time.Duration) (*watcher, error) {
+	if poll > 0 {
+		w := newPollWatcher(poll)
+		return newWatcherWith(w, w.Events, w.Errors), nil
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return newWatcherWith(w, w.Events, w.Errors), nil
+}
+
+// newWatcherWith creates a watcher that adds the directories to w, and
+// gets the events and errors of w from the channels.
+func newWatcherWith(w fileWatcher, events chan fsnotify.Event, errs chan error) *watcher {
+	return &watcher{
+		watcher:   w,
+		events:    events,
+		errors:    errs,
+		dirs:      map[string]struct{}{},
+		paths:     map[string]struct{}{},
+		deps:      map[string]map[string]struct{}{},
+		dirDeps:   map[string]map[string]struct{}{},
+		links:     map[string]map[string]struct{}{},
+		assetDirs: map[string]map[string]struct{}{},
+		treeDirs:  map[string]map[string]struct{}{},
+	}
+}
+
+func (w *watcher) Close() error {
+	return w.watcher.Close()
+}
+
+func (w *watcher) Events() chan fsnotify.Event {
+	return w.events
+}
+
+func (w *watcher) Errors() chan error {
+	return w.errors
+}
+
+func (w *watcher) CountPaths(entrypoint string) int {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	return len(w.deps[entrypoint])
+}
+
+// DependsOn returns whether the entrypoint depends on the given path.
+func (w *watcher) DependsOn(entrypoint string, path string) bool {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	return w.dependsOn(entrypoint, path)
+}
+
+func (w *watcher) dependsOn(entrypoint string, path string) bool {
+	if _, ok := w.deps[entrypoint][path]; ok {
+		return true
+	}
+	if _, ok := w.links[entrypoint][path]; ok {
+		return true
+	}
+	if _, ok := w.assetDirs[entrypoint][filepath.Dir(path)]; ok && isAssetFile(filepath.Base(path)) {
+		return true
+	}
+	if filepath.Ext(path) != ".toit" {
+		return false
+	}
+	if _, ok := w.treeDirs[entrypoint][filepath.Dir(path)]; ok {
+		return true
+	}
+	_, ok := w.dirDeps[entrypoint][filepath.Dir(path)]
+	return ok
+}
+
+// Watched returns the sorted directories and files that are currently
+// watched.
+func (w *watcher) Watched() (dirs []string, files []string) {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	for d := range w.dirs {
+		dirs = append(dirs, d)
+	}
+	for p := range w.paths {
+		files = append(files, p)
+	}
+	sort.Strings(dirs)
+	sort.Strings(files)
+	return dirs, files
+}
+
+// WatchedBy returns the sorted directories and files the entrypoint depends
+// on.
+func (w *watcher) WatchedBy(entrypoint string) (dirs []string, files []string) {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	for d := range w.dirDeps[entrypoint] {
+		dirs = append(dirs, d)
+	}
+	for p := range w.deps[entrypoint] {
+		files = append(files, p)
+	}
+	sort.Strings(dirs)
+	sort.Strings(files)
+	return dirs, files
+}
+
+// IsWatchedDir returns whether the path is one of the watched directories.
+func (w *watcher) IsWatchedDir(path string) bool {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	_, ok := w.dirs[path]
+	return ok
+}
+
+// Reset drops all directories from the underlying watcher, so the next
+// update adds them again. Needed after the watcher failed, or after a watched
+// directory was removed, which silently drops its watch.
+func (w *watcher) Reset() {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	for d := range w.dirs {
+		w.watcher.Remove(d)
+		delete(w.dirs, d)
+	}
+}
+
+// IsWatched returns whether any entrypoint depends on the given path.
+func (w *watcher) IsWatched(path string) bool {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	for entrypoint := range w.deps {
+		if w.dependsOn(entrypoint, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch sets the paths the entrypoint depends on and updates the
+// underlying watcher to cover the paths of all entrypoints.
+func (w *watcher) Watch(entrypoint string, paths ...string) (err error) {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	if err := resolvePaths(paths); err != nil {
+		return err
+	}
+
+	deps := map[string]struct{}{}
+	for _, p := range paths {
+		deps[p] = struct{}{}
+	}
+	w.deps[entrypoint] = deps
+	return w.update()
+}
+
+// Extend adds paths to the ones the entrypoint already depends on.
+func (w *watcher) Extend(entrypoint string, paths ...string) error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	if err := resolvePaths(paths); err != nil {
+		return err
+	}
+
+	deps, ok := w.deps[entrypoint]
+	if !ok {
+		deps = map[string]struct{}{}
+		w.deps[entrypoint] = deps
+	}
+	for _, p := range paths {
+		deps[p] = struct{}{}
+	}
+	return w.update()
+}
+
+// resolvePaths resolves symlinks in the given paths in place.
+func resolvePaths(paths []string) error {
+	for i, p := range paths {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return err
+			}
+			// The path exists but can't be resolved right now (for example
+			// because it is locked). Keep watching it under its given name.
+			continue
+		}
+		paths[i] = resolved
+	}
+	return nil
+}
+
+// WatchDirs sets the directories in which any Toit file is considered a
+// dependency of the entrypoint, in addition to the paths given to Watch.
+func (w *watcher) WatchDirs(entrypoint string, dirs ...string) error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	dirDeps := map[string]struct{}{}
+	for _, d := range dirs {
+		if resolved, err := filepath.EvalSymlinks(d); err == nil {
+			d = resolved
+		}
+		dirDeps[d] = struct{}{}
+	}
+	w.dirDeps[entrypoint] = dirDeps
+	if _, ok := w.deps[entrypoint]; !ok {
+		w.deps[entrypoint] = map[string]struct{}{}
+	}
+	return w.update()
+}
+
+// WatchAssetDirs sets the directories in which any file is considered a
+// dependency of the entrypoint.
+func (w *watcher) WatchAssetDirs(entrypoint string, dirs ...string) error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	dirDeps := map[string]struct{}{}
+	for _, d := range dirs {
+		if resolved, err := filepath.EvalSymlinks(d); err == nil {
+			d = resolved
+		}
+		dirDeps[d] = struct{}{}
+	}
+	w.assetDirs[entrypoint] = dirDeps
+	return w.update()
+}
+
+// WatchTree sets the directories of the project tree of the entrypoint, for
+// '--recursive'.
+func (w *watcher) WatchTree(entrypoint string, dirs ...string) error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	treeDirs := map[string]struct{}{}
+	for _, d := range dirs {
+		treeDirs[d] = struct{}{}
+	}
+	w.treeDirs[entrypoint] = treeDirs
+	return w.update()
+}
+
+// InTree returns whether the directory is in the project tree of the
+// entrypoint, or would be, if it was a direct subdirectory of one that
+// is.
+func (w *watcher) InTree(entrypoint string, dir string) bool {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	_, ok := w.treeDirs[entrypoint][filepath.Dir(dir)]
+	return ok
+}
+
+// ExtendTree adds directories to the project tree of the entrypoint, for
+// example after they were created.
+func (w *watcher) ExtendTree(entrypoint string, dirs ...string) error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	treeDirs, ok := w.treeDirs[entrypoint]
+	if !ok {
+		treeDirs = map[string]struct{}{}
+		w.treeDirs[entrypoint] = treeDirs
+	}
+	for _, d := range dirs {
+		treeDirs[d] = struct{}{}
+	}
+	return w.update()
+}
+
+// treeDirs returns the directory and its subdirectories for '--recursive'.
+// Hidden directories, like '.git' and '.packages', and the ones ignored by
+// a '.jagignore' file are skipped. The dependencies in '.packages' are
+// still watched, like without '--recursive'.
+func treeDirs(root string, ignores *ignoreMatcher) []string {
+	var res []string
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+		if path != root && (strings.HasPrefix(entry.Name(), ".") || ignores.Match(path)) {
+			return filepath.SkipDir
+		}
+		res = append(res, path)
+		return nil
+	})
+	return res
+}
+
+// projectRoot returns the root of the project the entrypoint is in: the
+// closest directory with a 'package.yaml' or a 'jag.yaml' file, or the
+// directory of the entrypoint.
+func projectRoot(entrypoint string) string {
+	start := filepath.Dir(entrypoint)
+	if abs, err := filepath.Abs(start); err == nil {
+		start = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(start); err == nil {
+		start = resolved
+	}
+	for dir := start; ; dir = filepath.Dir(dir) {
+		for _, name := range []string{"package.yaml", projectConfigName} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return dir
+			}
+		}
+		if filepath.Dir(dir) == dir {
+			return start
+		}
+	}
+}
+
+// WatchLinks sets the symlinks in the path of the entrypoint. Unlike the
+// paths given to Watch, they aren't resolved.
+func (w *watcher) WatchLinks(entrypoint string, links ...string) error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	deps := map[string]struct{}{}
+	for _, l := range links {
+		deps[l] = struct{}{}
+	}
+	w.links[entrypoint] = deps
+	return w.update()
+}
+
+// update makes the underlying watcher cover the paths and directories of
+// all entrypoints. Must be called with the mutex held.
+func (w *watcher) update() error {
+	var addErrs []error
+	addDir := func(dir string) {
+		if _, ok := w.dirs[dir]; ok {
+			return
+		}
+		if err := w.watcher.Add(dir); err != nil {
+			addErrs = append(addErrs, fmt.Errorf("'%s': %w", dir, err))
+			return
+		}
+		w.dirs[dir] = struct{}{}
+	}
+
+	candidateDirs := map[string]struct{}{}
+	candidates := map[string]struct{}{}
+	for _, deps := range w.deps {
+		for p := range deps {
+			w.paths[p] = struct{}{}
+			candidateDirs[filepath.Dir(p)] = struct{}{}
+			candidates[p] = struct{}{}
+		}
+	}
+	for _, dirDeps := range w.dirDeps {
+		for dir := range dirDeps {
+			candidateDirs[dir] = struct{}{}
+		}
+	}
+	for _, dirDeps := range w.assetDirs {
+		for dir := range dirDeps {
+			candidateDirs[dir] = struct{}{}
+		}
+	}
+	for _, dirDeps := range w.treeDirs {
+		for dir := range dirDeps {
+			candidateDirs[dir] = struct{}{}
+		}
+	}
+	for _, links := range w.links {
+		for l := range links {
+			w.paths[l] = struct{}{}
+			candidateDirs[filepath.Dir(l)] = struct{}{}
+			candidates[l] = struct{}{}
+		}
+	}
+	candidateDirs = w.collapseDirs(candidateDirs)
+	for dir := range candidateDirs {
+		addDir(dir)
+	}
+
+	// Remove the files/watchers we don't need anymore.
+	for p := range w.paths {
+		if _, ok := candidates[p]; !ok {
+			delete(w.paths, p)
+		}
+	}
+	for d := range w.dirs {
+		if _, ok := candidateDirs[d]; !ok {
+			delete(w.dirs, d)
+			w.watcher.Remove(d)
+		}
+	}
+	if len(addErrs) > 0 {
+		return &watchAddError{addErrs}
+	}
+	return nil
+}
+
+// collapseDirs limits the directories to maxDirs. The shallowest ones are
+// kept and the others are replaced by their common ancestor, which is only
+// watched by itself, so changes to files in them are missed. The watch
+// keeps working on huge trees, instead of exhausting the watches of the OS.
+// The collapse is reported through warnf whenever it changes.
+func (w *watcher) collapseDirs(dirs map[string]struct{}) map[string]struct{} {
+	if w.maxDirs <= 0 || len(dirs) <= w.maxDirs {
+		w.lastCollapse = ""
+		return dirs
+	}
+	sorted := make([]string, 0, len(dirs))
+	for d := range dirs {
+		sorted = append(sorted, d)
+	}
+	depth := func(d string) int { return strings.Count(filepath.Clean(d), string(filepath.Separator)) }
+	sort.Slice(sorted, func(i, j int) bool {
+		if di, dj := depth(sorted[i]), depth(sorted[j]); di != dj {
+			return di < dj
+		}
+		return sorted[i] < sorted[j]
+	})
+	kept := sorted[:w.maxDirs-1]
+	collapsed := sorted[w.maxDirs-1:]
+	ancestor := commonAncestor(collapsed)
+	res := map[string]struct{}{ancestor: {}}
+	for _, d := range kept {
+		res[d] = struct{}{}
+	}
+	if key := fmt.Sprintf("%d:%s", len(collapsed), ancestor); key != w.lastCollapse && w.warnf != nil {
+		w.lastCollapse = key
+		w.warnf("Warning: %d directories would be watched, more than --max-watch-dirs %d. %d of them were collapsed into '%s', so changes to the files in them are missed.\n", len(dirs), w.maxDirs, len(collapsed), ancestor)
+		w.warnf("Use '--poll', or raise '--max-watch-dirs' and the watch limit of the OS, to see all changes.\n")
+	}
+	return res
+}
+
+// commonAncestor returns the deepest directory that contains all the given
+// directories.
+func commonAncestor(dirs []string) string {
+	res := ""
+	for i, d := range dirs {
+		if abs, err := filepath.Abs(d); err == nil {
+			d = abs
+		}
+		if i == 0 {
+			res = d
+			continue
+		}
+		for res != filepath.Dir(res) && d != res && !strings.HasPrefix(d, res+string(filepath.Separator)) {
+			res = filepath.Dir(res)
+		}
+	}
+	return res
+}
+
+// defaultMaxWatchDirs returns the limit of watched directories if
+// '--max-watch-dirs' isn't given. Only inotify has a system wide limit, and
+// other programs need some of the watches as well. Zero means no limit.
+func defaultMaxWatchDirs(poll time.Duration) int {
+	if poll > 0 {
+		return 0
+	}
+	if limit, ok := inotifyWatchLimit(); ok {
+		return limit / 2
+	}
+	return 0
+}
+
+// watchAddError is returned when directories couldn't be added to the
+// underlying file watcher.
+type watchAddError struct {
+	errs []error
+}
+
+func (e *watchAddError) Error() string {
+	var msgs []string
+	for _, err := range e.errs {
+		msgs = append(msgs, err.Error())
+	}
+	return "failed to watch " + strings.Join(msgs, ", ")
+}
+
+// missing returns whether all directories failed because they don't exist.
+func (e *watchAddError) missing() bool {
+	for _, err := range e.errs {
+		if !errors.Is(err, os.ErrNotExist) {
+			return false
+		}
+	}
+	return true
+}
+
+// Rewatch makes sure that a watched path that was replaced on disk, for
+// example by an editor that saves through a rename, is still tracked.
+func (w *watcher) Rewatch(path string) error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	if _, ok := w.paths[path]; !ok {
+		return nil
+	}
+
+	// The path might have been renamed away, in which case there is
+	// nothing to resolve, but we still want to keep watching its directory.
+	if resolved, err := filepath.EvalSymlinks(path); err == nil && resolved != path {
+		w.paths[resolved] = struct{}{}
+		for _, deps := range w.deps {
+			if _, ok := deps[path]; ok {
+				deps[resolved] = struct{}{}
+			}
+		}
+		if err := w.watcher.Add(filepath.Dir(resolved)); err != nil {
+			return err
+		}
+		w.dirs[filepath.Dir(resolved)] = struct{}{}
+	}
+	return w.watcher.Add(filepath.Dir(path))
+}
+
+const (
+	// Number of consecutive failures to reach the device before we start
+	// backing off.
+	backoffThreshold = 3
+	backoffInitial   = 1 * time.Second
+	backoffMax       = 30 * time.Second
+
+	// How long an entrypoint may be missing before it counts as deleted.
+	// Editors that save through a rename remove the file for a moment.
+	entrypointGrace = 1 * time.Second
+
+	// How often to try to re-establish a failed watcher before giving up,
+	// and the delay before the first retry. The delay doubles with every
+	// retry.
+	watchRecoveryAttempts = 5
+	watchRecoveryDelay    = 1 * time.Second
+)
+
+// runBackoff keeps track of consecutive failures to send code to the
+// device, so watch doesn't hammer a device that is unreachable.
+type runBackoff struct {
+	sync.Mutex
+	failures int
+}
+
+func (b *runBackoff) fail() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures++
+}
+
+func (b *runBackoff) reset() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures = 0
+}
+
+func (b *runBackoff) count() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.failures
+}
+
+// delay returns how long to wait before the next run.
+func (b *runBackoff) delay() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	if b.failures < backoffThreshold {
+		return 0
+	}
+	delay := backoffInitial
+	for i := backoffThreshold; i < b.failures && delay < backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > backoffMax {
+		delay = backoffMax
+	}
+	return delay
+}
+
+// sdkReloader notices when the SDK is replaced during a watch session, for
+// example by 'jag setup', and loads it again so new runs use the new
+// toolchain.
+type sdkReloader struct {
+	sync.Mutex
+	sdk   *SDK
+	stamp time.Time
+	out   *watchOutput
+}
 
-			watcher, err := newWatcher()
-			if err != nil {
-				return err
-			}
-			defer watcher.Close()
+func newSDKReloader(sdk *SDK, out *watchOutput) *sdkReloader {
+	return &sdkReloader{
+		sdk:   sdk,
+		stamp: sdkStamp(sdk),
+		out:   out,
+	}
+}
 
-			waitCh, fn := onWatchChanges(cmd, watcher, device, sdk, entrypoint, programAssetsPath, optimizationLevel)
-			go fn()
+// sdkStamp returns the latest modification time of the files that change
+// when the SDK is installed.
+func sdkStamp(sdk *SDK) time.Time {
+	var res time.Time
+	for _, p := range []string{sdk.ToitPath(), sdk.DownloaderInfoPath()} {
+		if stat, err := os.Stat(p); err == nil && stat.ModTime().After(res) {
+			res = stat.ModTime()
+		}
+	}
+	return res
+}
 
-			<-waitCh
-			return nil
-		},
+// current returns the SDK to use for the next run. If the SDK changed on
+// disk, it is reloaded first. If the reload fails, for example because the
+// new SDK is still being installed, the old SDK is used and the reload is
+// retried next time.
+func (r *sdkReloader) current(ctx context.Context) *SDK {
+	r.Lock()
+	defer r.Unlock()
+	if sdkStamp(r.sdk).Equal(r.stamp) {
+		return r.sdk
 	}
-	cmd.Flags().StringP("device", "d", "", "use device with a given name, id, or address")
-	cmd.Flags().String("assets", "", "attach assets to the program")
-	cmd.Flags().IntP("optimization-level", "O", 1, "optimization level")
-	return cmd
+	sdk, err := GetSDK(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			r.out.errorf("Warning: the SDK changed, but it can't be loaded: %v\n", err)
+		}
+		return r.sdk
+	}
+	if sdk.Version != r.sdk.Version {
+		r.out.printf("The SDK changed from version %s to %s, reloaded it\n", r.sdk.Version, sdk.Version)
+	} else {
+		r.out.printf("The SDK in '%s' changed, reloaded it\n", sdk.Path)
+	}
+	r.sdk = sdk
+	r.stamp = sdkStamp(sdk)
+	return sdk
 }
 
-type watcher struct {
+// runSettings are the options of a run that are recomputed for every run,
+// since they can come from the project configuration, which can be edited
+// during the session.
+type runSettings struct {
+	optimizationLevel int
+}
+
+// runSettingsReloader reads the project configuration again for every run,
+// so changes to it are picked up by the next compile.
+type runSettingsReloader struct {
 	sync.Mutex
-	watcher *fsnotify.Watcher
+	entrypoints []string
+	// Set if the optimization level comes from the project configuration.
+	// Otherwise it was given on the command line and doesn't change.
+	reloadOptimizationLevel bool
+	settings                runSettings
+	out                     *watchOutput
+}
 
-	dirs  map[string]struct{}
-	paths map[string]struct{}
+func newRunSettingsReloader(entrypoints []string, optimizationLevel int, options watchOptions, out *watchOutput) *runSettingsReloader {
+	return &runSettingsReloader{
+		entrypoints:             entrypoints,
+		reloadOptimizationLevel: options.reloadOptimizationLevel,
+		settings:                runSettings{optimizationLevel: optimizationLevel},
+		out:                     out,
+	}
 }
 
-func newWatcher() (*watcher, error) {
-	w, err := fsnotify.NewWatcher()
+// current returns the settings for the next run. If the project
+// configuration can't be read, for example because it is being edited, the
+// previous settings are used.
+func (r *runSettingsReloader) current() runSettings {
+	r.Lock()
+	defer r.Unlock()
+	if !r.reloadOptimizationLevel {
+		return r.settings
+	}
+	// The configuration is small, so it is simply read again.
+	ctx, err := withProjectConfig(context.Background(), r.entrypoints...)
+	level := -1
+	if err == nil {
+		if config := projectConfigFromContext(ctx); config != nil {
+			if value, ok := config.Watch["optimization-level"]; ok {
+				level, err = parseOptimizationLevel(fmt.Sprint(value))
+				if err != nil {
+					err = fmt.Errorf("'%s': %w", config.path, err)
+				}
+			}
+		}
+	}
 	if err != nil {
-		return nil, err
+		r.out.errorf("Warning: the project configuration can't be loaded, keeping the previous settings: %v\n", err)
+		return r.settings
 	}
-	return &watcher{
-		watcher: w,
-		paths:   map[string]struct{}{},
-	}, nil
+	if level != r.settings.optimizationLevel {
+		r.out.printf("The optimization level changed from %s to %s\n", optimizationLevelName(r.settings.optimizationLevel), optimizationLevelName(level))
+		r.settings.optimizationLevel = level
+	}
+	return r.settings
 }
 
-func (w *watcher) Close() error {
-	return w.watcher.Close()
+// runTiming keeps track of how long a run took, from the moment the change
+// fired until the program was deployed.
+type runTiming struct {
+	sync.Mutex
+	start   time.Time
+	analyze time.Duration
 }
 
-func (w *watcher) Events() chan fsnotify.Event {
-	return w.watcher.Events
+func newRunTiming() *runTiming {
+	return &runTiming{start: time.Now()}
 }
 
-func (w *watcher) Errors() chan error {
-	return w.watcher.Errors
+func (t *runTiming) setAnalyze(d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	t.analyze = d
 }
 
-func (w *watcher) CountPaths() int {
-	return len(w.paths)
+// analyzeDuration returns the time the analyzer took, or 0 if it hasn't
+// finished yet.
+func (t *runTiming) analyzeDuration() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	return t.analyze
 }
 
-func (w *watcher) Watch(paths ...string) (err error) {
-	w.Mutex.Lock()
-	defer w.Mutex.Unlock()
+func roundDuration(d time.Duration) time.Duration {
+	return d.Round(100 * time.Millisecond)
+}
 
-	for i, p := range paths {
-		if paths[i], err = filepath.EvalSymlinks(p); err != nil {
-			return err
+func onWatchChanges(
+	cmd *cobra.Command,
+	watcher *watcher,
+	depFiles *dependencyFiles,
+	devices []Device,
+	sdk *SDK,
+	entrypoints []string,
+	assetsPaths []string,
+	optimizationLevel int,
+	options watchOptions) (<-chan error, func()) {
+	debounce := options.debounce
+	doneCh := make(chan error, 1)
+	ctx := cmd.Context()
+
+	backoffs := map[string]*runBackoff{}
+
+	// Every entrypoint depends on the assets files, so editing one of them
+	// re-runs all entrypoints.
+	assetsFiles := func() []string {
+		var res []string
+		for _, p := range assetsPaths {
+			if abs, err := filepath.Abs(p); err == nil {
+				p = abs
+			}
+			// An editor might be replacing the file right now. It is
+			// picked up again on the next change.
+			if _, err := os.Stat(p); err == nil {
+				res = append(res, p)
+			}
 		}
+		return res
+	}
+	for _, device := range devices {
+		backoffs[device.Name()] = &runBackoff{}
 	}
+	out := newWatchOutput(options)
+	watcher.maxDirs = options.maxWatchDirs
+	if watcher.maxDirs == 0 {
+		watcher.maxDirs = defaultMaxWatchDirs(options.poll)
+	}
+	watcher.warnf = out.errorf
+	sdks := newSDKReloader(sdk, out)
+	runOptions := newRunSettingsReloader(entrypoints, optimizationLevel, options, out)
+	// Held while the serial port is monitored, so the monitor of a new run
+	// waits for the old one to close the port.
+	var monitorMutex sync.Mutex
 
-	candidateDirs := map[string]struct{}{}
-	candidates := map[string]struct{}{}
-	for _, p := range paths {
-		dir := filepath.Dir(p)
-		w.paths[p] = struct{}{}
-		if _, ok := w.dirs[dir]; !ok {
-			w.watcher.Add(dir)
+	reportWatchError := func(err error) {
+		out.errorf("Failed to update watcher: %v\n", err)
+		var addErr *watchAddError
+		if errors.As(err, &addErr) && !addErr.missing() && runtime.GOOS == "linux" {
+			out.errorf("You might have reached the limit of inotify watches. You can raise it with:\n")
+			out.errorf("  $ sudo sysctl fs.inotify.max_user_watches=524288\n")
 		}
-		candidateDirs[dir] = struct{}{}
-		candidates[p] = struct{}{}
 	}
 
-	// Remove the files/watchers we don't need anymore.
-	for p := range w.paths {
-		if _, ok := candidates[p]; !ok {
-			delete(w.paths, p)
+	// The watched paths last printed for each entrypoint with '--no-run'.
+	var printedMutex sync.Mutex
+	printedPaths := map[string]string{}
+	printWatchedPaths := func(entrypoint string) {
+		dirs, files := watcher.WatchedBy(entrypoint)
+		key := strings.Join(dirs, "\n") + "\n\n" + strings.Join(files, "\n")
+		printedMutex.Lock()
+		defer printedMutex.Unlock()
+		if previous, ok := printedPaths[entrypoint]; ok && previous == key {
+			return
+		}
+		printedPaths[entrypoint] = key
+		out.emit(WatchEvent{Type: WatchEventDeps, Entrypoint: entrypoint, Files: files, Dirs: dirs})
+		out.printf("'%s' depends on %d files:\n", entrypoint, len(files))
+		for _, f := range files {
+			out.printf("  %s\n", f)
+		}
+		for _, d := range dirs {
+			out.printf("  %s (any Toit file)\n", d)
 		}
 	}
-	for d := range w.dirs {
-		if _, ok := candidateDirs[d]; !ok {
-			delete(w.dirs, d)
-			w.watcher.Remove(d)
+
+	// The entrypoints whose last run failed to compile.
+	var compileMutex sync.Mutex
+	compileFailed := map[string]bool{}
+	setCompileFailed := func(entrypoint string, failed bool) {
+		compileMutex.Lock()
+		defer compileMutex.Unlock()
+		compileFailed[entrypoint] = failed
+	}
+
+	// updateWatcher analyzes the entrypoint and watches its dependencies.
+	// Problems with the watcher are reported, and the first one is returned.
+	updateWatcher := func(runCtx context.Context, entrypoint string, timing *runTiming) (watchErr error) {
+		reportWatchError := func(err error) {
+			reportWatchError(err)
+			if watchErr == nil {
+				watchErr = err
+			}
+		}
+		if len(options.assetsDirs) > 0 {
+			// New subdirectories are picked up, since creating one re-runs
+			// the entrypoint.
+			var dirs []string
+			for _, d := range options.assetsDirs {
+				if abs, err := filepath.Abs(d); err == nil {
+					d = abs
+				}
+				dirs = append(dirs, assetsSubdirs(d)...)
+			}
+			if err := watcher.WatchAssetDirs(entrypoint, dirs...); err != nil {
+				reportWatchError(err)
+			}
+		}
+		if options.recursive {
+			dirs := treeDirs(projectRoot(entrypoint), options.ignores[entrypoint])
+			if err := watcher.WatchTree(entrypoint, dirs...); err != nil {
+				reportWatchError(err)
+			}
+		}
+		sdk := sdks.current(ctx)
+		// A newer change cancels runCtx, which kills a stale analysis, so
+		// analyzer processes don't pile up during rapid edits.
+		analyzeCtx := runCtx
+		if options.analyzeTimeout > 0 {
+			var cancel context.CancelFunc
+			analyzeCtx, cancel = context.WithTimeout(runCtx, options.analyzeTimeout)
+			defer cancel()
+		}
+		analyzeStart := time.Now()
+		paths, err := depFiles.analyze(analyzeCtx, sdk, entrypoint, out.errorf, out.verbosef)
+		timing.setAnalyze(time.Since(analyzeStart))
+		if err != nil && runCtx.Err() != nil {
+			// Superseded. The analysis of the newer change updates the
+			// watcher.
+			return nil
+		}
+		if err != nil && errors.Is(analyzeCtx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("analysis of '%s' timed out after %s", entrypoint, options.analyzeTimeout)
+			out.errorf("Warning: %v, keeping the files watched before\n", err)
+		}
+		if options.noRun {
+			defer func() {
+				if runCtx.Err() == nil {
+					printWatchedPaths(entrypoint)
+				}
+			}()
+		}
+		if out.verbose {
+			defer func() {
+				dirs, files := watcher.Watched()
+				out.verbosef("Watching %d directories and %d files:\n", len(dirs), len(files))
+				for _, d := range dirs {
+					out.verbosef("  dir:  %s\n", d)
+				}
+				for _, f := range files {
+					out.verbosef("  file: %s\n", f)
+				}
+			}()
+		}
+		var statErr *dependencyStatError
+		var execErr *analyzerExecError
+		if errors.As(err, &statErr) {
+			out.errorf("Warning: %v\n", err)
+		} else if errors.As(err, &execErr) {
+			// Only the directory of the entrypoint can be watched, so changes
+			// to imported files are missed until the SDK is fixed.
+			out.errorf("Error: %v\n", err)
+			out.errorf("The Toit SDK seems broken, so only changes in '%s' are seen.\n", filepath.Dir(entrypoint))
+			out.errorf("Run 'jag setup --check' to diagnose it.\n")
+			if err := watcher.WatchDirs(entrypoint, filepath.Dir(entrypoint)); err != nil {
+				reportWatchError(err)
+			}
+			if assets := assetsFiles(); len(assets) > 0 {
+				if err := watcher.Extend(entrypoint, assets...); err != nil {
+					reportWatchError(err)
+				}
+			}
+			return watchErr
+		} else if err != nil {
+			// A compilation error happened. We keep the paths we watched before,
+			// and add the ones from the partial dependency file. The fix might
+			// involve a new file that isn't a dependency yet, so we also watch
+			// the directories for new Toit files.
+			dirs := map[string]struct{}{filepath.Dir(entrypoint): {}}
+			for _, p := range paths {
+				dirs[filepath.Dir(p)] = struct{}{}
+			}
+			var dirList []string
+			for d := range dirs {
+				dirList = append(dirList, d)
+			}
+			if err := watcher.WatchDirs(entrypoint, dirList...); err != nil {
+				reportWatchError(err)
+			}
+			paths = append(paths, assetsFiles()...)
+			if len(paths) > 0 {
+				if err := watcher.Extend(entrypoint, paths...); err != nil {
+					reportWatchError(err)
+				}
+			}
+			return watchErr
+		}
+
+		var dirs []string
+		if len(paths) == 0 {
+			dirs = []string{filepath.Dir(entrypoint)}
 		}
+		if err := watcher.WatchDirs(entrypoint, dirs...); err != nil {
+			reportWatchError(err)
+		}
+
+		if err := watcher.Watch(entrypoint, append(paths, assetsFiles()...)...); err != nil {
+			reportWatchError(err)
+		}
+		return watchErr
 	}
-	return nil
-}
 
-func parseDependeniesToDirs(b []byte) []string {
-	m := map[string]struct{}{}
-	scanner := bufio.NewScanner(bytes.NewReader(b))
-	for scanner.Scan() {
-		p := strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ":")
-		if _, err := os.Stat(p); err == nil {
-			m[p] = struct{}{}
+	// runOnDevice runs the program on the device. The program is either
+	// the entrypoint itself, or a snapshot compiled from it.
+	runOnDevice := func(runCtx context.Context, sdk *SDK, settings runSettings, device Device, entrypoint string, program string, assetsPath string, changedFile string, timing *runTiming) error {
+		backoff := backoffs[device.Name()]
+		if delay := backoff.delay(); delay > 0 {
+			out.printf("Device '%s' failed %d times in a row, waiting %s before the next run ...\n", device.Name(), backoff.count(), delay)
+			select {
+			case <-time.After(delay):
+			case <-runCtx.Done():
+				return nil
+			}
+		}
+		out.emit(WatchEvent{Type: WatchEventRunStart, Entrypoint: entrypoint, File: changedFile, Device: device.Name()})
+		if options.restartDevice {
+			if err := rebootAndWait(runCtx, sdk, device, out.printf); err != nil {
+				if runCtx.Err() != nil {
+					return nil
+				}
+				backoff.fail()
+				exit := 1
+				out.emit(WatchEvent{Type: WatchEventRunEnd, Entrypoint: entrypoint, Device: device.Name(), Exit: &exit, Error: err.Error()})
+				out.printf("%s %v\n", out.paint(styleError, "Error:"), err)
+				return err
+			}
+		}
+		start := time.Now()
+		if options.runTimeout > 0 {
+			var cancel context.CancelFunc
+			runCtx, cancel = context.WithTimeout(runCtx, options.runTimeout)
+			defer cancel()
 		}
+		var err error
+		var stats deployStats
+		if program == entrypoint {
+			var result RunResult
+			result, err = RunFile(runCtx, cmd, device, sdk, entrypoint, options.name, options.defines, options.runArgs, assetsPath, settings.optimizationLevel)
+			stats = deployStats{snapshotSize: result.SnapshotSize, sentBytes: result.SentBytes}
+		} else {
+			infof(runCtx, "Running '%s' on '%s' ...\n", entrypoint, device.Name())
+			stats, err = sendCodeFromFile(runCtx, cmd, device, sdk, "/run", program, options.name, options.defines, options.runArgs, assetsPath, settings.optimizationLevel)
+		}
+		if err != nil && errors.Is(runCtx.Err(), context.Canceled) {
+			// A newer change superseded this run.
+			return nil
+		}
+		timedOut := err != nil && errors.Is(runCtx.Err(), context.DeadlineExceeded)
+		if timedOut {
+			err = fmt.Errorf("run of '%s' timed out after %s", entrypoint, options.runTimeout)
+		}
+		exit := 0
+		runDuration := time.Since(start)
+		durationMs := runDuration.Milliseconds()
+		if err != nil {
+			exit = 1
+			var sendErr *sendError
+			if errors.As(err, &sendErr) {
+				backoff.fail()
+				resetDeviceSession(device)
+			} else if !timedOut {
+				depFiles.invalidate(entrypoint)
+				setCompileFailed(entrypoint, true)
+				out.emit(WatchEvent{Type: WatchEventCompileError, Entrypoint: entrypoint, Device: device.Name(), Error: err.Error()})
+			}
+			out.emit(WatchEvent{Type: WatchEventRunEnd, Entrypoint: entrypoint, Device: device.Name(), Exit: &exit, DurationMs: &durationMs, Error: err.Error()})
+			if len(devices) > 1 {
+				out.printf("%s %v\n", out.paint(styleError, fmt.Sprintf("Error in '%s' on '%s':", entrypoint, device.Name())), err)
+			} else if len(entrypoints) > 1 {
+				out.printf("%s %v\n", out.paint(styleError, fmt.Sprintf("Error in '%s':", entrypoint)), err)
+			} else {
+				out.printf("%s %v\n", out.paint(styleError, "Error:"), err)
+			}
+			return err
+		}
+		backoff.reset()
+		total := time.Since(timing.start)
+		totalMs := total.Milliseconds()
+		event := WatchEvent{Type: WatchEventRunEnd, Entrypoint: entrypoint, Device: device.Name(), Exit: &exit, DurationMs: &durationMs, TotalMs: &totalMs}
+		summary := fmt.Sprintf("Run finished in %s", roundDuration(total))
+		if len(devices) > 1 {
+			summary = fmt.Sprintf("Run on '%s' finished in %s", device.Name(), roundDuration(total))
+		}
+		if analyze := timing.analyzeDuration(); analyze > 0 {
+			analyzeMs := analyze.Milliseconds()
+			event.AnalyzeMs = &analyzeMs
+			summary += fmt.Sprintf(" (analyze %s, run %s)", roundDuration(analyze), roundDuration(runDuration))
+		}
+		// Showing the sizes makes it easy to spot size regressions while
+		// editing.
+		event.SnapshotSize = &stats.snapshotSize
+		event.SentBytes = &stats.sentBytes
+		summary += fmt.Sprintf(", snapshot %s, sent %s", formatSize(stats.snapshotSize), formatSize(int64(stats.sentBytes)))
+		out.emit(event)
+		out.printf("%s\n", out.paint(styleSuccess, summary))
+		return nil
 	}
-	var res []string
-	for r := range m {
-		res = append(res, r)
+
+	// saveSnapshot copies a successfully compiled snapshot to the
+	// '--snapshot' path, if any. Failures are reported, but don't fail
+	// the run.
+	saveSnapshot := func(entrypoint string, snapshot string) {
+		if options.snapshot == "" {
+			return
+		}
+		dest := options.snapshot
+		if options.snapshotIsDir {
+			base := strings.TrimSuffix(filepath.Base(entrypoint), filepath.Ext(entrypoint))
+			dest = filepath.Join(dest, base+"-"+time.Now().Format("20060102-150405")+".snapshot")
+		}
+		if err := copyFileAtomic(snapshot, dest); err != nil {
+			out.errorf("Failed to write snapshot to '%s': %v\n", dest, err)
+			return
+		}
+		out.printf("Wrote snapshot to '%s'\n", dest)
 	}
-	return res
-}
 
-func onWatchChanges(
-	cmd *cobra.Command,
-	watcher *watcher,
-	device Device,
-	sdk *SDK,
-	entrypoint string,
-	assetsPath string,
-	optimizationLevel int) (<-chan struct{}, func()) {
-	doneCh := make(chan struct{})
-	ctx := cmd.Context()
+	// buildEntrypoint compiles the entrypoint without running it. Used
+	// for '--build-only'.
+	buildEntrypoint := func(runCtx context.Context, sdk *SDK, settings runSettings, entrypoint string, changedFile string, timing *runTiming) error {
+		tempdir, err := os.MkdirTemp("", "jag_watch")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tempdir)
+
+		out.emit(WatchEvent{Type: WatchEventRunStart, Entrypoint: entrypoint, File: changedFile})
+		out.printf("Compiling '%s' ...\n", entrypoint)
+		start := time.Now()
+		snapshot := filepath.Join(tempdir, "watch.snapshot")
+		err = sdk.Compile(runCtx, snapshot, entrypoint, settings.optimizationLevel)
+		if err != nil && runCtx.Err() != nil {
+			// A newer change superseded this build.
+			return nil
+		}
+		exit := 0
+		durationMs := time.Since(start).Milliseconds()
+		if err != nil {
+			exit = 1
+			depFiles.invalidate(entrypoint)
+			setCompileFailed(entrypoint, true)
+			out.emit(WatchEvent{Type: WatchEventCompileError, Entrypoint: entrypoint, Error: err.Error()})
+			out.emit(WatchEvent{Type: WatchEventRunEnd, Entrypoint: entrypoint, Exit: &exit, DurationMs: &durationMs, Error: err.Error()})
+			out.printf("%s\n", out.paint(styleError, fmt.Sprintf("Failed to compile '%s'", entrypoint)))
+			return fmt.Errorf("failed to compile '%s': %w", entrypoint, err)
+		}
+		saveSnapshot(entrypoint, snapshot)
+		total := time.Since(timing.start)
+		totalMs := total.Milliseconds()
+		event := WatchEvent{Type: WatchEventRunEnd, Entrypoint: entrypoint, Exit: &exit, DurationMs: &durationMs, TotalMs: &totalMs}
+		summary := fmt.Sprintf("Build finished in %s", roundDuration(total))
+		if stat, err := os.Stat(snapshot); err == nil {
+			size := stat.Size()
+			event.SnapshotSize = &size
+			summary += fmt.Sprintf(", snapshot %s", formatSize(size))
+		}
+		out.emit(event)
+		out.printf("%s\n", out.paint(styleSuccess, summary))
+		return nil
+	}
+
+	// afterRun runs the '--after-run' command for a run on a device. It is
+	// killed when a newer change cancels the run context. Its failure
+	// doesn't change the result of the run.
+	afterRun := func(runCtx context.Context, entrypoint string, device Device, runErr error) {
+		if options.afterRun == "" || runCtx.Err() != nil {
+			// A superseded run has no result.
+			return
+		}
+		exit := 0
+		if runErr != nil {
+			exit = 1
+		}
+		env := []string{
+			fmt.Sprintf("%s=%d", runExitEnv, exit),
+			entrypointEnv + "=" + entrypoint,
+			deviceEnv + "=" + device.Name(),
+		}
+		if err := runHook(runCtx, options.afterRun, env...); err != nil && runCtx.Err() == nil {
+			out.printf("Error: --after-run command failed: %v\n", err)
+		}
+	}
 
-	updateWatcher := func(runCtx context.Context) {
-		var paths []string
-		if tmpFile, err := os.CreateTemp("", "*.txt"); err == nil {
-			defer os.Remove(tmpFile.Name())
-			tmpFile.Close()
-			cmd := sdk.ToitAnalyze(ctx, "--dependency-file", tmpFile.Name(), "--dependency-format", "plain", entrypoint)
-			if err := cmd.Run(); err == nil {
-				if b, err := os.ReadFile(tmpFile.Name()); err == nil {
-					paths = parseDependeniesToDirs(b)
+	// runEntrypoint runs the entrypoint on all devices. Each device gets its
+	// own context, so a slow device doesn't hold up the others.
+	runEntrypoint := func(runCtx context.Context, entrypoint string, changedFile string, timing *runTiming) error {
+		if options.noRun {
+			// The watched paths are printed by updateWatcher.
+			return nil
+		}
+		if options.clear {
+			clearScreen()
+		}
+		if options.onChange != "" {
+			if err := runHook(runCtx, options.onChange, changedFileEnv+"="+changedFile); err != nil {
+				if runCtx.Err() == nil {
+					out.printf("Error: --on-change command failed, skipping run: %v\n", err)
 				}
-			} else {
-				// A compilation error happened, we let the watch paths be if there was some.
-				if watcher.CountPaths() > 0 {
-					return
+				return err
+			}
+		}
+		sdk := sdks.current(runCtx)
+		settings := runOptions.current()
+		if options.buildOnly {
+			return buildEntrypoint(runCtx, sdk, settings, entrypoint, changedFile, timing)
+		}
+		// Merge the assets for every run, so changes to them are picked up.
+		assetsPath, cleanupAssets, err := prepareAssets(runCtx, sdk, assetsPaths, options.assetsDirs, options.assetsOverwrite)
+		if err != nil {
+			if runCtx.Err() != nil {
+				return nil
+			}
+			out.errorf("Error: %v\n", err)
+			return err
+		}
+		defer cleanupAssets()
+		program := entrypoint
+		if options.snapshot != "" {
+			// Compile once, so the snapshot that is written is the one that
+			// runs on the devices.
+			tempdir, err := os.MkdirTemp("", "jag_watch")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tempdir)
+			program = filepath.Join(tempdir, "watch.snapshot")
+			if err := sdk.Compile(runCtx, program, entrypoint, settings.optimizationLevel); err != nil {
+				if runCtx.Err() != nil {
+					return nil
 				}
+				exit := 1
+				depFiles.invalidate(entrypoint)
+				setCompileFailed(entrypoint, true)
+				out.emit(WatchEvent{Type: WatchEventCompileError, Entrypoint: entrypoint, Error: err.Error()})
+				out.emit(WatchEvent{Type: WatchEventRunEnd, Entrypoint: entrypoint, Exit: &exit, Error: err.Error()})
+				out.printf("%s\n", out.paint(styleError, fmt.Sprintf("Failed to compile '%s'", entrypoint)))
+				return fmt.Errorf("failed to compile '%s': %w", entrypoint, err)
 			}
+			saveSnapshot(entrypoint, program)
+		}
+		if len(devices) == 1 {
+			err := runOnDevice(runCtx, sdk, settings, devices[0], entrypoint, program, assetsPath, changedFile, timing)
+			afterRun(runCtx, entrypoint, devices[0], err)
+			if err == nil && options.monitorPort != "" {
+				go monitorSerialLog(runCtx, out, &monitorMutex, options.monitorPort, options.monitorBaud)
+			}
+			return err
 		}
 
-		if len(paths) == 0 {
-			paths = []string{filepath.Dir(entrypoint)}
+		var wg sync.WaitGroup
+		errs := make([]error, len(devices))
+		for i, device := range devices {
+			wg.Add(1)
+			go func(i int, device Device) {
+				defer wg.Done()
+				deviceCtx, cancel := context.WithCancel(runCtx)
+				defer cancel()
+				errs[i] = runOnDevice(deviceCtx, sdk, settings, device, entrypoint, program, assetsPath, changedFile, timing)
+				afterRun(deviceCtx, entrypoint, device, errs[i])
+			}(i, device)
 		}
+		wg.Wait()
 
-		if err := watcher.Watch(paths...); err != nil {
-			fmt.Println("Failed to update watcher: ", err)
+		failed := 0
+		for _, err := range errs {
+			if err != nil {
+				failed++
+			}
 		}
+		if failed > 0 {
+			return fmt.Errorf("running '%s' failed on %d of %d devices", entrypoint, failed, len(devices))
+		}
+		return nil
 	}
 
-	runOnDevice := func(runCtx context.Context) {
-		if err := RunFile(cmd, device, sdk, entrypoint, nil, assetsPath, optimizationLevel); err != nil {
-			fmt.Println("Error:", err)
-			return
+	// runChecked runs the entrypoint, and returns whether it failed to
+	// compile. The watch goes on after a compile error, waiting for the
+	// change that fixes it, which is said explicitly, since the error is
+	// the last thing printed.
+	runChecked := func(runCtx context.Context, entrypoint string, changedFile string, timing *runTiming) (bool, error) {
+		setCompileFailed(entrypoint, false)
+		err := runEntrypoint(runCtx, entrypoint, changedFile, timing)
+		if runCtx.Err() != nil {
+			return false, err
 		}
+		compileMutex.Lock()
+		failed := compileFailed[entrypoint]
+		compileMutex.Unlock()
+		if failed && (!options.once || options.ignoreInitialError) {
+			out.printf("Waiting for changes to fix the compile error in '%s' ...\n", entrypoint)
+		}
+		return failed, err
 	}
 
-	firstCtx, previousCancel := context.WithCancel(ctx)
-	go updateWatcher(firstCtx)
-	runOnDevice(firstCtx)
+	previousCancels := map[string]context.CancelFunc{}
+	// Closed when the last run of the entrypoint has returned.
+	previousDones := map[string]chan struct{}{}
+	var firstUpdates sync.WaitGroup
+	var firstErr error
+	// The entrypoints whose first run failed to compile, with
+	// '--ignore-initial-error'. The watch stops once they all compiled.
+	broken := map[string]bool{}
+	for _, entrypoint := range entrypoints {
+		firstCtx, cancel := context.WithCancel(ctx)
+		previousCancels[entrypoint] = cancel
+		timing := newRunTiming()
+		firstUpdates.Add(1)
+		go func(entrypoint string) {
+			defer firstUpdates.Done()
+			updateWatcher(firstCtx, entrypoint, timing)
+		}(entrypoint)
+		failed, err := runChecked(firstCtx, entrypoint, "", timing)
+		if failed && options.ignoreInitialError {
+			broken[entrypoint] = true
+		} else if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		done := make(chan struct{})
+		close(done)
+		previousDones[entrypoint] = done
+	}
+	if options.once && len(broken) == 0 {
+		return doneCh, func() {
+			defer close(doneCh)
+			firstUpdates.Wait()
+			for _, cancel := range previousCancels {
+				cancel()
+			}
+			doneCh <- firstErr
+		}
+	}
+	// The results of the runs of the entrypoints in broken.
+	type fixResult struct {
+		entrypoint string
+		failed     bool
+		err        error
+	}
+	fixResults := make(chan fixResult)
 	return doneCh, func() {
 		defer close(doneCh)
-		fired := false
-		ticketDuration := 100 * time.Millisecond
-		ticker := time.NewTicker(ticketDuration)
-		defer ticker.Stop()
+		defer func() {
+			for _, cancel := range previousCancels {
+				cancel()
+			}
+		}()
+		rerun := func(entrypoint string, changedFile string) {
+			if len(entrypoints) > 1 {
+				out.printf("Re-running '%s'\n", entrypoint)
+			}
+			previousCancels[entrypoint]()
+			previousDone := previousDones[entrypoint]
+			innerCtx, cancel := context.WithCancel(ctx)
+			previousCancels[entrypoint] = cancel
+			done := make(chan struct{})
+			previousDones[entrypoint] = done
+			timing := newRunTiming()
+			// The analysis starts right away, overlapping with the
+			// cancellation of the previous run. The new run only starts
+			// once both are done, so the files it compiles are the ones
+			// that are watched, and it never races the previous run on the
+			// device.
+			analyzed := make(chan struct{})
+			go func() {
+				defer close(analyzed)
+				updateWatcher(innerCtx, entrypoint, timing)
+			}()
+			go func() {
+				defer close(done)
+				// The previous run has been cancelled, so it returns soon.
+				// Waiting for it even if this run is cancelled as well keeps
+				// the runs in order.
+				<-previousDone
+				select {
+				case <-analyzed:
+				case <-innerCtx.Done():
+					return
+				}
+				failed, err := runChecked(innerCtx, entrypoint, changedFile, timing)
+				if !options.once || innerCtx.Err() != nil {
+					return
+				}
+				select {
+				case fixResults <- fixResult{entrypoint, failed, err}:
+				case <-innerCtx.Done():
+				}
+			}()
+		}
+
+		// reestablish adds all directories to the watcher again and
+		// recomputes the dependencies, after the watcher failed. Since
+		// changes might have been missed, all entrypoints are re-run. It gives
+		// up after watchRecoveryAttempts failed attempts.
+		reestablish := func(reason error) error {
+			out.errorf("Re-establishing the watcher ...\n")
+			delay := watchRecoveryDelay
+			for attempt := 1; ; attempt++ {
+				watcher.Reset()
+				var err error
+				for _, entrypoint := range entrypoints {
+					if updateErr := updateWatcher(ctx, entrypoint, newRunTiming()); err == nil {
+						err = updateErr
+					}
+				}
+				if err == nil {
+					break
+				}
+				if attempt == watchRecoveryAttempts {
+					return fmt.Errorf("the watcher failed (%v), and it couldn't be re-established after %d attempts: %w", reason, attempt, err)
+				}
+				out.errorf("Failed to re-establish the watcher, retrying in %s\n", delay)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return nil
+				}
+				delay *= 2
+			}
+			out.printf("Re-established the watcher, re-running in case changes were missed\n")
+			for _, entrypoint := range entrypoints {
+				rerun(entrypoint, "")
+			}
+			return nil
+		}
+
+		// The files the entrypoints point to. If an entrypoint is a symlink,
+		// or is in a symlinked directory, re-pointing the link re-runs it.
+		targets := map[string]string{}
+		watchLinks := func(entrypoint string) {
+			if err := watcher.WatchLinks(entrypoint, symlinkComponents(entrypoint)...); err != nil {
+				reportWatchError(err)
+			}
+		}
+		for _, entrypoint := range entrypoints {
+			watchLinks(entrypoint)
+			targets[entrypoint] = resolveEntrypoint(entrypoint)
+		}
+
+		// The entrypoints that were deleted, with '--wait-for-entrypoint'.
+		missing := map[string]bool{}
+		missingTimer := time.NewTimer(entrypointGrace)
+		if !missingTimer.Stop() {
+			<-missingTimer.C
+		}
+		defer missingTimer.Stop()
+		// checkEntrypoints reports entrypoints that were deleted. It returns
+		// an error if the watch must stop.
+		checkEntrypoints := func() error {
+			for _, entrypoint := range entrypoints {
+				if _, err := os.Stat(entrypoint); err == nil || !os.IsNotExist(err) || missing[entrypoint] {
+					continue
+				}
+				out.emit(WatchEvent{Type: WatchEventDeleted, Entrypoint: entrypoint})
+				if !options.waitForEntrypoint {
+					out.errorf("The entrypoint '%s' was deleted, stopping the watch\n", entrypoint)
+					return fmt.Errorf("the entrypoint '%s' was deleted", entrypoint)
+				}
+				out.printf("The entrypoint '%s' was deleted, waiting for it to be created again ...\n", entrypoint)
+				missing[entrypoint] = true
+				// Until it is analyzed again, any Toit file created in its
+				// directory might be the entrypoint.
+				if err := watcher.WatchDirs(entrypoint, filepath.Dir(entrypoint)); err != nil {
+					reportWatchError(err)
+				}
+			}
+			return nil
+		}
+
+		// With the trailing debounce every relevant event restarts the
+		// timer, and the entrypoints only re-run once no new events arrived
+		// for the debounce duration. A burst of writes, like a git checkout,
+		// thus leads to a single run. With the global debounce the timer is
+		// only started by the first event of a burst, so later events can't
+		// delay the run.
+		var changedFiles []string
+		pending := map[string]string{}
+		timer := time.NewTimer(debounce)
+		if !timer.Stop() {
+			<-timer.C
+		}
+		defer timer.Stop()
+		timerRunning := false
+		fire := func() {
+			for _, entrypoint := range entrypoints {
+				target := resolveEntrypoint(entrypoint)
+				if target == "" || target == targets[entrypoint] {
+					continue
+				}
+				if targets[entrypoint] != "" {
+					out.printf("'%s' now points to '%s'\n", entrypoint, target)
+				}
+				targets[entrypoint] = target
+				watchLinks(entrypoint)
+				if _, ok := pending[entrypoint]; !ok {
+					pending[entrypoint] = entrypoint
+				}
+			}
+			for _, f := range changedFiles {
+				out.printf("%s\n", out.paint(styleChange, fmt.Sprintf("File modified '%s'", f)))
+				out.emit(WatchEvent{Type: WatchEventChanged, File: f})
+			}
+			for _, entrypoint := range entrypoints {
+				changedFile, ok := pending[entrypoint]
+				if !ok {
+					continue
+				}
+				if missing[entrypoint] {
+					if _, err := os.Stat(entrypoint); err != nil {
+						// Still gone. Running it would only fail.
+						continue
+					}
+					delete(missing, entrypoint)
+				}
+				rerun(entrypoint, changedFile)
+			}
+			changedFiles = nil
+			pending = map[string]string{}
+		}
+
 		for {
 			select {
 			case event, ok := <-watcher.Events():
 				if !ok {
 					return
 				}
-				if _, ok = watcher.paths[event.Name]; !ok {
+				out.verbosef("Event: %s %s\n", event.Op, event.Name)
+				if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && watcher.IsWatchedDir(event.Name) {
+					// The watch of the directory is gone with it.
+					reason := fmt.Errorf("the watched directory '%s' was removed", event.Name)
+					out.errorf("Watch error: %v\n", reason)
+					if err := reestablish(reason); err != nil {
+						doneCh <- err
+						return
+					}
+					continue
+				}
+				if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+					// The file might have been an entrypoint. It is checked
+					// once it had time to come back.
+					if !missingTimer.Stop() {
+						select {
+						case <-missingTimer.C:
+						default:
+						}
+					}
+					missingTimer.Reset(entrypointGrace)
+				}
+				if options.recursive && event.Op&fsnotify.Create != 0 {
+					if stat, err := os.Stat(event.Name); err == nil && stat.IsDir() {
+						// Toit files created in the new directory are picked up
+						// once it is watched.
+						for _, entrypoint := range entrypoints {
+							if watcher.InTree(entrypoint, event.Name) && !options.ignores[entrypoint].Match(event.Name) {
+								if err := watcher.ExtendTree(entrypoint, treeDirs(event.Name, options.ignores[entrypoint])...); err != nil {
+									reportWatchError(err)
+								}
+							}
+						}
+					}
+				}
+				if !watcher.IsWatched(event.Name) {
 					// Not a file we are watching.
 					continue
 				}
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					if !fired {
-						fmt.Printf("File modified '%s'\n", event.Name)
-						previousCancel()
-						var innerCtx context.Context
-						innerCtx, previousCancel = context.WithCancel(ctx)
-						go updateWatcher(innerCtx)
-						go runOnDevice(innerCtx)
-						fired = true
-						ticker.Reset(ticketDuration)
+				if event.Op&fsnotify.Remove == fsnotify.Remove {
+					// Some editors delete the file and create it again when saving.
+					// Make sure we still watch its directory, so the create that
+					// follows is seen and re-resolved.
+					if err := watcher.Rewatch(event.Name); err != nil {
+						reportWatchError(err)
+					}
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					if event.Op&(fsnotify.Create|fsnotify.Rename) != 0 {
+						// Editors that save atomically write to a temporary file and
+						// rename it over the original.
+						if err := watcher.Rewatch(event.Name); err != nil {
+							reportWatchError(err)
+						}
 					}
+					relevant := false
+					for _, entrypoint := range entrypoints {
+						if !watcher.DependsOn(entrypoint, event.Name) {
+							continue
+						}
+						if options.ignores[entrypoint].Match(event.Name) {
+							continue
+						}
+						pending[entrypoint] = event.Name
+						relevant = true
+					}
+					if !relevant {
+						continue
+					}
+					found := false
+					for _, f := range changedFiles {
+						if f == event.Name {
+							found = true
+							break
+						}
+					}
+					if !found {
+						changedFiles = append(changedFiles, event.Name)
+					}
+					if debounce == 0 {
+						fire()
+						continue
+					}
+					if timerRunning && options.debounceMode == debounceGlobal {
+						continue
+					}
+					timerRunning = true
+					if !timer.Stop() {
+						select {
+						case <-timer.C:
+						default:
+						}
+					}
+					timer.Reset(debounce)
+				}
+			case result := <-fixResults:
+				if result.failed || !broken[result.entrypoint] {
+					continue
+				}
+				delete(broken, result.entrypoint)
+				if result.err != nil && firstErr == nil {
+					firstErr = result.err
+				}
+				if len(broken) == 0 {
+					doneCh <- firstErr
+					return
+				}
+			case <-timer.C:
+				timerRunning = false
+				fire()
+			case <-missingTimer.C:
+				if err := checkEntrypoints(); err != nil {
+					doneCh <- err
+					return
 				}
-			case <-ticker.C:
-				fired = false
 			case err, ok := <-watcher.Errors():
 				if !ok {
 					return
 				}
-				fmt.Println("Watch error:", err)
+				out.errorf("Watch error: %v\n", err)
+				if err := reestablish(err); err != nil {
+					doneCh <- err
+					return
+				}
 			case <-ctx.Done():
 				return
 			}
@@ -0,0 +1,45 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Magic numbers of filesystems that are known to not deliver inotify
+// events for changes made by other machines, from 'man 2 statfs'.
+var unreliableFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xfe534d42: "smb2",
+	0xff534d42: "cifs",
+	0x01021997: "9p",
+	0x65735546: "fuse",
+	0x6a656a63: "virtiofs",
+}
+
+// unreliableFilesystem returns the name of the filesystem of the path, if
+// file watching is known to be unreliable on it.
+func unreliableFilesystem(path string) (string, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return "", false
+	}
+	name, ok := unreliableFilesystems[uint32(stat.Type)]
+	return name, ok
+}
+
+// inotifyWatchLimit returns the maximum number of inotify watches per user.
+func inotifyWatchLimit() (int, bool) {
+	content, err := os.ReadFile("/proc/sys/fs/inotify/max_user_watches")
+	if err != nil {
+		return 0, false
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	return limit, err == nil
+}
@@ -0,0 +1,20 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package commands
+
+// unreliableFilesystem returns the name of the filesystem of the path, if
+// file watching is known to be unreliable on it. Only implemented on Linux.
+func unreliableFilesystem(path string) (string, bool) {
+	return "", false
+}
+
+// inotifyWatchLimit returns the maximum number of inotify watches per user.
+// Only Linux uses inotify.
+func inotifyWatchLimit() (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// pollWatcher is a replacement for fsnotify on filesystems that don't
+// deliver change notifications, like NFS or SMB. It periodically lists the
+// watched directories and reports the same events fsnotify would.
+type pollWatcher struct {
+	sync.Mutex
+	interval time.Duration
+	dirs     map[string]map[string]pollFileState
+
+	Events chan fsnotify.Event
+	Errors chan error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type pollFileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func newPollWatcher(interval time.Duration) *pollWatcher {
+	w := &pollWatcher{
+		interval: interval,
+		dirs:     map[string]map[string]pollFileState{},
+		Events:   make(chan fsnotify.Event),
+		Errors:   make(chan error),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *pollWatcher) Add(dir string) error {
+	w.Lock()
+	defer w.Unlock()
+	if _, ok := w.dirs[dir]; ok {
+		return nil
+	}
+	files, err := scanPollDir(dir)
+	if err != nil {
+		return err
+	}
+	w.dirs[dir] = files
+	return nil
+}
+
+func (w *pollWatcher) Remove(dir string) error {
+	w.Lock()
+	defer w.Unlock()
+	delete(w.dirs, dir)
+	return nil
+}
+
+func (w *pollWatcher) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	return nil
+}
+
+func (w *pollWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, event := range w.poll() {
+				select {
+				case w.Events <- event:
+				case <-w.done:
+					return
+				}
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// poll lists all watched directories and returns the events for the files
+// that changed since the last poll.
+func (w *pollWatcher) poll() []fsnotify.Event {
+	w.Lock()
+	var dirs []string
+	for dir := range w.dirs {
+		dirs = append(dirs, dir)
+	}
+	w.Unlock()
+
+	var events []fsnotify.Event
+	for _, dir := range dirs {
+		// Listing the directory happens without the lock, so the
+		// directory might have been removed from the watch set meanwhile.
+		files, err := scanPollDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			continue
+		}
+
+		w.Lock()
+		old, ok := w.dirs[dir]
+		if ok {
+			for name, state := range files {
+				p := filepath.Join(dir, name)
+				if oldState, ok := old[name]; !ok {
+					events = append(events, fsnotify.Event{Name: p, Op: fsnotify.Create})
+				} else if oldState != state {
+					events = append(events, fsnotify.Event{Name: p, Op: fsnotify.Write})
+				}
+			}
+			for name := range old {
+				if _, ok := files[name]; !ok {
+					events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Remove})
+				}
+			}
+			w.dirs[dir] = files
+		}
+		w.Unlock()
+	}
+	return events
+}
+
+func scanPollDir(dir string) (map[string]pollFileState, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return map[string]pollFileState{}, err
+	}
+	res := map[string]pollFileState{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// The file was removed while listing.
+			continue
+		}
+		res[entry.Name()] = pollFileState{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		}
+	}
+	return res, nil
+}
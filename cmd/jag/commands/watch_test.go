@@ -0,0 +1,1234 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fakeFileWatcher records the directories that are added to it. The
+// events of the watcher that uses it are fed through its channels.
+type fakeFileWatcher struct {
+	sync.Mutex
+	events chan fsnotify.Event
+	errors chan error
+	// The number of times each directory was added.
+	added map[string]int
+	// The directories that are currently watched.
+	watched map[string]struct{}
+	// Returns the error for adding the directory, if any.
+	failAdd func(dir string) error
+}
+
+func newFakeFileWatcher() *fakeFileWatcher {
+	return &fakeFileWatcher{
+		events:  make(chan fsnotify.Event),
+		errors:  make(chan error),
+		added:   map[string]int{},
+		watched: map[string]struct{}{},
+	}
+}
+
+// newFakeWatcher returns a watcher that uses a fake file watcher.
+func newFakeWatcher() (*watcher, *fakeFileWatcher) {
+	fake := newFakeFileWatcher()
+	return newWatcherWith(fake, fake.events, fake.errors), fake
+}
+
+func (f *fakeFileWatcher) Add(name string) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.failAdd != nil {
+		if err := f.failAdd(name); err != nil {
+			return err
+		}
+	}
+	f.added[name]++
+	f.watched[name] = struct{}{}
+	return nil
+}
+
+func (f *fakeFileWatcher) Remove(name string) error {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.watched, name)
+	return nil
+}
+
+func (f *fakeFileWatcher) Close() error {
+	return nil
+}
+
+// addCount returns the number of times the directory was added.
+func (f *fakeFileWatcher) addCount(dir string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.added[dir]
+}
+
+func (f *fakeFileWatcher) isWatched(dir string) bool {
+	f.Lock()
+	defer f.Unlock()
+	_, ok := f.watched[dir]
+	return ok
+}
+
+func TestWatcherAddFailure(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good")
+	bad := filepath.Join(dir, "bad")
+	createFiles(t, dir, "good/main.toit", "bad/dep.toit")
+
+	w, fake := newFakeWatcher()
+	limit := errors.New("no space left on device")
+	fake.failAdd = func(d string) error {
+		if d == bad {
+			return limit
+		}
+		return nil
+	}
+
+	err := w.Watch("main.toit", filepath.Join(good, "main.toit"), filepath.Join(bad, "dep.toit"))
+	var addErr *watchAddError
+	if !errors.As(err, &addErr) {
+		t.Fatalf("got %v, want a *watchAddError", err)
+	}
+	if !errors.Is(addErr.errs[0], limit) || len(addErr.errs) != 1 {
+		t.Errorf("got %v, want only the error of '%s'", addErr.errs, bad)
+	}
+	if addErr.missing() {
+		t.Errorf("the directory exists, but the error says it's missing")
+	}
+	if dirs, _ := w.Watched(); !reflect.DeepEqual(dirs, []string{good}) {
+		t.Errorf("watched %v, want only '%s'", dirs, good)
+	}
+
+	// The failed directory is retried on the next update.
+	fake.failAdd = nil
+	if err := w.Extend("main.toit"); err != nil {
+		t.Fatal(err)
+	}
+	if dirs, _ := w.Watched(); !reflect.DeepEqual(dirs, []string{bad, good}) {
+		t.Errorf("watched %v, want '%s' and '%s'", dirs, bad, good)
+	}
+	if !fake.isWatched(bad) {
+		t.Errorf("'%s' wasn't added again", bad)
+	}
+}
+
+func TestWatcherAddMissing(t *testing.T) {
+	dir := t.TempDir()
+	createFiles(t, dir, "main.toit")
+	w, fake := newFakeWatcher()
+	missing := filepath.Join(dir, "missing")
+	fake.failAdd = func(d string) error {
+		if d == missing {
+			return &os.PathError{Op: "add", Path: d, Err: os.ErrNotExist}
+		}
+		return nil
+	}
+	err := w.WatchDirs("main.toit", missing)
+	var addErr *watchAddError
+	if !errors.As(err, &addErr) || !addErr.missing() {
+		t.Errorf("got %v, want a *watchAddError for a missing directory", err)
+	}
+}
+
+func TestWatcherAddsDirectoriesOnce(t *testing.T) {
+	dir := t.TempDir()
+	createFiles(t, dir, "main.toit", "a.toit", "lib/b.toit", "lib/c.toit", "other/d.toit")
+	p := func(name string) string { return filepath.Join(dir, name) }
+
+	w, fake := newFakeWatcher()
+	for i := 0; i < 3; i++ {
+		if err := w.Watch("main.toit", p("main.toit"), p("a.toit"), p("lib/b.toit")); err != nil {
+			t.Fatal(err)
+		}
+		// Overlaps with the directories of the first entrypoint.
+		if err := w.Watch("other.toit", p("lib/c.toit"), p("other/d.toit"), p("main.toit")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []string{dir, p("lib"), p("other")} {
+		if n := fake.addCount(d); n != 1 {
+			t.Errorf("'%s' was added %d times, want once", d, n)
+		}
+	}
+
+	// A directory that is dropped and needed again is added again.
+	if err := w.Watch("other.toit", p("main.toit")); err != nil {
+		t.Fatal(err)
+	}
+	if fake.isWatched(p("other")) {
+		t.Errorf("'%s' is still watched", p("other"))
+	}
+	if err := w.Watch("other.toit", p("other/d.toit")); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.addCount(p("other")); n != 2 {
+		t.Errorf("'%s' was added %d times, want twice", p("other"), n)
+	}
+	if n := fake.addCount(dir); n != 1 {
+		t.Errorf("'%s' was added %d times, want once", dir, n)
+	}
+}
+
+// fakeToit stands in for the toit executable of an SDK. The dependencies of
+// a file are the absolute paths on its lines that start with "import " or
+// "uses ". A file that contains "broken", or imports a file that is broken
+// or doesn't exist, doesn't compile. Used files don't have to exist. The
+// analysis of an entrypoint with an "analyze-delay <seconds>" line takes
+// that long. The arguments of every compilation are appended to compile.log
+// next to the executable.
+const fakeToit = `#!/bin/sh
+deps() {
+  sed -n 's/^import //p; s/^uses //p' "$1" 2>/dev/null
+}
+broken() {
+  grep -q broken "$1" 2>/dev/null && return 0
+  for f in $(sed -n 's/^import //p' "$1" 2>/dev/null); do
+    [ -f "$f" ] || return 0
+    grep -q broken "$f" && return 0
+  done
+  return 1
+}
+case "$1" in
+analyze)
+  # analyze --dependency-file <file> --dependency-format <format> <entrypoint>
+  delay=$(sed -n 's/^analyze-delay //p' "$6" 2>/dev/null)
+  # An orphaned sleep must not keep the pipes open once the script is
+  # killed.
+  [ -n "$delay" ] && sleep "$delay" < /dev/null > /dev/null 2>&1
+  { echo "$6:"; deps "$6" | sed 's/^/  /'; } > "$3"
+  if [ ! -f "$6" ] || broken "$6"; then
+    exit 1
+  fi
+  ;;
+compile)
+  # compile --snapshot -o <snapshot> [-O<level>] <entrypoint>
+  eval entry=\${$#}
+  echo "$@" >> "$(dirname "$0")/compile.log"
+  if [ ! -f "$entry" ] || broken "$entry"; then
+    exit 1
+  fi
+  echo snapshot > "$4"
+  ;;
+*)
+  exit 2
+  ;;
+esac
+`
+
+// newFakeSDK returns an SDK whose toit executable is fakeToit.
+func newFakeSDK(tb testing.TB) *SDK {
+	tb.Helper()
+	if runtime.GOOS == "windows" {
+		tb.Skip("the fake SDK is a shell script")
+	}
+	dir := tb.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "bin"), 0755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bin", "toit"), []byte(fakeToit), 0755); err != nil {
+		tb.Fatal(err)
+	}
+	return &SDK{Path: dir, Version: "v0.0.0-test"}
+}
+
+// writeFile writes the file, creating its directory.
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sessionTimeout bounds the waits for the events of a session.
+const sessionTimeout = 10 * time.Second
+
+// watchSession is a 'jag watch --build-only' session with a fake SDK and a
+// fake file watcher, so tests decide which changes it sees.
+type watchSession struct {
+	t       *testing.T
+	sdk     *SDK
+	watcher *watcher
+	fake    *fakeFileWatcher
+	events  chan WatchEvent
+	done    <-chan error
+	cancel  context.CancelFunc
+}
+
+// startWatchSession starts a session for the entrypoints. The build-only,
+// quiet, event, and watcher options are set by the session.
+func startWatchSession(t *testing.T, options watchOptions, entrypoints ...string) *watchSession {
+	t.Helper()
+	return startAssetsWatchSession(t, options, nil, entrypoints...)
+}
+
+// startAssetsWatchSession is like startWatchSession, but also watches the
+// assets files, like '--assets'.
+func startAssetsWatchSession(t *testing.T, options watchOptions, assetsPaths []string, entrypoints ...string) *watchSession {
+	t.Helper()
+	s := &watchSession{
+		t:      t,
+		sdk:    newFakeSDK(t),
+		events: make(chan WatchEvent, 1000),
+	}
+	options.buildOnly = true
+	options.quiet = true
+	options.onEvent = func(event WatchEvent) { s.events <- event }
+	options.newWatcher = func() (*watcher, error) {
+		s.watcher, s.fake = newFakeWatcher()
+		return s.watcher, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	done, err := startWatch(ctx, nil, nil, s.sdk, entrypoints, assetsPaths, -1, options)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	s.done = done
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(sessionTimeout):
+			t.Error("the session didn't stop")
+		}
+	})
+	return s
+}
+
+// next returns the next event of one of the types.
+func (s *watchSession) next(types ...string) WatchEvent {
+	s.t.Helper()
+	timeout := time.After(sessionTimeout)
+	for {
+		select {
+		case event := <-s.events:
+			for _, t := range types {
+				if event.Type == t {
+					return event
+				}
+			}
+		case <-timeout:
+			s.t.Fatalf("no %v event within %s", types, sessionTimeout)
+		}
+	}
+}
+
+// runEnd waits for the end of the next run and returns its exit code.
+func (s *watchSession) runEnd() int {
+	s.t.Helper()
+	event := s.next(WatchEventRunEnd)
+	return *event.Exit
+}
+
+// expectNoRun fails if a run starts within the duration.
+func (s *watchSession) expectNoRun(d time.Duration) {
+	s.t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case event := <-s.events:
+			if event.Type == WatchEventRunStart {
+				s.t.Fatalf("unexpected run of '%s' for '%s'", event.Entrypoint, event.File)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// waitUntilWatched waits until the entrypoint depends on the path, which
+// the analysis in the background does after the runs started.
+func (s *watchSession) waitUntilWatched(entrypoint string, path string) {
+	s.t.Helper()
+	deadline := time.Now().Add(sessionTimeout)
+	for !s.watcher.DependsOn(entrypoint, path) {
+		if time.Now().After(deadline) {
+			s.t.Fatalf("'%s' doesn't depend on '%s'", entrypoint, path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// send delivers the event to the session.
+func (s *watchSession) send(path string, op fsnotify.Op) {
+	s.t.Helper()
+	select {
+	case s.fake.events <- fsnotify.Event{Name: path, Op: op}:
+	case <-time.After(sessionTimeout):
+		s.t.Fatalf("the session doesn't take events")
+	}
+}
+
+// change writes the file and tells the session about it.
+func (s *watchSession) change(path string, content string) {
+	s.t.Helper()
+	writeFile(s.t, path, content)
+	s.send(path, fsnotify.Write)
+}
+
+// imports returns the content of a file that imports the paths.
+func imports(paths ...string) string {
+	var res strings.Builder
+	for _, p := range paths {
+		fmt.Fprintf(&res, "import %s\n", p)
+	}
+	return res.String()
+}
+
+func TestWatchCoalescesBursts(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	var libs []string
+	for i := 0; i < 10; i++ {
+		lib := filepath.Join(dir, fmt.Sprintf("lib%d.toit", i))
+		writeFile(t, lib, "")
+		libs = append(libs, lib)
+	}
+	writeFile(t, main, imports(libs...))
+
+	debounce := 200 * time.Millisecond
+	s := startWatchSession(t, watchOptions{debounce: debounce}, main)
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the first run failed with %d", exit)
+	}
+	for _, lib := range libs {
+		s.waitUntilWatched(main, lib)
+	}
+
+	// The burst is longer than the debounce, but the gaps between the
+	// events are shorter.
+	for i := 0; i < 50; i++ {
+		s.change(libs[i%len(libs)], fmt.Sprintf("// %d\n", i))
+		time.Sleep(debounce / 40)
+	}
+	s.next(WatchEventRunStart)
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the run failed with %d", exit)
+	}
+	s.expectNoRun(3 * debounce)
+}
+
+func TestWatchIgnoreInitialError(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	writeFile(t, main, "broken\n")
+
+	// Without Once, through the API, with a real file watcher.
+	events := make(chan WatchEvent, 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done, err := Watch(ctx, WatchOptions{
+		Entrypoints:        []string{main},
+		SDK:                newFakeSDK(t),
+		BuildOnly:          true,
+		OptimizationLevel:  -1,
+		Debounce:           50 * time.Millisecond,
+		IgnoreInitialError: true,
+		Quiet:              true,
+		OnEvent:            func(event WatchEvent) { events <- event },
+	})
+	if err != nil {
+		t.Fatalf("IgnoreInitialError without Once was rejected: %v", err)
+	}
+	s := &watchSession{t: t, events: events, done: done}
+	if exit := s.runEnd(); exit == 0 {
+		t.Fatalf("the broken file compiled")
+	}
+	// The real watcher needs the directory of the entrypoint to be
+	// watched, which the analysis does in the background.
+	deadline := time.Now().Add(sessionTimeout)
+	for {
+		writeFile(t, main, "// fixed\n")
+		select {
+		case event := <-events:
+			if event.Type != WatchEventRunEnd {
+				continue
+			}
+			if *event.Exit != 0 {
+				t.Fatalf("the fixed file failed with %d", *event.Exit)
+			}
+		case err := <-done:
+			t.Fatalf("the watch stopped: %v", err)
+		case <-time.After(200 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatal("the fix wasn't run")
+			}
+			continue
+		}
+		break
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("the watch stopped after the fix: %v", err)
+	default:
+	}
+}
+
+func TestWatchOnceIgnoreInitialError(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	lib := filepath.Join(dir, "lib.toit")
+	writeFile(t, lib, "broken\n")
+	writeFile(t, main, imports(lib))
+
+	s := startWatchSession(t, watchOptions{once: true, ignoreInitialError: true}, main)
+	if exit := s.runEnd(); exit == 0 {
+		t.Fatalf("the broken file compiled")
+	}
+	s.waitUntilWatched(main, lib)
+	select {
+	case err := <-s.done:
+		t.Fatalf("the watch stopped after the compile error: %v", err)
+	default:
+	}
+
+	// Still broken.
+	s.change(lib, "broken again\n")
+	if exit := s.runEnd(); exit == 0 {
+		t.Fatalf("the broken file compiled")
+	}
+	s.change(lib, "// fixed\n")
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the fixed file failed with %d", exit)
+	}
+	select {
+	case err := <-s.done:
+		if err != nil {
+			t.Errorf("got %v, want a successful watch", err)
+		}
+	case <-time.After(sessionTimeout):
+		t.Fatal("the watch didn't stop after the fix")
+	}
+}
+
+func TestWatchOnceInitialError(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	writeFile(t, main, "broken\n")
+
+	s := startWatchSession(t, watchOptions{once: true}, main)
+	select {
+	case err := <-s.done:
+		if err == nil {
+			t.Errorf("the watch succeeded, want the compile error")
+		}
+	case <-time.After(sessionTimeout):
+		t.Fatal("the watch didn't stop after the first run")
+	}
+}
+
+// BenchmarkDependencyAnalysis compares a re-run of an entrypoint whose
+// dependencies didn't change, which uses the cached analysis, with a
+// re-run that runs the analyzer again.
+func BenchmarkDependencyAnalysis(b *testing.B) {
+	sdk := newFakeSDK(b)
+	dir := b.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	var libs []string
+	for i := 0; i < 50; i++ {
+		lib := filepath.Join(dir, fmt.Sprintf("lib%d.toit", i))
+		libs = append(libs, lib)
+	}
+	files := append([]string{main}, libs...)
+	for _, f := range files {
+		content := ""
+		if f == main {
+			content = imports(libs...)
+		}
+		if err := os.WriteFile(f, []byte(content), 0644); err != nil {
+			b.Fatal(err)
+		}
+		// The cache only trusts files that were modified before the
+		// analysis started.
+		old := time.Now().Add(-time.Minute)
+		if err := os.Chtimes(f, old, old); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	nop := func(format string, a ...interface{}) {}
+	for _, cached := range []bool{false, true} {
+		name := "uncached"
+		if cached {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			depFiles, err := newDependencyFiles([]string{main}, "")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer depFiles.Close()
+			ctx := context.Background()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !cached {
+					depFiles.invalidate(main)
+				}
+				paths, err := depFiles.analyze(ctx, sdk, main, nop, nop)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(paths) != len(files) {
+					b.Fatalf("got %d dependencies, want %d", len(paths), len(files))
+				}
+			}
+		})
+	}
+}
+
+func TestWatchDeleteAndRecreate(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	lib := filepath.Join(dir, "lib.toit")
+	writeFile(t, lib, "")
+	writeFile(t, main, imports(lib))
+
+	s := startWatchSession(t, watchOptions{}, main)
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the first run failed with %d", exit)
+	}
+	s.waitUntilWatched(main, lib)
+
+	// Editors that save by deleting and recreating the file.
+	for i := 0; i < 2; i++ {
+		if err := os.Remove(lib); err != nil {
+			t.Fatal(err)
+		}
+		s.send(lib, fsnotify.Remove)
+		writeFile(t, lib, fmt.Sprintf("// %d\n", i))
+		s.send(lib, fsnotify.Create)
+		s.next(WatchEventRunStart)
+		if exit := s.runEnd(); exit != 0 {
+			t.Fatalf("the run failed with %d", exit)
+		}
+		s.waitUntilWatched(main, lib)
+	}
+
+	// Editors that save by renaming a temporary file over the original.
+	writeFile(t, lib, "// renamed\n")
+	s.send(lib, fsnotify.Rename)
+	s.send(lib, fsnotify.Create)
+	event := s.next(WatchEventRunStart)
+	if event.File != lib {
+		t.Errorf("the run was for '%s', want '%s'", event.File, lib)
+	}
+	s.runEnd()
+}
+
+func TestWatchNewImportFixesCompileError(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	lib := filepath.Join(dir, "lib", "lib.toit")
+	sibling := filepath.Join(dir, "new.toit")
+	writeFile(t, lib, "")
+	writeFile(t, main, imports(lib, sibling))
+
+	s := startWatchSession(t, watchOptions{}, main)
+	if exit := s.runEnd(); exit == 0 {
+		t.Fatalf("the run succeeded, but '%s' doesn't exist", sibling)
+	}
+	// While the entrypoint doesn't compile, any Toit file in its directory,
+	// or in the directories of the partial dependency file, might be the
+	// fix.
+	s.waitUntilWatched(main, sibling)
+	s.waitUntilWatched(main, filepath.Join(dir, "lib", "other.toit"))
+	if s.watcher.DependsOn(main, filepath.Join(dir, "notes.txt")) {
+		t.Errorf("other files than Toit files are watched")
+	}
+
+	writeFile(t, sibling, "")
+	s.send(sibling, fsnotify.Create)
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the run failed with %d after creating '%s'", exit, sibling)
+	}
+
+	// Now the new file is a regular dependency, and the directories are
+	// only watched for it.
+	deadline := time.Now().Add(sessionTimeout)
+	for s.watcher.DependsOn(main, filepath.Join(dir, "lib", "other.toit")) {
+		if time.Now().After(deadline) {
+			t.Fatal("the directories are still watched for any Toit file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.waitUntilWatched(main, sibling)
+	s.change(sibling, "broken\n")
+	if exit := s.runEnd(); exit == 0 {
+		t.Fatalf("the run succeeded with a broken '%s'", sibling)
+	}
+}
+
+// watchTempFiles returns the temporary files and directories of 'jag watch'
+// in dir.
+func watchTempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var res []string
+	for _, pattern := range []string{"jag_watch*", "*.txt"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, matches...)
+	}
+	return res
+}
+
+func TestWatchNoStrayTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	lib := filepath.Join(dir, "lib.toit")
+	writeFile(t, lib, "")
+	writeFile(t, main, imports(lib))
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	s := startWatchSession(t, watchOptions{}, main)
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the first run failed with %d", exit)
+	}
+	s.waitUntilWatched(main, lib)
+	for i := 0; i < 20; i++ {
+		s.change(lib, fmt.Sprintf("// %d\n", i))
+		s.next(WatchEventRunStart)
+		if exit := s.runEnd(); exit != 0 {
+			t.Fatalf("the run failed with %d", exit)
+		}
+	}
+	// The dependency files of the session share one directory.
+	s.waitUntilWatched(main, lib)
+	var deps []string
+	for _, f := range watchTempFiles(t, tmp) {
+		if strings.HasPrefix(filepath.Base(f), "jag_watch_deps") {
+			deps = append(deps, f)
+		} else if strings.HasSuffix(f, ".txt") {
+			t.Errorf("stray temporary file '%s'", f)
+		}
+	}
+	if len(deps) != 1 {
+		t.Errorf("got the dependency directories %q, want one", deps)
+	}
+
+	s.cancel()
+	select {
+	case <-s.done:
+	case <-time.After(sessionTimeout):
+		t.Fatal("the session didn't stop")
+	}
+	if files := watchTempFiles(t, tmp); len(files) != 0 {
+		t.Errorf("the session left %q behind", files)
+	}
+}
+
+func TestWatchAssets(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	other := filepath.Join(dir, "other.toit")
+	assets := filepath.Join(dir, "assets", "data.assets")
+	writeFile(t, main, "")
+	writeFile(t, other, "")
+	writeFile(t, assets, "v1")
+
+	s := startAssetsWatchSession(t, watchOptions{}, []string{assets}, main, other)
+	for i := 0; i < 2; i++ {
+		if exit := s.runEnd(); exit != 0 {
+			t.Fatalf("the first run failed with %d", exit)
+		}
+	}
+	s.waitUntilWatched(main, assets)
+	s.waitUntilWatched(other, assets)
+
+	// Every entrypoint uses the assets. The runs of the entrypoints
+	// overlap.
+	s.change(assets, "v2")
+	runs := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		event := s.next(WatchEventRunStart)
+		if event.File != assets {
+			t.Errorf("the run was for '%s', want '%s'", event.File, assets)
+		}
+		runs[event.Entrypoint] = true
+	}
+	if !runs[main] || !runs[other] {
+		t.Errorf("re-ran %v, want both entrypoints", runs)
+	}
+}
+
+func TestWatchWithoutAssets(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	assets := filepath.Join(dir, "assets", "data.assets")
+	writeFile(t, main, "")
+	writeFile(t, assets, "v1")
+
+	s := startWatchSession(t, watchOptions{}, main)
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the first run failed with %d", exit)
+	}
+	s.waitUntilWatched(main, main)
+	if s.watcher.DependsOn(main, assets) {
+		t.Errorf("'%s' is watched without --assets", assets)
+	}
+	s.change(assets, "v2")
+	s.expectNoRun(500 * time.Millisecond)
+}
+
+func TestWatchRunsAfterAnalysis(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	writeFile(t, main, "analyze-delay 0.3\n")
+
+	s := startWatchSession(t, watchOptions{}, main)
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the first run failed with %d", exit)
+	}
+	s.waitUntilWatched(main, main)
+
+	// The re-run only starts once the slow analysis is done, so the new
+	// import is watched by the time it compiles.
+	for i := 0; i < 2; i++ {
+		lib := filepath.Join(dir, fmt.Sprintf("lib%d.toit", i))
+		writeFile(t, lib, "")
+		s.change(main, "analyze-delay 0.3\n"+imports(lib))
+		s.next(WatchEventRunStart)
+		if !s.watcher.DependsOn(main, lib) {
+			t.Fatalf("the run started before the analysis found '%s'", lib)
+		}
+		if exit := s.runEnd(); exit != 0 {
+			t.Fatalf("the run failed with %d", exit)
+		}
+	}
+}
+
+func TestWatchRecoversFromRemovedDirectory(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	libDir := filepath.Join(dir, "lib")
+	lib := filepath.Join(libDir, "lib.toit")
+	writeFile(t, lib, "")
+	writeFile(t, main, imports(lib))
+
+	s := startWatchSession(t, watchOptions{}, main)
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the first run failed with %d", exit)
+	}
+	s.waitUntilWatched(main, lib)
+
+	// The directory is replaced, like with a 'git checkout'. The first
+	// attempt to watch it again fails, as if it wasn't back yet.
+	var failed sync.Once
+	s.fake.Lock()
+	s.fake.failAdd = func(d string) error {
+		var err error
+		if d == libDir {
+			failed.Do(func() { err = &os.PathError{Op: "add", Path: d, Err: os.ErrNotExist} })
+		}
+		return err
+	}
+	s.fake.Unlock()
+	if err := os.RemoveAll(libDir); err != nil {
+		t.Fatal(err)
+	}
+	s.send(libDir, fsnotify.Remove)
+	writeFile(t, lib, "// restored\n")
+
+	// Changes might have been missed, so the entrypoint is re-run.
+	if event := s.next(WatchEventRunStart); event.Entrypoint != main {
+		t.Errorf("re-ran '%s', want '%s'", event.Entrypoint, main)
+	}
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the run failed with %d", exit)
+	}
+	if n := s.fake.addCount(libDir); n < 2 || !s.fake.isWatched(libDir) {
+		t.Errorf("'%s' wasn't watched again", libDir)
+	}
+	s.waitUntilWatched(main, lib)
+	s.change(lib, "// changed\n")
+	if event := s.next(WatchEventRunStart); event.File != lib {
+		t.Errorf("the run was for '%s', want '%s'", event.File, lib)
+	}
+	s.runEnd()
+}
+
+func TestWatchEntrypointDeleted(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	writeFile(t, main, "")
+
+	s := startWatchSession(t, watchOptions{}, main)
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the first run failed with %d", exit)
+	}
+	if err := os.Remove(main); err != nil {
+		t.Fatal(err)
+	}
+	s.send(main, fsnotify.Remove)
+	if event := s.next(WatchEventDeleted); event.Entrypoint != main {
+		t.Errorf("got the deletion of '%s', want '%s'", event.Entrypoint, main)
+	}
+	select {
+	case err := <-s.done:
+		if err == nil || !strings.Contains(err.Error(), "deleted") {
+			t.Errorf("got %v, want an error about the deleted entrypoint", err)
+		}
+	case <-time.After(sessionTimeout):
+		t.Fatal("the watch didn't stop")
+	}
+}
+
+func TestWatchWaitForEntrypoint(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	writeFile(t, main, "")
+
+	s := startWatchSession(t, watchOptions{waitForEntrypoint: true}, main)
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the first run failed with %d", exit)
+	}
+	for i := 0; i < 2; i++ {
+		if err := os.Remove(main); err != nil {
+			t.Fatal(err)
+		}
+		s.send(main, fsnotify.Remove)
+		s.next(WatchEventDeleted)
+		select {
+		case err := <-s.done:
+			t.Fatalf("the watch stopped: %v", err)
+		default:
+		}
+
+		writeFile(t, main, fmt.Sprintf("// %d\n", i))
+		s.send(main, fsnotify.Create)
+		if event := s.next(WatchEventRunStart); event.Entrypoint != main {
+			t.Errorf("re-ran '%s', want '%s'", event.Entrypoint, main)
+		}
+		if exit := s.runEnd(); exit != 0 {
+			t.Fatalf("the run of the recreated entrypoint failed with %d", exit)
+		}
+		s.waitUntilWatched(main, main)
+	}
+}
+
+// repoint points the symlink to the target, like 'ln -sfn', and tells the
+// session about it.
+func (s *watchSession) repoint(link string, target string) {
+	s.t.Helper()
+	tmp := link + ".tmp"
+	if err := os.Symlink(target, tmp); err != nil {
+		s.t.Fatal(err)
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		s.t.Fatal(err)
+	}
+	s.send(link, fsnotify.Create)
+}
+
+func TestWatchRepointedSymlink(t *testing.T) {
+	dir := t.TempDir()
+	var mains, libs []string
+	for i := 1; i <= 2; i++ {
+		release := filepath.Join(dir, fmt.Sprintf("release-%d", i))
+		lib := filepath.Join(release, "lib.toit")
+		main := filepath.Join(release, "main.toit")
+		writeFile(t, lib, "")
+		writeFile(t, main, imports(lib))
+		mains = append(mains, main)
+		libs = append(libs, lib)
+	}
+	current := filepath.Join(dir, "current.toit")
+	if err := os.Symlink(mains[0], current); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+
+	s := startWatchSession(t, watchOptions{}, current)
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the first run failed with %d", exit)
+	}
+	s.waitUntilWatched(current, libs[0])
+
+	for _, i := range []int{1, 0} {
+		s.repoint(current, mains[i])
+		if event := s.next(WatchEventRunStart); event.Entrypoint != current {
+			t.Errorf("re-ran '%s', want '%s'", event.Entrypoint, current)
+		}
+		if exit := s.runEnd(); exit != 0 {
+			t.Fatalf("the run failed with %d", exit)
+		}
+		// The dependencies of the new target are watched instead.
+		s.waitUntilWatched(current, libs[i])
+		old := libs[1-i]
+		if s.watcher.DependsOn(current, old) {
+			t.Errorf("'%s' is still watched", old)
+		}
+		s.change(old, "// changed\n")
+		s.expectNoRun(300 * time.Millisecond)
+		s.change(libs[i], "// changed\n")
+		if event := s.next(WatchEventRunStart); event.File != libs[i] {
+			t.Errorf("the run was for '%s', want '%s'", event.File, libs[i])
+		}
+		s.runEnd()
+	}
+}
+
+// compileLog returns the arguments of the compilations so far, one line per
+// compilation.
+func (s *watchSession) compileLog() []string {
+	s.t.Helper()
+	b, err := os.ReadFile(filepath.Join(s.sdk.Path, "bin", "compile.log"))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+// lastCompileLevel returns the optimization flag of the last compilation,
+// or "" if the compiler default was used.
+func (s *watchSession) lastCompileLevel() string {
+	s.t.Helper()
+	log := s.compileLog()
+	for _, arg := range strings.Fields(log[len(log)-1]) {
+		if strings.HasPrefix(arg, "-O") {
+			return arg
+		}
+	}
+	return ""
+}
+
+func TestWatchReloadsOptimizationLevel(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	config := filepath.Join(dir, projectConfigName)
+	writeFile(t, main, "")
+
+	for _, reload := range []bool{true, false} {
+		writeFile(t, config, "watch:\n  optimization-level: 2\n")
+		s := startWatchSession(t, watchOptions{reloadOptimizationLevel: reload}, main)
+		s.runEnd()
+		s.waitUntilWatched(main, main)
+		want := "-O2"
+		if !reload {
+			// As if the level was given on the command line.
+			want = ""
+		}
+		if got := s.lastCompileLevel(); got != want {
+			t.Errorf("reload %v: compiled with %q, want %q", reload, got, want)
+		}
+
+		writeFile(t, config, "watch:\n  optimization-level: 0\n")
+		s.change(main, "// changed\n")
+		s.runEnd()
+		if reload {
+			want = "-O0"
+		}
+		if got := s.lastCompileLevel(); got != want {
+			t.Errorf("reload %v: compiled with %q after the change, want %q", reload, got, want)
+		}
+
+		// A configuration that is being edited keeps the previous level.
+		writeFile(t, config, "watch:\n  optimization-level: [\n")
+		s.change(main, "// changed again\n")
+		s.runEnd()
+		if got := s.lastCompileLevel(); got != want {
+			t.Errorf("reload %v: compiled with %q with a malformed configuration, want %q", reload, got, want)
+		}
+		s.cancel()
+	}
+}
+
+// within fails the test if the function takes longer than the duration.
+func within(t *testing.T, d time.Duration, what string, f func()) {
+	t.Helper()
+	start := time.Now()
+	f()
+	if elapsed := time.Since(start); elapsed > d {
+		t.Errorf("%s took %s, want at most %s", what, elapsed, d)
+	}
+}
+
+func TestWatchCancelsStaleAnalysis(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	lib := filepath.Join(dir, "lib.toit")
+	writeFile(t, lib, "")
+	writeFile(t, main, "")
+
+	s := startWatchSession(t, watchOptions{}, main)
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the first run failed with %d", exit)
+	}
+	s.waitUntilWatched(main, main)
+
+	// The slow analysis is superseded by the next change. Analyses of an
+	// entrypoint are serialized, so the new one would have to wait for the
+	// stale one if it wasn't cancelled.
+	s.change(main, "analyze-delay 5\n")
+	s.next(WatchEventChanged)
+	time.Sleep(100 * time.Millisecond)
+	s.change(main, imports(lib))
+	within(t, 2*time.Second, "the analysis after the superseding change", func() {
+		s.waitUntilWatched(main, lib)
+	})
+}
+
+func TestWatchAnalyzeTimeout(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.toit")
+	lib := filepath.Join(dir, "lib.toit")
+	writeFile(t, lib, "")
+	writeFile(t, main, "")
+
+	s := startWatchSession(t, watchOptions{analyzeTimeout: 200 * time.Millisecond}, main)
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the first run failed with %d", exit)
+	}
+	s.waitUntilWatched(main, main)
+
+	// Runs wait for the analysis, which is cut short.
+	s.change(main, "analyze-delay 5\n"+imports(lib))
+	within(t, 2*time.Second, "the run after the slow analysis", func() {
+		s.next(WatchEventRunStart)
+	})
+	if exit := s.runEnd(); exit != 0 {
+		t.Fatalf("the run failed with %d", exit)
+	}
+	// The files watched before are kept.
+	if !s.watcher.DependsOn(main, main) {
+		t.Errorf("'%s' isn't watched after the analysis timed out", main)
+	}
+
+	s.change(main, imports(lib))
+	s.runEnd()
+	s.waitUntilWatched(main, lib)
+}
+
+func TestWatcherFilesAndDirs(t *testing.T) {
+	dir := t.TempDir()
+	createFiles(t, dir, "main.toit", "lib/a.toit", "lib/b.toit", "fix/c.toit")
+	p := func(name string) string { return filepath.Join(dir, filepath.FromSlash(name)) }
+
+	w, fake := newFakeWatcher()
+	// Only files are dependencies. Their directories are watched, so the
+	// files can be seen being replaced.
+	if err := w.Watch("main.toit", p("main.toit"), p("lib/a.toit")); err != nil {
+		t.Fatal(err)
+	}
+	dirs, files := w.WatchedBy("main.toit")
+	if len(dirs) != 0 || !reflect.DeepEqual(files, []string{p("lib/a.toit"), p("main.toit")}) {
+		t.Errorf("got the directories %q and the files %q, want only the files", dirs, files)
+	}
+	if dirs, _ := w.Watched(); !reflect.DeepEqual(dirs, []string{dir, p("lib")}) {
+		t.Errorf("watched %q, want the directories of the files", dirs)
+	}
+	if !fake.isWatched(p("lib")) {
+		t.Errorf("'%s' isn't watched", p("lib"))
+	}
+	// Other files in the watched directories aren't dependencies.
+	if w.DependsOn("main.toit", p("lib/b.toit")) {
+		t.Errorf("'%s' is a dependency", p("lib/b.toit"))
+	}
+
+	// A directory dependency covers any Toit file in it, and nothing else.
+	if err := w.WatchDirs("main.toit", p("fix")); err != nil {
+		t.Fatal(err)
+	}
+	dirs, files = w.WatchedBy("main.toit")
+	if !reflect.DeepEqual(dirs, []string{p("fix")}) || len(files) != 2 {
+		t.Errorf("got the directories %q and the files %q, want '%s' and the two files", dirs, files, p("fix"))
+	}
+	if !w.DependsOn("main.toit", p("fix/new.toit")) || w.DependsOn("main.toit", p("fix/notes.txt")) {
+		t.Errorf("the directory dependency doesn't cover exactly its Toit files")
+	}
+	if w.DependsOn("main.toit", p("fix")) {
+		t.Errorf("the directory itself is a dependency")
+	}
+}
+
+func TestCommonAncestor(t *testing.T) {
+	root := filepath.FromSlash("/")
+	p := func(name string) string { return filepath.Join(root, filepath.FromSlash(name)) }
+	tests := []struct {
+		dirs []string
+		want string
+	}{
+		{[]string{p("a/b")}, p("a/b")},
+		{[]string{p("a/b/c"), p("a/b/d")}, p("a/b")},
+		{[]string{p("a/b/c"), p("a/b")}, p("a/b")},
+		{[]string{p("a/b"), p("a/b/c/d"), p("a/e")}, p("a")},
+		// Not a path prefix.
+		{[]string{p("a/bc"), p("a/b")}, p("a")},
+		{[]string{p("a"), p("b")}, root},
+	}
+	for _, test := range tests {
+		if got := commonAncestor(test.dirs); got != test.want {
+			t.Errorf("commonAncestor(%q) = %q, want %q", test.dirs, got, test.want)
+		}
+	}
+}
+
+func TestCollapseDirs(t *testing.T) {
+	p := func(name string) string { return filepath.Join(filepath.FromSlash("/"), filepath.FromSlash(name)) }
+	set := func(dirs ...string) map[string]struct{} {
+		res := map[string]struct{}{}
+		for _, d := range dirs {
+			res[p(d)] = struct{}{}
+		}
+		return res
+	}
+	dirs := set("p", "p/a", "p/b", "p/a/x", "p/a/y", "p/b/z")
+
+	var warnings []string
+	w := &watcher{warnf: func(format string, a ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, a...))
+	}}
+	for _, max := range []int{0, 6, 10} {
+		w.maxDirs = max
+		if got := w.collapseDirs(dirs); !reflect.DeepEqual(got, dirs) {
+			t.Errorf("max %d: got %v, want the directories unchanged", max, got)
+		}
+	}
+	if len(warnings) != 0 {
+		t.Errorf("got the warnings %q without a collapse", warnings)
+	}
+
+	// The shallowest directories are kept, and the rest are replaced by
+	// their common ancestor.
+	w.maxDirs = 4
+	want := set("p", "p/a", "p/b")
+	for i := 0; i < 2; i++ {
+		if got := w.collapseDirs(dirs); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	// The collapse is only reported when it changes.
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "3 of them were collapsed into '"+p("p")+"'") {
+		t.Errorf("got the warnings %q, want one report of the collapse", warnings)
+	}
+	w.maxDirs = 2
+	if got, want := w.collapseDirs(dirs), set("p"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(warnings) != 4 {
+		t.Errorf("the new collapse wasn't reported")
+	}
+}
@@ -189,6 +189,16 @@ func GetSDKCachePath() (string, error) {
 	return filepath.Join(home, ".cache", "jaguar", "sdk"), nil
 }
 
+// GetSDKsCachePath returns the directory that holds the SDKs installed with
+// 'jag sdk install', one subdirectory per version.
+func GetSDKsCachePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".cache", "jaguar", "sdks"), nil
+}
+
 func GetEnvelopesCachePath(version string) (string, error) {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -311,6 +321,10 @@ func WriteConfig(cfg *viper.Viper) error {
 	}
 
 	tmpFile := filepath.Join(filepath.Dir(file), ".config.tmp.yaml")
+	// The configuration can hold secrets, like the WiFi password, so only
+	// the user may read it. The file is replaced by the temporary one, which
+	// thus determines its mode.
+	cfg.SetConfigPermissions(0600)
 	if err := cfg.WriteConfigAs(tmpFile); err != nil {
 		return err
 	}
@@ -0,0 +1,61 @@
+// Copyright (C) 2021 Toitware ApS. All rights reserved.
+// Use of this source code is governed by an MIT-style license that can be
+// found in the LICENSE file.
+
+package directory
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestWriteConfigMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows doesn't have Unix file modes")
+	}
+	path := filepath.Join(t.TempDir(), "jaguar", "config.yaml")
+	t.Setenv(UserConfigPathEnv, path)
+
+	// An existing configuration that is readable by everyone, as written
+	// by older versions.
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("sdk:\n  version: v2.0.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		cfg, err := GetUserConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Set("wifi.password", "secret")
+		if err := WriteConfig(cfg); err != nil {
+			t.Fatal(err)
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := stat.Mode().Perm(); mode != 0600 {
+			t.Errorf("the configuration has mode %o, want 600", mode)
+		}
+	}
+
+	cfg, err := GetUserConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.GetString("wifi.password"); got != "secret" {
+		t.Errorf("got the password %q, want %q", got, "secret")
+	}
+	if got := cfg.GetString("sdk.version"); got != "v2.0.0" {
+		t.Errorf("the existing setting was lost, got %q", got)
+	}
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"os"
 
 	"github.com/toitlang/jaguar/cmd/jag/commands"
@@ -18,6 +19,7 @@ var (
 )
 
 var buildDate = "unknown"
+var buildCommit = "unknown"
 var buildMode = "development"
 
 func main() {
@@ -26,12 +28,17 @@ func main() {
 
 	info := commands.Info{
 		Date:       buildDate,
+		Commit:     buildCommit,
 		Version:    version,
 		SDKVersion: sdkVersion,
 	}
 	ctx := commands.SetInfo(context.Background(), info)
 	cmd := commands.JagCmd(info, isReleaseBuild)
 	if err := cmd.ExecuteContext(ctx); err != nil {
+		var exitErr *commands.ExitCodeError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		os.Exit(1)
 	}
 }